@@ -0,0 +1,286 @@
+package jambo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// AuditEvent records a single attach operation.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	CallerUID  int       `json:"callerUid"`
+	Pid        int       `json:"pid"`
+	NsPid      int       `json:"nsPid"`
+	TargetUID  int       `json:"targetUid"`
+	MainClass  string    `json:"mainClass,omitempty"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+
+	// DryRun is set when Options.DryRun was given: nothing was sent to the
+	// target, whatever the outcome.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// TimedOut is set when the caller stopped waiting because of
+	// Options.Timeout or the context deadline. The operation may still
+	// complete in the target.
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// AgentPath and AgentSHA256 identify the agent file of a load command,
+	// as seen from the target's mount namespace. The digest is taken before
+	// the command is sent.
+	AgentPath   string `json:"agentPath,omitempty"`
+	AgentSHA256 string `json:"agentSha256,omitempty"`
+}
+
+// AuditSink receives an AuditEvent for every attach operation, including
+// operations rejected by a Policy.
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// MultiAuditSink sends each event to all of its sinks.
+type MultiAuditSink []AuditSink
+
+// Audit sends event to every sink and returns their joined errors.
+func (m MultiAuditSink) Audit(event *AuditEvent) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Audit(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// JSONLinesAuditSink appends events to a file, one JSON object per line.
+type JSONLinesAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLinesAuditSink opens (or creates) path for appending audit events.
+// The file is created with mode 0600.
+func NewJSONLinesAuditSink(path string) (*JSONLinesAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesAuditSink{file: file}, nil
+}
+
+// Audit writes event as a single line and syncs the file.
+func (s *JSONLinesAuditSink) Audit(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the underlying file.
+func (s *JSONLinesAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// JournaldSocket is the systemd-journald native protocol socket.
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// JournaldAuditSink sends events to systemd-journald using its native
+// datagram protocol, so that every event field becomes a journal field
+// (JAMBO_PID, JAMBO_COMMAND, ...). Events are tagged with
+// SYSLOG_IDENTIFIER=jambo.
+type JournaldAuditSink struct {
+	conn net.Conn
+}
+
+// NewJournaldAuditSink connects to the local journald socket.
+func NewJournaldAuditSink() (*JournaldAuditSink, error) {
+	conn, err := net.Dial("unixgram", JournaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldAuditSink{conn: conn}, nil
+}
+
+// Audit sends event as a single journal entry.
+func (s *JournaldAuditSink) Audit(event *AuditEvent) error {
+	priority := "6" // info
+	if event.Outcome != AuditSuccess {
+		priority = "4" // warning
+	}
+
+	message := fmt.Sprintf("%s %s on pid %d by uid %d", event.Outcome, event.Command, event.Pid, event.CallerUID)
+	if event.DryRun {
+		message += " (dry run)"
+	}
+	if event.Error != "" {
+		message += ": " + event.Error
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", message)
+	writeJournalField(&buf, "PRIORITY", priority)
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "jambo")
+	writeJournalField(&buf, "JAMBO_CALLER_UID", strconv.Itoa(event.CallerUID))
+	writeJournalField(&buf, "JAMBO_PID", strconv.Itoa(event.Pid))
+	writeJournalField(&buf, "JAMBO_NSPID", strconv.Itoa(event.NsPid))
+	writeJournalField(&buf, "JAMBO_TARGET_UID", strconv.Itoa(event.TargetUID))
+	writeJournalField(&buf, "JAMBO_MAIN_CLASS", event.MainClass)
+	writeJournalField(&buf, "JAMBO_COMMAND", event.Command)
+	writeJournalField(&buf, "JAMBO_ARGS", strings.Join(event.Args, " "))
+	writeJournalField(&buf, "JAMBO_OUTCOME", event.Outcome)
+	writeJournalField(&buf, "JAMBO_ERROR", event.Error)
+	writeJournalField(&buf, "JAMBO_DURATION_MS", strconv.FormatInt(event.DurationMs, 10))
+	if event.DryRun {
+		writeJournalField(&buf, "JAMBO_DRY_RUN", "1")
+	}
+	if event.TimedOut {
+		writeJournalField(&buf, "JAMBO_TIMED_OUT", "1")
+	}
+	writeJournalField(&buf, "JAMBO_AGENT_PATH", event.AgentPath)
+	writeJournalField(&buf, "JAMBO_AGENT_SHA256", event.AgentSHA256)
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the journald connection.
+func (s *JournaldAuditSink) Close() error {
+	return s.conn.Close()
+}
+
+// writeJournalField encodes a field in journald's native protocol.
+// Values containing newlines use the length-prefixed binary form; empty
+// values are omitted.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteByte('\n')
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// auditEvent starts the event for an attach operation. The agent file of
+// a load command is hashed now, before anything is sent, so that the event
+// describes the file the JVM is given.
+func (p *Process) auditEvent(info VMInfo, callerUID int, command string, args []string, start time.Time, options *Options) *AuditEvent {
+	event := &AuditEvent{
+		Time:      start.UTC(),
+		CallerUID: callerUID,
+		Pid:       p.pid,
+		NsPid:     p.nsPid,
+		TargetUID: p.uid,
+		MainClass: info.MainClass,
+		Command:   command,
+		Args:      args,
+		DryRun:    options.DryRun,
+	}
+
+	if command == "load" {
+		event.AgentPath = agentFile(args)
+		if event.AgentPath != "" {
+			if sum, err := fileSHA256(targetFilePath(p.pid, event.AgentPath)); err == nil {
+				event.AgentSHA256 = sum
+			}
+		}
+	}
+	return event
+}
+
+// audit completes event with the outcome of the operation and sends it to
+// sink.
+func audit(sink AuditSink, event *AuditEvent, err error) error {
+	event.Outcome = AuditSuccess
+	event.DurationMs = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		event.Outcome = AuditFailure
+		if errors.Is(err, ErrPolicyDenied) {
+			event.Outcome = AuditDenied
+		}
+		event.TimedOut = errors.Is(err, context.DeadlineExceeded)
+		event.Error = err.Error()
+	}
+	return sink.Audit(event)
+}
+
+// agentFile returns the file a load command makes the JVM read: the
+// javaagent jar for the instrument library, or the library itself when
+// given as an absolute path. Relative library names resolved through the
+// JVM's library path yield "".
+func agentFile(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	if args[0] == "instrument" {
+		if len(args) < 3 || args[2] == "" {
+			return ""
+		}
+		jar, _, _ := strings.Cut(args[2], "=")
+		return jar
+	}
+
+	if len(args) > 1 && args[1] == "true" {
+		return args[0]
+	}
+	return ""
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of a file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,294 @@
+package jambo
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// JcmdCatalog lists the diagnostic commands a JVM implements, as reported
+// by its own jcmd help.
+type JcmdCatalog struct {
+	// Version identifies the JVM build the catalog was read from: the
+	// java.vm.name, java.vm.version and java.runtime.version properties.
+	// It is empty if they could not all be read.
+	Version string `json:"version"`
+
+	// Detailed reports whether Commands describe options and permissions.
+	// OpenJ9 only lists command names.
+	Detailed bool `json:"detailed"`
+
+	// Commands are the diagnostic commands, in the order listed by help.
+	Commands []JcmdCommand `json:"commands"`
+}
+
+// JcmdCommand describes a diagnostic command, from "help -all".
+type JcmdCommand struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Impact is the command's effect on the JVM, e.g. "Low" or "High:
+	// Depends on Java heap size and content."
+	Impact string `json:"impact,omitempty"`
+
+	// Permission is the Java permission the command requires when the
+	// JVM runs with a security manager, e.g.
+	// "java.lang.management.ManagementPermission(monitor)". It is empty if
+	// none is required.
+	Permission string `json:"permission,omitempty"`
+
+	// Syntax is the usage line, e.g. "GC.heap_dump [options] <filename>".
+	Syntax string `json:"syntax,omitempty"`
+
+	// Arguments are the positional arguments, in order.
+	Arguments []JcmdOption `json:"arguments,omitempty"`
+
+	// Options are the options given as <key> or <key>=<value>.
+	Options []JcmdOption `json:"options,omitempty"`
+}
+
+// JcmdOption describes an argument or option of a diagnostic command.
+type JcmdOption struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`    // e.g. "BOOLEAN", "STRING", "MEMORY SIZE"
+	Default     string `json:"default,omitempty"` // as printed, e.g. "false" or "no default value"
+	Optional    bool   `json:"optional,omitempty"`
+}
+
+// jcmdCatalogs caches catalogs by JcmdCatalog.Version. The same mutex
+// guards Process.jcmdCatalog.
+var (
+	jcmdCatalogsMu sync.Mutex
+	jcmdCatalogs   = map[string]*JcmdCatalog{}
+)
+
+// JcmdCommands returns the catalog of diagnostic commands of the JVM. The
+// first call reads the JVM's properties to identify its version, and runs
+// jcmd help and, on HotSpot, help -all unless a JVM of the same version has
+// been asked before. A JVM whose version cannot be identified is always
+// asked. Later calls on the same Process send nothing.
+//
+// Once the catalog is known, Attach and Jcmd reject jcmd commands and
+// options it does not list with ErrUnsupportedCommand, before sending.
+// Options may be nil; PrintOutput and Output are ignored.
+func (p *Process) JcmdCommands(options *Options) (*JcmdCatalog, error) {
+	jcmdCatalogsMu.Lock()
+	catalog := p.jcmdCatalog
+	jcmdCatalogsMu.Unlock()
+	if catalog != nil {
+		return catalog, nil
+	}
+
+	options = quietOptions(options)
+	properties, err := p.Attach("properties", nil, options)
+	if err != nil {
+		return nil, err
+	}
+	version := catalogVersion(parseProperties([]byte(properties)))
+
+	if version != "" {
+		jcmdCatalogsMu.Lock()
+		catalog = jcmdCatalogs[version]
+		jcmdCatalogsMu.Unlock()
+	}
+
+	if catalog == nil {
+		if catalog, err = p.readJcmdCatalog(options); err != nil {
+			return nil, err
+		}
+		catalog.Version = version
+		// Without a version, the catalog only applies to this Process
+		if version != "" {
+			jcmdCatalogsMu.Lock()
+			jcmdCatalogs[version] = catalog
+			jcmdCatalogsMu.Unlock()
+		}
+	}
+
+	jcmdCatalogsMu.Lock()
+	p.jcmdCatalog = catalog
+	jcmdCatalogsMu.Unlock()
+	return catalog, nil
+}
+
+// catalogVersion returns the key of a JVM build in jcmdCatalogs, or "" if
+// any of its properties is missing.
+func catalogVersion(props map[string]string) string {
+	parts := []string{props["java.vm.name"], props["java.vm.version"], props["java.runtime.version"]}
+	if slices.Contains(parts, "") {
+		return ""
+	}
+	return strings.Join(parts, " ")
+}
+
+// readJcmdCatalog runs jcmd help, and help -all where supported.
+func (p *Process) readJcmdCatalog(options *Options) (*JcmdCatalog, error) {
+	output, err := p.Attach("jcmd", []string{"help"}, options)
+	if err != nil {
+		return nil, fmt.Errorf("jcmd help: %w", err)
+	}
+	names := parseJcmdHelp(diagnosticOutput(output))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("jcmd help listed no commands")
+	}
+
+	if p.detectInAttachPath(options).Type() == OpenJ9 {
+		catalog := &JcmdCatalog{}
+		for _, name := range names {
+			catalog.Commands = append(catalog.Commands, JcmdCommand{Name: name})
+		}
+		return catalog, nil
+	}
+
+	output, err = p.Attach("jcmd", []string{"help -all"}, options)
+	if err != nil {
+		return nil, fmt.Errorf("jcmd help -all: %w", err)
+	}
+	return parseJcmdHelpAll(output, names), nil
+}
+
+// Command returns the command with the given name, or nil.
+func (c *JcmdCatalog) Command(name string) *JcmdCommand {
+	for i := range c.Commands {
+		if c.Commands[i].Name == name {
+			return &c.Commands[i]
+		}
+	}
+	return nil
+}
+
+// Names returns the command names, in the order listed by help.
+func (c *JcmdCatalog) Names() []string {
+	names := make([]string, len(c.Commands))
+	for i, command := range c.Commands {
+		names[i] = command.Name
+	}
+	return names
+}
+
+// Check returns ErrUnsupportedCommand if the catalog does not list the jcmd
+// command given by args, in the form passed to Attach, or, for a detailed
+// catalog, if an option is unknown or there are more positional arguments
+// than the command takes.
+func (c *JcmdCatalog) Check(args []string) error {
+	fields := splitJavaOptions(strings.Join(args, " "))
+	name := "help"
+	if len(fields) > 0 {
+		name, fields = fields[0], fields[1:]
+	}
+
+	command := c.Command(name)
+	if command == nil {
+		return fmt.Errorf("%w: jcmd %s is not available in %s", ErrUnsupportedCommand, name, c.Version)
+	}
+	if !c.Detailed || name == "help" {
+		return nil
+	}
+
+	positional := 0
+	for _, field := range fields {
+		key, _, _ := strings.Cut(field, "=")
+		if slices.ContainsFunc(command.Options, func(o JcmdOption) bool { return o.Name == key }) {
+			continue
+		}
+		positional++
+		if positional > len(command.Arguments) {
+			return fmt.Errorf("%w: jcmd %s has no option or argument %q in %s", ErrUnsupportedCommand, name, field, c.Version)
+		}
+	}
+	return nil
+}
+
+// parseJcmdHelp returns the command names listed by jcmd help, which
+// follow "The following commands are available:" one per line.
+func parseJcmdHelp(output string) []string {
+	var names []string
+	listing := false
+	for line := range strings.Lines(output) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "The following commands are available") {
+			listing = true
+			continue
+		}
+		if !listing {
+			continue
+		}
+		if line == "" {
+			if len(names) > 0 {
+				break
+			}
+			continue
+		}
+		if strings.ContainsAny(line, " \t") {
+			break
+		}
+		names = append(names, line)
+	}
+	return names
+}
+
+// jcmdOptionLine matches an argument or option of help -all, e.g.
+//
+//	-all : [optional] Dump all objects, including unreachable objects (BOOLEAN, false)
+var jcmdOptionLine = regexp.MustCompile(`^(.+?) : (\[optional\] )?(.*?)(?: \(([A-Z][A-Z ]*), ([^()]*)\))?$`)
+
+// parseJcmdHelpAll parses the output of help -all, which describes each
+// command in turn: its name alone on a line, a description, then
+// "Impact:", "Permission:" and "Syntax :" lines and the "Arguments:" and
+// "Options:" lists. names are the commands listed by help; a line equal to
+// one of them starts its description.
+func parseJcmdHelpAll(output string, names []string) *JcmdCatalog {
+	catalog := &JcmdCatalog{Detailed: true}
+	for _, name := range names {
+		catalog.Commands = append(catalog.Commands, JcmdCommand{Name: name})
+	}
+
+	var command *JcmdCommand
+	var list *[]JcmdOption
+	for line := range strings.Lines(output) {
+		indented := strings.HasPrefix(line, "\t") || strings.HasPrefix(line, " ")
+		line = strings.TrimSpace(line)
+
+		if !indented {
+			if c := catalog.Command(line); c != nil {
+				command, list = c, nil
+				continue
+			}
+		}
+		if command == nil || line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "Impact:"):
+			command.Impact = strings.TrimSpace(strings.TrimPrefix(line, "Impact:"))
+		case strings.HasPrefix(line, "Permission:"):
+			command.Permission = strings.TrimSpace(strings.TrimPrefix(line, "Permission:"))
+		case strings.HasPrefix(line, "Syntax"):
+			_, syntax, _ := strings.Cut(line, ":")
+			command.Syntax = strings.TrimSpace(syntax)
+		case strings.HasPrefix(line, "Arguments:"):
+			list = &command.Arguments
+		case strings.HasPrefix(line, "Options:"):
+			list = &command.Options
+		case list != nil && indented:
+			if m := jcmdOptionLine.FindStringSubmatch(line); m != nil {
+				*list = append(*list, JcmdOption{
+					Name:        m[1],
+					Optional:    m[2] != "",
+					Description: strings.TrimSpace(m[3]),
+					Type:        m[4],
+					Default:     m[5],
+				})
+			}
+		case command.Description == "" && command.Impact == "":
+			command.Description = line
+		case command.Impact == "":
+			command.Description += " " + line
+		}
+	}
+	return catalog
+}
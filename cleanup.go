@@ -0,0 +1,40 @@
+package jambo
+
+// StaleFile is attach state left behind by an aborted attach or by a JVM
+// that is gone.
+type StaleFile struct {
+	// Path is the file, directory or semaphore file, as seen from jambo.
+	Path string `json:"path"`
+
+	// Reason explains why the entry is stale.
+	Reason string `json:"reason"`
+}
+
+// Cleanup removes stale attach state from the temporary directory of pid,
+// or from the host's /tmp if pid is 0: HotSpot .attach_pid files of
+// processes that are gone, .java_pid sockets that refuse connections,
+// OpenJ9 .com_ibm_tools_attach entries of dead JVMs, leftover replyInfo
+// files, and semaphore posts left by aborted attaches. The target's
+// namespaces are not entered; its files are reached through
+// /proc/{pid}/root, and its semaphore is only repaired if jambo shares its
+// IPC namespace. A semaphore that does not exist is never created.
+//
+// Options.DryRun reports what would be removed without changing anything.
+// Options.AttachPath selects another directory; for OpenJ9, the JVM's own
+// attach directory is used, as for Attach.
+//
+// Example:
+//
+//	stale, err := jambo.Cleanup(12345, &jambo.Options{DryRun: true})
+//	for _, f := range stale {
+//	    fmt.Printf("%s: %s\n", f.Path, f.Reason)
+//	}
+func Cleanup(pid int, options *Options) ([]StaleFile, error) {
+	if pid < 0 {
+		return nil, ErrInvalidPID
+	}
+	if options == nil {
+		options = &Options{}
+	}
+	return cleanup(pid, options)
+}
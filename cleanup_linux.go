@@ -0,0 +1,203 @@
+//go:build linux
+
+package jambo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cleanup implements Cleanup.
+func cleanup(pid int, options *Options) ([]StaleFile, error) {
+	tmpPath, procRoot, nspid := "/tmp", "/proc", 0
+	attachDir := ""
+	sharesIPC := true
+
+	if pid != 0 {
+		proc, err := NewProcess(pid)
+		if err != nil {
+			return nil, err
+		}
+		defer proc.Close()
+		jvm := proc.detectInAttachPath(options)
+
+		// Reach the target's files without entering its namespaces
+		opts := *options
+		opts.procPid = pid
+		if tmpPath, err = proc.getTempPath(jvm, &opts); err != nil {
+			return nil, err
+		}
+		procRoot = targetFilePath(pid, "/proc")
+		nspid = proc.nsPid
+		if o, ok := jvm.(*openJ9); ok {
+			attachDir = o.attachDir(tmpPath, nspid, &opts)
+		}
+		sharesIPC = sharesNamespace(pid, "ipc")
+	} else if path := options.attachPathOverride(); path != "" {
+		tmpPath = path
+	}
+	if attachDir == "" {
+		attachDir = tmpPath + "/.com_ibm_tools_attach"
+	}
+
+	stale := removeStaleHotSpotFiles(tmpPath, procRoot, nspid, options.DryRun)
+
+	openJ9Stale, err := cleanupOpenJ9(attachDir, procRoot, nspid, sharesIPC, options)
+	stale = append(stale, openJ9Stale...)
+
+	for _, f := range stale {
+		if options.DryRun {
+			options.trace(TraceDryRun, nil, "would remove %s: %s", f.Path, f.Reason)
+		} else {
+			options.trace(TraceCleanup, nil, "removed %s: %s", f.Path, f.Reason)
+		}
+	}
+	return stale, err
+}
+
+// cleanupOpenJ9 removes stale entries of an OpenJ9 attach directory while
+// holding its _attachlock, so that no attach is in progress. The lock file
+// is not created if missing: without it, no attach has ever been made.
+func cleanupOpenJ9(attachDir, procRoot string, nspid int, sharesIPC bool, options *Options) ([]StaleFile, error) {
+	fd, err := syscall.Open(attachDir+"/_attachlock", syscall.O_WRONLY, 0)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s/_attachlock: %v", attachDir, err)
+	}
+	defer syscall.Close(fd)
+	if err := lockFile(fd, options.lockTimeout()); err != nil {
+		return nil, fmt.Errorf("cannot lock %s/_attachlock: %v", attachDir, err)
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	stale := removeStaleOpenJ9Entries(attachDir, procRoot, nspid, options.DryRun)
+
+	// The semaphore key depends on the IPC namespace
+	if _, err := os.Stat(attachDir + "/_notifier"); err == nil && sharesIPC {
+		semaphore, err := (&openJ9{}).repairSemaphore(attachDir, options.DryRun)
+		if err != nil {
+			return stale, err
+		}
+		if semaphore != nil {
+			stale = append(stale, *semaphore)
+		}
+	}
+	return stale, nil
+}
+
+// processVisible reports whether pid exists in the /proc at procRoot.
+func processVisible(procRoot string, pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%d", procRoot, pid))
+	return err == nil
+}
+
+// removeStaleOpenJ9Entries removes the directories of JVMs in attachDir
+// whose process no longer exists in procRoot, the /proc of their PID
+// namespace, and replyInfo files left in the others. It must only be called
+// while holding _attachlock, when no replyInfo is in use. If nspid, the
+// target's PID in that namespace, is not visible there, procRoot is not the
+// right view and nothing is removed.
+//
+// Like OpenJ9 itself, this assumes that the directory is not shared by
+// JVMs in different PID namespaces.
+func removeStaleOpenJ9Entries(attachDir, procRoot string, nspid int, dryRun bool) []StaleFile {
+	if nspid != 0 && !processVisible(procRoot, nspid) {
+		return nil
+	}
+	entries, err := os.ReadDir(attachDir)
+	if err != nil {
+		return nil
+	}
+
+	var stale []StaleFile
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := attachDir + "/" + entry.Name()
+
+		// Directories without a valid attachInfo may belong to a JVM
+		// that is still starting up
+		data, err := os.ReadFile(dir + "/attachInfo")
+		if err != nil {
+			continue
+		}
+		info, err := parseAttachInfo(data)
+		if err != nil {
+			continue
+		}
+
+		if !processVisible(procRoot, info.ProcessID) {
+			if dryRun || os.RemoveAll(dir) == nil {
+				stale = append(stale, StaleFile{Path: dir, Reason: fmt.Sprintf("process %d is gone", info.ProcessID)})
+			}
+			continue
+		}
+
+		replyInfo := dir + "/replyInfo"
+		if _, err := os.Lstat(replyInfo); err == nil {
+			if dryRun || syscall.Unlink(replyInfo) == nil {
+				stale = append(stale, StaleFile{Path: replyInfo, Reason: "left by an aborted attach"})
+			}
+		}
+	}
+	return stale
+}
+
+// removeStaleHotSpotFiles removes .attach_pid files in tmpPath whose
+// process no longer exists in procRoot, and .java_pid sockets that refuse
+// connections because their listener is gone. Sockets are never judged by
+// their PID: a tmpPath shared between containers holds sockets of JVMs in
+// other PID namespaces, which procRoot does not show. If nspid, the
+// target's PID in that namespace, is not visible in procRoot, no
+// .attach_pid file is removed.
+func removeStaleHotSpotFiles(tmpPath, procRoot string, nspid int, dryRun bool) []StaleFile {
+	entries, err := os.ReadDir(tmpPath)
+	if err != nil {
+		return nil
+	}
+	checkProcesses := nspid == 0 || processVisible(procRoot, nspid)
+
+	var stale []StaleFile
+	remove := func(path, reason string) {
+		if dryRun || syscall.Unlink(path) == nil {
+			stale = append(stale, StaleFile{Path: path, Reason: reason})
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := tmpPath + "/" + name
+
+		if suffix, ok := strings.CutPrefix(name, ".attach_pid"); ok {
+			pid, err := strconv.Atoi(suffix)
+			if err == nil && checkProcesses && !processVisible(procRoot, pid) {
+				remove(path, fmt.Sprintf("process %d is gone", pid))
+			}
+			continue
+		}
+
+		suffix, ok := strings.CutPrefix(name, ".java_pid")
+		if !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(suffix); err != nil || !(&hotSpot{}).checkSocket(path) {
+			continue
+		}
+		// Connecting without sending a request does not change the
+		// JVM's state
+		conn, err := connectToSocket(path)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			remove(path, "no listener (connection refused)")
+		} else if err == nil {
+			conn.Close()
+		}
+	}
+	return stale
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosmorse/jambo"
+)
+
+// defaultOutputTemplate names the per-target files written by --all.
+const defaultOutputTemplate = "{pid}-{main}-{ts}.txt"
+
+// runAll attaches to every JVM matching selector and writes each output to
+// a file named after outputTemplate. It returns the process exit code.
+func runAll(selector, command string, args []string, parallel int, outputTemplate string, options jambo.Options) int {
+	vms, err := jambo.SelectJVMs(selector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if len(vms) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no JVM matches %q\n", selector)
+		return 1
+	}
+
+	pids := make([]int, 0, len(vms))
+	mainClasses := make(map[int]string, len(vms))
+	for _, vm := range vms {
+		pids = append(pids, vm.Pid)
+		mainClasses[vm.Pid] = vm.MainClass
+	}
+	sort.Ints(pids)
+
+	results := jambo.AttachMany(context.Background(), pids, command, args, &jambo.ManyOptions{
+		Options:     options,
+		Parallelism: parallel,
+	})
+
+	ts := time.Now().Format("20060102T150405")
+	exitCode := 0
+
+	for _, pid := range pids {
+		result := results[pid]
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "%d: error: %v\n", pid, result.Err)
+			exitCode = 1
+			continue
+		}
+
+		name := expandOutputTemplate(outputTemplate, pid, mainClasses[pid], ts)
+		if err := os.WriteFile(name, []byte(result.Output), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "%d: error: %v\n", pid, err)
+			exitCode = 1
+			continue
+		}
+
+		fmt.Printf("%d: %s (%v)\n", pid, name, result.Duration.Round(time.Millisecond))
+	}
+
+	return exitCode
+}
+
+// expandOutputTemplate substitutes {pid}, {main} and {ts} in template.
+// The main class is reduced to a file-name-safe form.
+func expandOutputTemplate(template string, pid int, mainClass, ts string) string {
+	main := filepath.Base(mainClass)
+	if main == "." || main == "/" {
+		main = "unknown"
+	}
+	main = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, main)
+
+	return strings.NewReplacer(
+		"{pid}", strconv.Itoa(pid),
+		"{main}", main,
+		"{ts}", ts,
+	).Replace(template)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cosmorse/jambo"
+)
+
+// runCleanup parses the cleanup flags and removes stale attach files of the
+// given PID's temporary directory, or of the host's /tmp without a PID. It
+// returns 0 if the directory could be cleaned.
+func runCleanup(args []string, options jambo.Options) int {
+	flags := flag.NewFlagSet("jambo cleanup", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", options.DryRun, "only list what would be removed")
+	asJSON := flags.Bool("json", false, "print the stale files as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: jambo cleanup [--dry-run] [--json] [<pid>]")
+		return 1
+	}
+	pid := 0
+	if flags.NArg() == 1 {
+		var err error
+		if pid, err = jambo.ParsePID(flags.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s is not a valid process ID\n", flags.Arg(0))
+			return 1
+		}
+	}
+
+	options.DryRun = *dryRun
+	options.PrintOutput = false
+	stale, err := jambo.Cleanup(pid, &options)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(stale)
+	} else {
+		verb := "removed"
+		if options.DryRun {
+			verb = "would remove"
+		}
+		for _, f := range stale {
+			fmt.Printf("%s %s (%s)\n", verb, f.Path, f.Reason)
+		}
+		if len(stale) == 0 && err == nil {
+			fmt.Println("no stale attach files found")
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
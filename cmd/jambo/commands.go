@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cosmorse/jambo"
+)
+
+// runCommands parses the commands flags and prints the jcmd commands the
+// JVM implements, one per line, or the options of one command. The plain
+// output is meant for shell completion. It returns 0 on success.
+func runCommands(args []string, options jambo.Options) int {
+	flags := flag.NewFlagSet("jambo commands", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the catalog, or the command, as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: jambo commands [--json] <pid> [<jcmd command>]")
+		return 1
+	}
+	pid, err := jambo.ParsePID(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a valid process ID\n", flags.Arg(0))
+		return 1
+	}
+
+	proc, err := jambo.NewProcess(pid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer proc.Close()
+
+	options.PrintOutput = false
+	catalog, err := proc.JcmdCommands(&options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var result any = catalog
+	if flags.NArg() == 2 {
+		command := catalog.Command(flags.Arg(1))
+		if command == nil {
+			fmt.Fprintf(os.Stderr, "Error: %s has no jcmd command %s\n", catalog.Version, flags.Arg(1))
+			return 1
+		}
+		result = command
+		if !*asJSON {
+			for _, option := range command.Options {
+				if option.Type == "BOOLEAN" {
+					fmt.Println(option.Name)
+				} else {
+					fmt.Println(option.Name + "=")
+				}
+			}
+		}
+	} else if !*asJSON {
+		for _, name := range catalog.Names() {
+			fmt.Println(name)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cosmorse/jambo"
+)
+
+// runDoctor parses the doctor flags and prints a report of every attach
+// precondition for the given PID, reached as options would reach it. It
+// returns 0 if no check failed.
+func runDoctor(args []string, options jambo.Options) int {
+	flags := flag.NewFlagSet("jambo doctor", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the checks as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: jambo [options] doctor [--json] <pid>")
+		return 1
+	}
+	pid, err := jambo.ParsePID(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a valid process ID\n", flags.Arg(0))
+		return 1
+	}
+
+	checks := jambo.Diagnose(pid, &options)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(checks)
+	} else {
+		printChecks(checks)
+	}
+
+	if !jambo.Healthy(checks) {
+		return 1
+	}
+	return 0
+}
+
+// printChecks writes one line per check, followed by its hint, if any.
+func printChecks(checks []jambo.Check) {
+	width := 0
+	for _, check := range checks {
+		width = max(width, len(check.Name))
+	}
+
+	for _, check := range checks {
+		fmt.Printf("[%s] %-*s  %s\n", strings.ToUpper(check.Status), width, check.Name, check.Detail)
+		if check.Hint != "" {
+			fmt.Printf("       %-*s  hint: %s\n", width, "", check.Hint)
+		}
+	}
+}
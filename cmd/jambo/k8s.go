@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cosmorse/jambo"
+)
+
+// runK8s attaches to the single JVM running in the container referenced by
+// ref (<namespace>/<pod>[/<container>]). It returns the process exit code.
+func runK8s(ref, command string, args []string, options jambo.Options, record *sessionRecorder) int {
+	vms, err := jambo.FindKubeJVMs(ref)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	switch len(vms) {
+	case 0:
+		fmt.Fprintf(os.Stderr, "Error: no JVM found in %s\n", ref)
+		return 1
+	case 1:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %d JVMs found in %s, specify the container or use --all with a PID:\n", len(vms), ref)
+		for _, vm := range vms {
+			fmt.Fprintf(os.Stderr, "    %d %s\n", vm.Pid, vm.MainClass)
+		}
+		return 1
+	}
+
+	proc, err := jambo.NewProcess(vms[0].Pid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	output, err := proc.Attach(command, args, &options)
+	record.save(proc, command, args, output, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if output != "" {
+		fmt.Print(output)
+	}
+	return 0
+}
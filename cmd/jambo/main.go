@@ -3,9 +3,14 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cosmorse/jambo"
 )
@@ -17,7 +22,44 @@ var version = "dev"
 func printUsage() {
 	fmt.Printf("jambo %s - JVM Dynamic Attach Utility (Go version)\n", version)
 	fmt.Println()
-	fmt.Println("Usage: jambo <pid> <cmd> [args ...]")
+	fmt.Println("Usage: jambo [options] <pid> <cmd> [args ...]")
+	fmt.Println("       jambo [options] --all <selector> <cmd> [args ...]")
+	fmt.Println("       jambo [options] k8s <namespace>/<pod>[/<container>] <cmd> [args ...]")
+	fmt.Println("       jambo [options] doctor [--json] <pid>")
+	fmt.Println("       jambo [options] cleanup [--dry-run] [--json] [<pid>]")
+	fmt.Println("       jambo [options] commands [--json] <pid> [<jcmd command>]")
+	fmt.Println("       jambo serve [--socket <path>] [--timeout <ms>] [--allow-uid <uids>] [--allow-gid <gids>]")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("    --all <selector>  : attach to every JVM matching selector")
+	fmt.Println("                        ('*' for all, a PID, or a glob on the main class/jar)")
+	fmt.Println("    --parallel <n>    : maximum concurrent attaches with --all (default 4)")
+	fmt.Println("    --timeout <ms>    : per-target timeout in milliseconds (default none)")
+	fmt.Println("    --output <tmpl>   : output file name template for --all")
+	fmt.Println("                        (default {pid}-{main}-{ts}.txt)")
+	fmt.Println("    --policy <file>   : enforce a command policy (JSON file, or 'read-only')")
+	fmt.Println("    --audit-log <file>: append an audit record (JSON lines) for every operation")
+	fmt.Println("    --audit-journald  : send audit records to systemd-journald")
+	fmt.Println("    --trace           : print every protocol step and the bytes exchanged to stderr")
+	fmt.Println("    --dry-run         : print what would be sent without signalling the process")
+	fmt.Println("    --record <file>   : save the protocol exchange as a session for replay")
+	fmt.Println("                        (a single PID or k8s target)")
+	fmt.Println("    --retries <n>     : connect attempts on transient socket errors (default 3)")
+	fmt.Println("    --strict-namespaces")
+	fmt.Println("                      : fail if a namespace of the target cannot be entered")
+	fmt.Println("    --attach-path <dir>")
+	fmt.Println("                      : directory of the attach files, as seen from jambo")
+	fmt.Println("                        (default derived from the JVM's options)")
+	fmt.Println("    --no-setns        : do not enter the target's namespaces; reach its files")
+	fmt.Println("                        through /proc/<pid>/root (HotSpot only)")
+	fmt.Println("    --hotspot-wait <spec>")
+	fmt.Println("                      : wait for the HotSpot attach socket after SIGQUIT")
+	fmt.Println("                        (default initial=20ms,step=20ms,factor=1,max=6s)")
+	fmt.Println("    --openj9-wait <spec>")
+	fmt.Println("                      : wait for an OpenJ9 JVM to connect back")
+	fmt.Println("                        (default initial=100ms,step=100ms,factor=1,max=5s)")
+	fmt.Println("                        A spec is a maximum wait such as 30s, or a")
+	fmt.Println("                        comma-separated list of the keys above")
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("    load            : load agent library")
@@ -57,23 +99,168 @@ func printUsage() {
 	fmt.Println("    # Heap histogram")
 	fmt.Println("    jambo <pid> inspectheap")
 	fmt.Println()
+	fmt.Println("    # Explain why attaching to a process would fail")
+	fmt.Println("    jambo doctor <pid>")
+	fmt.Println()
+	fmt.Println("    # Remove attach files and sockets left by dead JVMs and aborted attaches")
+	fmt.Println("    jambo cleanup --dry-run <pid>")
+	fmt.Println()
+	fmt.Println("    # List the JVM's jcmd commands, or the options of one (for shell completion)")
+	fmt.Println("    jambo commands <pid>")
+	fmt.Println("    jambo commands <pid> GC.heap_dump")
+	fmt.Println()
+	fmt.Println("    # Thread dump of the JVM in a Kubernetes container (run on the node)")
+	fmt.Println("    jambo k8s default/orders-7d9f/app threaddump")
+	fmt.Println()
+	fmt.Println("    # Thread dump of every JVM whose main class matches, one file each")
+	fmt.Println("    jambo --all 'com.example.*' --output /var/tmp/{pid}-{main}-{ts}.txt threaddump")
+	fmt.Println()
 	fmt.Println("Platform Support:")
 	fmt.Println("    Linux   : Full support (HotSpot + OpenJ9, container-aware)")
 	fmt.Println("    Windows : HotSpot support (requires Administrator privileges)")
 	fmt.Println()
 	fmt.Println("Environment Variables:")
 	fmt.Println("    JAMBO_ATTACH_PATH : Override default temporary path for attach files")
+	fmt.Println("                        (--attach-path takes precedence)")
 }
 
 func main() {
-	if len(os.Args) < 3 {
+	flags := flag.NewFlagSet("jambo", flag.ExitOnError)
+	flags.Usage = printUsage
+
+	selector := flags.String("all", "", "")
+	parallel := flags.Int("parallel", jambo.DefaultParallelism, "")
+	timeout := flags.Int("timeout", 0, "")
+	outputTemplate := flags.String("output", defaultOutputTemplate, "")
+	policyPath := flags.String("policy", "", "")
+	auditLog := flags.String("audit-log", "", "")
+	auditJournald := flags.Bool("audit-journald", false, "")
+	trace := flags.Bool("trace", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	recordPath := flags.String("record", "", "")
+	retries := flags.Int("retries", jambo.DefaultRetryPolicy.Attempts, "")
+	strictNamespaces := flags.Bool("strict-namespaces", false, "")
+	noSetns := flags.Bool("no-setns", false, "")
+	attachPath := flags.String("attach-path", "", "")
+	hotSpotWait := flags.String("hotspot-wait", "", "")
+	openJ9Wait := flags.String("openj9-wait", "", "")
+	flags.Parse(os.Args[1:])
+
+	options := jambo.Options{
+		PrintOutput:      true,
+		Timeout:          *timeout,
+		CallerUID:        callerUID(),
+		DryRun:           *dryRun,
+		StrictNamespaces: *strictNamespaces,
+		NoSetns:          *noSetns,
+		AttachPath:       *attachPath,
+	}
+	if *retries != jambo.DefaultRetryPolicy.Attempts {
+		retry := jambo.DefaultRetryPolicy
+		retry.Attempts = *retries
+		options.Retry = &retry
+	}
+	var tracers jambo.MultiTracer
+	if *trace {
+		tracers = append(tracers, jambo.NewWriterTracer(os.Stderr))
+	}
+	var record *sessionRecorder
+	if *recordPath != "" {
+		record = &sessionRecorder{recorder: jambo.NewRecorder(), path: *recordPath}
+		tracers = append(tracers, record.recorder)
+	}
+	if len(tracers) == 1 {
+		options.Tracer = tracers[0]
+	} else if len(tracers) > 1 {
+		options.Tracer = tracers
+	}
+	if *hotSpotWait != "" {
+		wait, err := parseWaitPolicy(*hotSpotWait, jambo.DefaultHotSpotWait)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --hotspot-wait: %v\n", err)
+			os.Exit(1)
+		}
+		options.HotSpotWait = wait
+	}
+	if *openJ9Wait != "" {
+		wait, err := parseWaitPolicy(*openJ9Wait, jambo.DefaultOpenJ9Wait)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --openj9-wait: %v\n", err)
+			os.Exit(1)
+		}
+		options.OpenJ9Wait = wait
+	}
+	if *policyPath != "" {
+		policy, err := jambo.LoadPolicy(*policyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		options.Policy = policy
+	}
+	if sink, err := openAuditSink(*auditLog, *auditJournald); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	} else if sink != nil {
+		options.Audit = sink
+	}
+
+	rest := flags.Args()
+	if record != nil {
+		// A session holds a single attach to a local PID
+		mode := ""
+		switch {
+		case *selector != "":
+			mode = "--all"
+		case len(rest) >= 1 && slices.Contains([]string{"serve", "doctor", "cleanup", "commands"}, rest[0]):
+			mode = rest[0]
+		}
+		if mode != "" {
+			fmt.Fprintf(os.Stderr, "Error: --record cannot be used with %s\n", mode)
+			os.Exit(1)
+		}
+	}
+
+	if *selector != "" {
+		if len(rest) < 1 {
+			printUsage()
+			os.Exit(1)
+		}
+		os.Exit(runAll(*selector, rest[0], rest[1:], *parallel, *outputTemplate, options))
+	}
+
+	if len(rest) >= 1 && rest[0] == "serve" {
+		os.Exit(runServe(rest[1:]))
+	}
+
+	if len(rest) >= 1 && rest[0] == "doctor" {
+		os.Exit(runDoctor(rest[1:], options))
+	}
+
+	if len(rest) >= 1 && rest[0] == "cleanup" {
+		os.Exit(runCleanup(rest[1:], options))
+	}
+
+	if len(rest) >= 1 && rest[0] == "commands" {
+		os.Exit(runCommands(rest[1:], options))
+	}
+
+	if len(rest) >= 1 && rest[0] == "k8s" {
+		if len(rest) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+		os.Exit(runK8s(rest[1], rest[2], rest[3:], options, record))
+	}
+
+	if len(rest) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	pidStr := os.Args[1]
-	command := os.Args[2]
-	args := os.Args[3:]
+	pidStr := rest[0]
+	command := rest[1]
+	args := rest[2:]
 
 	pid, err := jambo.ParsePID(pidStr)
 	if err != nil {
@@ -81,11 +268,28 @@ func main() {
 		os.Exit(1)
 	}
 
-	output, err := jambo.Attach(pid, command, args, true)
+	proc, err := jambo.NewProcess(pid)
+	if err == nil {
+		var output string
+		output, err = proc.Attach(command, args, &options)
+		if err == nil && output != "" {
+			fmt.Print(output)
+		}
+		record.save(proc, command, args, output, err)
+	}
+
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 
-		if strings.Contains(err.Error(), "process not found") {
+		if errors.Is(err, jambo.ErrNotJVM) {
+			fmt.Fprintf(os.Stderr, "Process %d is not a Java process; check the PID\n", pid)
+		} else if errors.Is(err, jambo.ErrAttachDisabled) {
+			fmt.Fprintf(os.Stderr, "The JVM cannot start its attach listener; it was not signalled\n")
+		} else if errors.Is(err, jambo.ErrNamespace) {
+			fmt.Fprintf(os.Stderr, "Run as root to enter the container's namespaces, or try 'jambo doctor %d'\n", pid)
+		} else if errors.Is(err, jambo.ErrInsecure) {
+			fmt.Fprintf(os.Stderr, "Refusing to talk to an attach socket or file that may not belong to the JVM\n")
+		} else if strings.Contains(err.Error(), "process not found") {
 			fmt.Fprintf(os.Stderr, "Process %d not found or not accessible\n", pid)
 		} else if strings.Contains(err.Error(), "permission denied") {
 			fmt.Fprintf(os.Stderr, "Permission denied. Try running with sudo\n")
@@ -93,8 +297,95 @@ func main() {
 
 		os.Exit(1)
 	}
+}
+
+// callerUID returns the user jambo acts on behalf of for policy checks:
+// the invoking user when run through sudo, otherwise the real user ID.
+func callerUID() *int {
+	uid := os.Getuid()
+	if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil && uid == 0 {
+		uid = sudoUID
+	}
+	return &uid
+}
+
+// parseWaitPolicy parses a --hotspot-wait or --openj9-wait value: either
+// a maximum wait ("30s"), or comma-separated initial=, step=, factor= and
+// max= settings. Settings not given keep their value from base.
+func parseWaitPolicy(spec string, base jambo.WaitPolicy) (*jambo.WaitPolicy, error) {
+	wait := base
+
+	if d, err := time.ParseDuration(spec); err == nil {
+		wait.MaxWait = d
+		return &wait, nil
+	}
+
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid setting %q", setting)
+		}
 
-	if output != "" {
-		fmt.Print(output)
+		var err error
+		switch key {
+		case "initial":
+			wait.InitialDelay, err = time.ParseDuration(value)
+		case "step":
+			wait.Increment, err = time.ParseDuration(value)
+		case "factor":
+			wait.Multiplier, err = strconv.ParseFloat(value, 64)
+		case "max":
+			wait.MaxWait, err = time.ParseDuration(value)
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+
+	return &wait, nil
+}
+
+// openAuditSink opens the audit sinks selected on the command line.
+// It returns nil if auditing is not enabled.
+func openAuditSink(logPath string, journald bool) (jambo.AuditSink, error) {
+	var sinks jambo.MultiAuditSink
+	if logPath != "" {
+		sink, err := jambo.NewJSONLinesAuditSink(logPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open audit log: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if journald {
+		sink, err := jambo.NewJournaldAuditSink()
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to journald: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+// sessionRecorder saves the protocol exchange of an attach for --record.
+type sessionRecorder struct {
+	recorder *jambo.Recorder
+	path     string
+}
+
+// save writes the session of the attach to the --record file. It does
+// nothing if r is nil; a failure is reported but does not change the exit
+// status.
+func (r *sessionRecorder) save(proc *jambo.Process, command string, args []string, output string, err error) {
+	if r == nil {
+		return
+	}
+	if saveErr := r.recorder.Session(proc, command, args, output, err).Save(r.path); saveErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot save session: %v\n", saveErr)
 	}
 }
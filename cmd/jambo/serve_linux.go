@@ -0,0 +1,564 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cosmorse/jambo"
+	"golang.org/x/sys/unix"
+)
+
+// peerCredKey is the context key under which the connecting peer's
+// credentials are stored by server.connContext.
+type peerCredKey struct{}
+
+// server exposes attach operations over HTTP on a Unix domain socket.
+type server struct {
+	timeout   time.Duration   // default per-request timeout
+	allowUIDs map[uint32]bool // peers allowed in addition to root and our own uid
+	allowGIDs map[uint32]bool // peer groups allowed
+	policy    *jambo.Policy   // optional command policy, checked against the peer's uid
+	audit     jambo.AuditSink // optional audit sink
+}
+
+// runServe parses the serve flags and runs the daemon until SIGINT or SIGTERM.
+// It returns the process exit code.
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("jambo serve", flag.ExitOnError)
+	socketPath := flags.String("socket", "/run/jambo.sock", "Unix socket to listen on")
+	timeout := flags.Int("timeout", 60000, "default per-request timeout in milliseconds")
+	mode := flags.String("mode", "0660", "permission bits of the socket file")
+	allowUID := flags.String("allow-uid", "", "comma-separated uids allowed to connect (root and the daemon's uid always are)")
+	allowGID := flags.String("allow-gid", "", "comma-separated gids allowed to connect, as the primary or a supplementary group")
+	policyPath := flags.String("policy", "", "command policy (JSON file, or 'read-only')")
+	auditLog := flags.String("audit-log", "", "append audit records (JSON lines) to this file")
+	auditJournald := flags.Bool("audit-journald", false, "send audit records to systemd-journald")
+	flags.Parse(args)
+
+	s := &server{timeout: time.Duration(*timeout) * time.Millisecond}
+	var err error
+	if s.allowUIDs, err = parseIDList(*allowUID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --allow-uid: %v\n", err)
+		return 1
+	}
+	if s.allowGIDs, err = parseIDList(*allowGID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --allow-gid: %v\n", err)
+		return 1
+	}
+	if *policyPath != "" {
+		if s.policy, err = jambo.LoadPolicy(*policyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	if s.audit, err = openAuditSink(*auditLog, *auditJournald); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	perm, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --mode: %v\n", err)
+		return 1
+	}
+
+	listener, err := listenUnix(*socketPath, os.FileMode(perm))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	httpServer := &http.Server{
+		Handler:     s.routes(),
+		ConnContext: connContext,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("jambo %s listening on %s", version, *socketPath)
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listenUnix listens on path, replacing a leftover socket file from a previous run.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// connContext records the peer credentials of each accepted connection.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// routes returns the API handler. Every route requires an authorized peer.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/jvms", s.handleList)
+	mux.HandleFunc("POST /v1/jvms/{pid}/attach", s.handleAttach)
+	mux.HandleFunc("GET /v1/jvms/{pid}/threaddump", s.handleText("threaddump"))
+	mux.HandleFunc("GET /v1/jvms/{pid}/histogram", s.handleText("inspectheap"))
+	mux.HandleFunc("GET /v1/jvms/{pid}/heapdump", s.handleHeapDump)
+	mux.HandleFunc("GET /v1/jvms/{pid}/jfr", s.handleJFR)
+	return s.authorize(mux)
+}
+
+// authorize rejects peers that are neither root, the daemon's own user,
+// nor listed in --allow-uid / --allow-gid.
+func (s *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerCredKey{}).(*unix.Ucred)
+		if !ok {
+			writeError(w, http.StatusForbidden, errors.New("peer credentials unavailable"))
+			return
+		}
+		if !s.allowed(cred) {
+			log.Printf("denied %s %s for uid=%d gid=%d pid=%d", r.Method, r.URL.Path, cred.Uid, cred.Gid, cred.Pid)
+			writeError(w, http.StatusForbidden, jambo.ErrPermission)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether the peer is root, the daemon's own user, listed
+// in --allow-uid, or a member of a group in --allow-gid. SO_PEERCRED only
+// carries the primary group; supplementary groups are read from the
+// peer's /proc status.
+func (s *server) allowed(cred *unix.Ucred) bool {
+	if cred.Uid == 0 || int(cred.Uid) == os.Getuid() || s.allowUIDs[cred.Uid] || s.allowGIDs[cred.Gid] {
+		return true
+	}
+	if len(s.allowGIDs) == 0 {
+		return false
+	}
+	for _, gid := range peerGroups(cred.Pid, cred.Uid) {
+		if s.allowGIDs[gid] {
+			return true
+		}
+	}
+	return false
+}
+
+// peerGroups returns the supplementary groups of process pid, or none if
+// it is gone or no longer runs as uid.
+func peerGroups(pid int32, uid uint32) []uint32 {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+
+	var groups []uint32
+	sameUser := false
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "Uid:"); ok {
+			fields := strings.Fields(value)
+			sameUser = len(fields) > 0 && fields[0] == strconv.FormatUint(uint64(uid), 10)
+		}
+		if value, ok := strings.CutPrefix(line, "Groups:"); ok {
+			for _, field := range strings.Fields(value) {
+				if gid, err := strconv.ParseUint(field, 10, 32); err == nil {
+					groups = append(groups, uint32(gid))
+				}
+			}
+		}
+	}
+	if !sameUser {
+		return nil
+	}
+	return groups
+}
+
+// attachRequest is the body of POST /v1/jvms/{pid}/attach.
+type attachRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// attachResponse is the body returned by POST /v1/jvms/{pid}/attach.
+type attachResponse struct {
+	Pid        int    `json:"pid"`
+	Output     string `json:"output"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// errorResponse is the body returned for failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	vms, err := jambo.ListJVMs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if vms == nil {
+		vms = []jambo.VMInfo{}
+	}
+	writeJSON(w, http.StatusOK, vms)
+}
+
+func (s *server) handleAttach(w http.ResponseWriter, r *http.Request) {
+	var req attachRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Command == "" {
+		writeError(w, http.StatusBadRequest, errors.New("command is required"))
+		return
+	}
+
+	start := time.Now()
+	proc, output, err := s.attach(r, req.Command, req.Args, nil)
+	if err != nil {
+		writeAttachError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, attachResponse{
+		Pid:        proc.Pid(),
+		Output:     output,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+}
+
+// handleText returns a handler that runs command and streams its output as text.
+func (s *server) handleText(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := &responseStream{w: w, contentType: "text/plain; charset=utf-8"}
+		defer stream.close()
+
+		_, output, err := s.attach(r, command, r.URL.Query()["arg"], stream)
+		if err != nil {
+			if stream.close() {
+				// The status has been sent; abort the connection so that
+				// the client sees a truncated response
+				log.Printf("%s %s failed after streaming: %v", r.Method, r.URL.Path, err)
+				panic(http.ErrAbortHandler)
+			}
+			writeAttachError(w, err)
+			return
+		}
+		io.WriteString(stream, output)
+	}
+}
+
+// responseStream writes attach output to the response as it arrives. The
+// content type is set by the first write. Writes after close, from an
+// attach thread that outlived its request, are discarded.
+type responseStream struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	contentType string
+	written     bool
+	closed      bool
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	if !s.written {
+		s.w.Header().Set("Content-Type", s.contentType)
+		s.written = true
+	}
+	n, err := s.w.Write(p)
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// close discards later writes and reports whether anything was written.
+func (s *responseStream) close() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.written
+}
+
+// handleHeapDump writes a heap dump inside the target and streams it to the client.
+func (s *server) handleHeapDump(w http.ResponseWriter, r *http.Request) {
+	pid, err := jambo.ParsePID(r.PathValue("pid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	file := fmt.Sprintf("/tmp/jambo-%d-%d.hprof", pid, time.Now().UnixNano())
+	args := []string{file}
+	if r.URL.Query().Get("live") == "false" {
+		args = append(args, "-all")
+	}
+
+	proc, _, err := s.attach(r, "dumpheap", args, nil)
+	if err != nil {
+		writeAttachError(w, err)
+		return
+	}
+	s.streamTargetFile(w, proc, file, "application/octet-stream")
+}
+
+// handleJFR records a flight recording of ?duration= (default 30s) and streams it.
+func (s *server) handleJFR(w http.ResponseWriter, r *http.Request) {
+	pid, err := jambo.ParsePID(r.PathValue("pid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	duration := 30 * time.Second
+	if d := r.URL.Query().Get("duration"); d != "" {
+		if duration, err = time.ParseDuration(d); err != nil || duration < time.Second {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", d))
+			return
+		}
+	}
+
+	name := fmt.Sprintf("jambo-%d", time.Now().UnixNano())
+	file := fmt.Sprintf("/tmp/%s.jfr", name)
+	proc, _, err := s.attach(r, "jcmd", []string{"JFR.start",
+		"name=" + name,
+		fmt.Sprintf("duration=%ds", int(duration.Seconds())),
+		"filename=" + file,
+	}, nil)
+	if err != nil {
+		writeAttachError(w, err)
+		return
+	}
+
+	// The recording is written when it stops; wait for it, within the
+	// request timeout on top of the recording duration.
+	hostPath := fmt.Sprintf("/proc/%d/root%s", pid, file)
+	deadline := time.Now().Add(duration + s.requestTimeout(r))
+	var lastSize int64 = -1
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		if info, err := os.Lstat(hostPath); err == nil && info.Size() > 0 {
+			if info.Size() == lastSize {
+				break
+			}
+			lastSize = info.Size()
+		}
+		if time.Now().After(deadline) {
+			writeError(w, http.StatusGatewayTimeout, fmt.Errorf("recording %s was not written in time", name))
+			return
+		}
+	}
+
+	s.streamTargetFile(w, proc, file, "application/octet-stream")
+}
+
+// streamTargetFile streams a file written by the target JVM and removes it afterwards.
+// path is interpreted in the target's mount namespace.
+func (s *server) streamTargetFile(w http.ResponseWriter, proc *jambo.Process, path, contentType string) {
+	f, err := openTargetFile(proc.Pid(), path, proc.Uid())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path[strings.LastIndex(path, "/")+1:]))
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	io.Copy(w, f)
+}
+
+// openTargetFile opens a file written by the target JVM and removes it,
+// path being interpreted in the target's root directory. The JVM's user
+// controls that directory, so no symlink is followed, and only a regular
+// file owned by uid and not linked elsewhere is accepted; anything else
+// could hand the client a file that user cannot read.
+func openTargetFile(pid int, path string, uid int) (*os.File, error) {
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	dir, name := filepath.Split(filepath.Clean(path))
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", root, err)
+	}
+	dirfd, err := unix.Openat2(rootfd, dir, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_SYMLINKS,
+	})
+	unix.Close(rootfd)
+	if errors.Is(err, unix.ENOSYS) {
+		// Before Linux 5.6 only the last component can be kept from being
+		// followed; the checks below reject what an earlier one leads to
+		dirfd, err = unix.Open(root+dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+	defer unix.Close(dirfd)
+
+	// O_NONBLOCK keeps a FIFO from blocking the open
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	defer unix.Unlinkat(dirfd, name, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG || int(stat.Uid) != uid || stat.Nlink != 1 {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a regular file of uid %d written by the JVM", path, uid)
+	}
+	return f, nil
+}
+
+// attach runs command against the {pid} of the request, bounded by the
+// request timeout. If out is set, the output is written to it instead of
+// returned.
+func (s *server) attach(r *http.Request, command string, args []string, out io.Writer) (*jambo.Process, string, error) {
+	pid, err := jambo.ParsePID(r.PathValue("pid"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	proc, err := jambo.NewProcess(pid)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(r))
+	defer cancel()
+
+	options := &jambo.Options{Policy: s.policy, Audit: s.audit, Output: out}
+	if cred, ok := r.Context().Value(peerCredKey{}).(*unix.Ucred); ok {
+		uid := int(cred.Uid)
+		options.CallerUID = &uid
+	}
+
+	output, err := proc.AttachContext(ctx, command, args, options)
+	return proc, output, err
+}
+
+// requestTimeout returns the ?timeout= of the request in milliseconds,
+// or the server default.
+func (s *server) requestTimeout(r *http.Request) time.Duration {
+	if ms, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return s.timeout
+}
+
+// writeAttachError maps attach errors to HTTP status codes.
+func writeAttachError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, jambo.ErrInvalidPID):
+		status = http.StatusBadRequest
+	case errors.Is(err, jambo.ErrProcessNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, jambo.ErrNotJVM), errors.Is(err, jambo.ErrAttachDisabled):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, jambo.ErrPermission), errors.Is(err, jambo.ErrPolicyDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	case errors.Is(err, jambo.ErrCommandFailed), errors.Is(err, jambo.ErrInsecure):
+		status = http.StatusBadGateway
+	}
+	writeError(w, status, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// parseIDList parses a comma-separated list of numeric uids or gids.
+func parseIDList(list string) (map[uint32]bool, error) {
+	ids := make(map[uint32]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids[uint32(id)] = true
+	}
+	return ids, nil
+}
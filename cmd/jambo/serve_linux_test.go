@@ -0,0 +1,201 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cosmorse/jambo"
+	"golang.org/x/sys/unix"
+)
+
+// startPeer starts a process running as uid and gid with the given
+// supplementary groups, to stand for a connecting client.
+func startPeer(t *testing.T, uid, gid uint32, groups ...uint32) int32 {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to start a process with other credentials")
+	}
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: gid, Groups: groups}}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return int32(cmd.Process.Pid)
+}
+
+func TestServerAllowed(t *testing.T) {
+	peer := startPeer(t, 1000, 1000, 1500)
+
+	tests := []struct {
+		name    string
+		cred    unix.Ucred
+		uids    string
+		gids    string
+		allowed bool
+	}{
+		{"root", unix.Ucred{Pid: peer, Uid: 0, Gid: 0}, "", "", true},
+		{"not listed", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "", "", false},
+		{"uid", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "1000", "", true},
+		{"other uid", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "1001", "", false},
+		{"primary gid", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "", "1000", true},
+		{"supplementary gid", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "", "1500", true},
+		{"other gid", unix.Ucred{Pid: peer, Uid: 1000, Gid: 1000}, "", "1600", false},
+		{"uid changed", unix.Ucred{Pid: peer, Uid: 1001, Gid: 1001}, "", "1500", false},
+		{"peer gone", unix.Ucred{Pid: 1 << 30, Uid: 1000, Gid: 1000}, "", "1500", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{}
+			s.allowUIDs, _ = parseIDList(tt.uids)
+			s.allowGIDs, _ = parseIDList(tt.gids)
+			if got := s.allowed(&tt.cred); got != tt.allowed {
+				t.Errorf("allowed(%+v) = %v, want %v", tt.cred, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestPeerGroups(t *testing.T) {
+	peer := startPeer(t, 1000, 1000, 1500, 1600)
+	if groups := peerGroups(peer, 1000); len(groups) != 2 || groups[0] != 1500 || groups[1] != 1600 {
+		t.Errorf("peerGroups() = %v, want [1500 1600]", groups)
+	}
+	if groups := peerGroups(peer, 1001); groups != nil {
+		t.Errorf("peerGroups() of another uid = %v, want none", groups)
+	}
+}
+
+func TestWriteAttachError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{jambo.ErrInvalidPID, http.StatusBadRequest},
+		{jambo.ErrProcessNotFound, http.StatusNotFound},
+		{jambo.ErrNotJVM, http.StatusUnprocessableEntity},
+		{jambo.ErrAttachDisabled, http.StatusUnprocessableEntity},
+		{jambo.ErrPermission, http.StatusForbidden},
+		{fmt.Errorf("%w: jcmd", jambo.ErrPolicyDenied), http.StatusForbidden},
+		{fmt.Errorf("attach to process 1: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{fmt.Errorf("%w: code 1", jambo.ErrCommandFailed), http.StatusBadGateway},
+		{jambo.ErrInsecure, http.StatusBadGateway},
+		{errors.New("other"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeAttachError(w, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("writeAttachError(%v) status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+		if !strings.Contains(w.Body.String(), tt.err.Error()) {
+			t.Errorf("writeAttachError(%v) body = %q", tt.err, w.Body.String())
+		}
+	}
+}
+
+func TestResponseStream(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := &responseStream{w: w, contentType: "text/plain; charset=utf-8"}
+
+	if _, err := stream.Write([]byte("part 1\n")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if !w.Flushed {
+		t.Error("Write() did not flush")
+	}
+	stream.Write([]byte("part 2\n"))
+	if !stream.close() {
+		t.Error("close() = false after writes")
+	}
+	if _, err := stream.Write([]byte("late\n")); err == nil {
+		t.Error("Write() after close succeeded")
+	}
+
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := w.Body.String(); got != "part 1\npart 2\n" {
+		t.Errorf("body = %q", got)
+	}
+
+	if (&responseStream{w: httptest.NewRecorder()}).close() {
+		t.Error("close() = true without writes")
+	}
+}
+
+func TestOpenTargetFile(t *testing.T) {
+	dir := t.TempDir()
+	pid := os.Getpid()
+	uid := os.Geteuid()
+
+	dump := filepath.Join(dir, "jambo.hprof")
+	os.WriteFile(dump, []byte("JAVA PROFILE 1.0.2"), 0600)
+	f, err := openTargetFile(pid, dump, uid)
+	if err != nil {
+		t.Fatalf("openTargetFile() error: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, _ := f.Read(buf)
+	f.Close()
+	if string(buf[:n]) != "JAVA PROFILE 1.0.2" {
+		t.Errorf("read %q", buf[:n])
+	}
+	if _, err := os.Lstat(dump); !os.IsNotExist(err) {
+		t.Errorf("file was not removed: %v", err)
+	}
+
+	secret := filepath.Join(dir, "secret")
+	os.WriteFile(secret, []byte("secret"), 0600)
+
+	tests := []struct {
+		name  string
+		setup func(path string) error
+		uid   int
+	}{
+		{"symlink", func(path string) error { return os.Symlink(secret, path) }, uid},
+		{"hard link", func(path string) error { return os.Link(secret, path) }, uid},
+		{"fifo", func(path string) error { return unix.Mkfifo(path, 0600) }, uid},
+		{"other owner", func(path string) error { return os.WriteFile(path, nil, 0600) }, uid + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "jambo.jfr")
+			if err := tt.setup(path); err != nil {
+				t.Fatalf("setup error: %v", err)
+			}
+			if f, err := openTargetFile(pid, path, tt.uid); err == nil {
+				f.Close()
+				t.Error("openTargetFile() accepted it")
+			}
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("file was not removed: %v", err)
+			}
+		})
+	}
+
+	// A symlinked directory is not followed either
+	link := filepath.Join(t.TempDir(), "tmp")
+	os.Symlink(dir, link)
+	os.WriteFile(filepath.Join(dir, "jambo.hprof"), nil, 0600)
+	if f, err := openTargetFile(pid, filepath.Join(link, "jambo.hprof"), uid); err == nil {
+		f.Close()
+		t.Error("openTargetFile() followed a symlinked directory")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runServe is not available on this platform: the daemon relies on
+// SO_PEERCRED to authorize clients.
+func runServe(args []string) int {
+	fmt.Fprintln(os.Stderr, "Error: serve is only supported on Linux")
+	return 1
+}
@@ -0,0 +1,149 @@
+package jambo
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// commandTable lists the attach commands a JVM implements.
+type commandTable struct {
+	// commands are the attach commands, in the order they are listed.
+	commands []string
+
+	// jcmd maps the jcmd subcommands the JVM accepts to the arguments
+	// they accept, where nil accepts any. A nil map accepts every
+	// subcommand, leaving the check to the JVM.
+	jcmd map[string][]string
+
+	// aliases maps attach commands that are run as a jcmd subcommand to
+	// that subcommand, whose arguments they share.
+	aliases map[string]string
+}
+
+// commandTables holds the command table of each JVM type. JVM types
+// without one are not checked.
+var commandTables = map[JVMType]*commandTable{
+	HotSpot: {
+		commands: []string{"load", "properties", "agentProperties", "datadump", "threaddump", "dumpheap", "inspectheap", "setflag", "printflag", "jcmd"},
+	},
+
+	// OpenJ9 has no flags to set or print, and runs only its own
+	// diagnostic commands through ATTACH_DIAGNOSTICS; see translateCommand.
+	OpenJ9: {
+		commands: []string{"load", "properties", "agentProperties", "datadump", "threaddump", "dumpheap", "inspectheap", "jcmd"},
+		jcmd: map[string][]string{
+			"help":                        nil,
+			"Dump.heap":                   nil,
+			"Dump.java":                   nil,
+			"Dump.snap":                   nil,
+			"Dump.system":                 nil,
+			"GC.class_histogram":          {"all"},
+			"GC.heap_dump":                nil,
+			"GC.run":                      {},
+			"Jstat.class":                 {},
+			"Thread.print":                {"-l"},
+			"ManagementAgent.start":       nil,
+			"ManagementAgent.start_local": {},
+		},
+		aliases: map[string]string{
+			"threaddump":  "Thread.print",
+			"dumpheap":    "Dump.heap",
+			"inspectheap": "GC.class_histogram",
+			"datadump":    "Dump.java",
+		},
+	},
+}
+
+// check returns ErrUnsupportedCommand if the JVM does not implement command
+// with args. The jcmd subcommand and its arguments may be given as one
+// argument or several.
+func (t *commandTable) check(jvm JVMType, command string, args []string) error {
+	if !slices.Contains(t.commands, command) {
+		return fmt.Errorf("%w: %s does not implement %s", ErrUnsupportedCommand, jvm, command)
+	}
+	if t.jcmd == nil {
+		return nil
+	}
+
+	var sub string
+	var subArgs []string
+	if command == "jcmd" {
+		sub = "help"
+		if fields := strings.Fields(strings.Join(args, " ")); len(fields) > 0 {
+			sub, subArgs = fields[0], fields[1:]
+		}
+	} else if alias, ok := t.aliases[command]; ok {
+		sub, subArgs = alias, strings.Fields(strings.Join(args, " "))
+	} else {
+		return nil
+	}
+
+	accepted, ok := t.jcmd[sub]
+	if !ok {
+		return fmt.Errorf("%w: %s does not implement jcmd %s", ErrUnsupportedCommand, jvm, sub)
+	}
+	if accepted == nil {
+		return nil
+	}
+	for _, arg := range subArgs {
+		if !slices.Contains(accepted, arg) {
+			return fmt.Errorf("%w: %s does not accept %q for %s", ErrUnsupportedCommand, jvm, arg, command)
+		}
+	}
+	return nil
+}
+
+// names returns the commands in the form used by Policy rules, with the
+// accepted jcmd subcommands as "jcmd:<Subcommand>" if they are restricted.
+func (t *commandTable) names() []string {
+	var names []string
+	for _, command := range t.commands {
+		if command != "jcmd" || t.jcmd == nil {
+			names = append(names, command)
+			continue
+		}
+		for _, sub := range slices.Sorted(maps.Keys(t.jcmd)) {
+			names = append(names, "jcmd:"+sub)
+		}
+	}
+	return names
+}
+
+// SupportedCommands returns the attach commands the JVM implements, named
+// as in Policy rules: "jcmd" if every jcmd subcommand is passed on to the
+// JVM (HotSpot), or one "jcmd:<Subcommand>" entry per supported subcommand
+// (OpenJ9). Other commands fail with ErrUnsupportedCommand before
+// attaching. It returns nil if the JVM type is not known.
+func (p *Process) SupportedCommands() []string {
+	if p.jvm == nil {
+		return nil
+	}
+	if table := commandTables[p.jvm.Type()]; table != nil {
+		return table.names()
+	}
+	return nil
+}
+
+// checkCommand returns ErrUnsupportedCommand if jvm does not implement
+// command with args, according to its command table and, once read by
+// JcmdCommands, its jcmd catalog.
+func (p *Process) checkCommand(jvm JVM, command string, args []string) error {
+	if jvm == nil {
+		return nil
+	}
+	if table := commandTables[jvm.Type()]; table != nil {
+		if err := table.check(jvm.Type(), command, args); err != nil {
+			return err
+		}
+	}
+
+	jcmdCatalogsMu.Lock()
+	catalog := p.jcmdCatalog
+	jcmdCatalogsMu.Unlock()
+	if command == "jcmd" && catalog != nil {
+		return catalog.Check(args)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package jambo
+
+// Check statuses reported by Diagnose.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// Check is the result of one attach precondition.
+type Check struct {
+	// Name identifies the precondition, e.g. "credentials".
+	Name string `json:"name"`
+
+	// Status is one of the Check* constants.
+	Status string `json:"status"`
+
+	// Detail describes what was found.
+	Detail string `json:"detail"`
+
+	// Hint suggests a remediation for a failed or doubtful check.
+	Hint string `json:"hint,omitempty"`
+}
+
+// Diagnose checks each precondition of attaching to pid and explains what
+// would make an attach fail. Nothing is sent to the target and no attach
+// files are created: namespaces and credentials are tried on a dedicated
+// thread that is discarded afterwards, exactly as Attach would use them.
+//
+// The options that affect how the target is reached are honored:
+// Options.AttachPath, Options.NoSetns and Options.StrictNamespaces. nil
+// means the defaults.
+//
+// Example:
+//
+//	for _, check := range jambo.Diagnose(12345, nil) {
+//	    fmt.Printf("%s %s: %s\n", check.Status, check.Name, check.Detail)
+//	}
+func Diagnose(pid int, options *Options) []Check {
+	if options == nil {
+		options = &Options{}
+	}
+	return diagnose(pid, options)
+}
+
+// Healthy reports whether none of the checks failed.
+func Healthy(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
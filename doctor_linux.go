@@ -0,0 +1,316 @@
+//go:build linux
+
+package jambo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// diagnose runs the checks of Diagnose. Checks that depend on an earlier
+// failure are not run.
+func diagnose(pid int, options *Options) []Check {
+	var checks []Check
+	add := func(name, status, hint, format string, args ...any) {
+		checks = append(checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...), Hint: hint})
+	}
+
+	proc, err := NewProcess(pid)
+	if err != nil {
+		add("process", CheckFail, "check the PID; processes of other users may only be visible to root", "%v", err)
+		return checks
+	}
+	defer proc.Close()
+	jvm := proc.detectInAttachPath(options)
+	add("process", CheckPass, "", "pid %d (nspid %d), uid %d, gid %d", proc.pid, proc.nsPid, proc.uid, proc.gid)
+
+	// JVM library
+	library := ""
+	if maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid)); err != nil {
+		add("jvm", CheckWarn, "run as root or as the process owner", "cannot read memory maps: %v", err)
+	} else if library = jvmLibrary(maps); library == "" {
+		add("jvm", CheckFail, "check the PID; attaching would send SIGQUIT to a process that is not a JVM", "neither libjvm nor libj9vm is loaded")
+		return checks
+	} else {
+		add("jvm", CheckPass, "", "%s is loaded", library)
+	}
+
+	// JVM type and whether it enabled attach
+	jvmType := jvm.Type()
+	cmdline := readCmdline(pid)
+	switch {
+	case jvmType == OpenJ9:
+		info := jvm.(*openJ9).info
+		add("jvm-type", CheckPass, "", "OpenJ9 (vmId %s, %q, attach API version %s)", info.VMID, info.DisplayName, info.Version)
+		if containsArg(cmdline, "-Dcom.ibm.tools.attach.enable=no") {
+			add("attach-enabled", CheckFail, "restart the JVM without -Dcom.ibm.tools.attach.enable=no", "started with -Dcom.ibm.tools.attach.enable=no")
+		} else {
+			add("attach-enabled", CheckPass, "", "attach API is enabled")
+		}
+	case strings.Contains(library, "libj9vm"):
+		add("jvm-type", CheckWarn, "", "OpenJ9 library loaded, but no attachInfo naming nspid %d was found; HotSpot attach would be used", proc.nsPid)
+		add("attach-enabled", CheckFail, "start the JVM with -Dcom.ibm.tools.attach.enable=yes, or pass --attach-path", "OpenJ9 attach API is disabled or uses another directory")
+	default:
+		add("jvm-type", CheckPass, "", "HotSpot")
+		if containsArg(cmdline, "-XX:+DisableAttachMechanism") {
+			add("attach-enabled", CheckFail, "restart the JVM without -XX:+DisableAttachMechanism", "started with -XX:+DisableAttachMechanism")
+		} else {
+			add("attach-enabled", CheckPass, "", "attach mechanism is not disabled")
+		}
+	}
+
+	// SIGQUIT handler, needed to start the HotSpot attach listener
+	if jvmType == HotSpot {
+		status, _ := os.ReadFile(fmt.Sprintf(statusPath, pid))
+		caught, err := signalCaught(status, syscall.SIGQUIT)
+		switch {
+		case err != nil:
+			add("sigquit", CheckWarn, "", "cannot read signal mask: %v", err)
+		case caught:
+			add("sigquit", CheckPass, "", "SIGQUIT is handled")
+		default:
+			add("sigquit", CheckFail, "restart the JVM without -Xrs; SIGQUIT would terminate it", "SIGQUIT is not handled")
+		}
+	} else {
+		add("sigquit", CheckSkip, "", "not used by OpenJ9 attach")
+	}
+
+	// Credentials
+	euid, egid := os.Geteuid(), os.Getegid()
+	switch {
+	case euid == proc.uid && egid == proc.gid:
+		add("credentials", CheckPass, "", "running as the process owner (uid %d, gid %d)", euid, egid)
+	case hasCapabilities(unix.CAP_SETUID, unix.CAP_SETGID):
+		add("credentials", CheckPass, "", "will switch from uid %d to %d with CAP_SETUID/CAP_SETGID", euid, proc.uid)
+	default:
+		add("credentials", CheckFail, fmt.Sprintf("run as uid %d or with sudo", proc.uid), "uid %d gid %d cannot switch to uid %d gid %d", euid, egid, proc.uid, proc.gid)
+	}
+
+	// Namespaces, credential switch and attach directory, on a throwaway
+	// thread set up like the attach thread
+	probed := make(chan []Check)
+	go func() {
+		runtime.LockOSThread()
+		probed <- proc.probe(jvm, options)
+	}()
+	checks = append(checks, <-probed...)
+
+	// Free space where dumps without an absolute path are written
+	var fs unix.Statfs_t
+	cwd := fmt.Sprintf("/proc/%d/cwd", pid)
+	if err := unix.Statfs(cwd, &fs); err != nil {
+		add("disk", CheckWarn, "", "cannot check the working directory: %v", err)
+	} else {
+		free := fs.Bavail * uint64(fs.Bsize)
+		rss := readStatusKB(pid, "VmRSS:") * 1024
+		if free < rss {
+			add("disk", CheckWarn, "write dumps to a larger file system with an absolute path", "%s free in the working directory, less than the %s resident set", formatBytes(free), formatBytes(rss))
+		} else {
+			add("disk", CheckPass, "", "%s free in the working directory (resident set %s)", formatBytes(free), formatBytes(rss))
+		}
+	}
+
+	return checks
+}
+
+// probe enters the target's namespaces and credentials like attach to jvm,
+// then checks the attach directory and socket as the target sees them. It
+// must only be called from a goroutine that is locked to its OS thread.
+func (p *Process) probe(jvm JVM, options *Options) []Check {
+	var checks []Check
+	add := func(name, status, hint, format string, args ...any) {
+		checks = append(checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...), Hint: hint})
+	}
+
+	switch {
+	case sharesUserNamespace(p.pid):
+		add("namespace-user", CheckPass, "", "shared with jambo")
+	case p.nsUid == -1:
+		add("namespace-user", CheckWarn, "", "uid %d is not mapped in the process's user namespace", p.uid)
+	default:
+		add("namespace-user", CheckPass, "", "uid %d gid %d is uid %d gid %d in the process's user namespace", p.uid, p.gid, p.nsUid, p.nsGid)
+	}
+
+	// Files are reached by host PID outside the target's mount namespace
+	opts := *options
+	options = &opts
+	if options.NoSetns {
+		options.procPid = p.pid
+	}
+
+	entered := true
+	for _, nsType := range []string{"net", "ipc", "mnt"} {
+		name := "namespace-" + nsType
+		if options.NoSetns {
+			switch {
+			case sharesNamespace(p.pid, nsType):
+				add(name, CheckPass, "", "shared with jambo")
+			case nsType != "mnt" && jvm.Type() == OpenJ9:
+				add(name, CheckFail, "attach without --no-setns", "not entered (no-setns mode); OpenJ9 attach needs it")
+			case nsType == "mnt":
+				add(name, CheckPass, "", "not entered (no-setns mode); files will be reached through /proc/%d/root", p.pid)
+			default:
+				add(name, CheckPass, "", "not entered (no-setns mode)")
+			}
+			continue
+		}
+
+		joined, err := joinNamespace(p.pid, nsType)
+		switch {
+		case err != nil && options.StrictNamespaces:
+			add(name, CheckFail, "run as root (setns needs CAP_SYS_ADMIN), or attach without --strict-namespaces", "cannot enter: %v", err)
+			entered = false
+		case err != nil && nsType == "mnt":
+			add(name, CheckWarn, "run as root (setns needs CAP_SYS_ADMIN)", "cannot enter: %v; files will be reached through /proc/%d/root", err, p.pid)
+			options.procPid = p.pid
+		case err != nil && nsType == "ipc" && jvm.Type() == OpenJ9:
+			add(name, CheckFail, "run as root (setns needs CAP_SYS_ADMIN)", "cannot enter: %v; OpenJ9 is notified through a semaphore in it", err)
+		case err != nil:
+			add(name, CheckWarn, "run as root (setns needs CAP_SYS_ADMIN)", "cannot enter: %v", err)
+		case joined:
+			add(name, CheckPass, "", "entered")
+		default:
+			add(name, CheckPass, "", "shared with jambo")
+		}
+	}
+
+	if !entered {
+		add("credential-switch", CheckSkip, "", "requires the target's namespaces")
+		add("attach-dir", CheckSkip, "", "requires the target's namespaces")
+		add("socket", CheckSkip, "", "requires the target's namespaces")
+		return checks
+	}
+
+	if err := p.setCredentials(); err != nil {
+		add("credential-switch", CheckFail, fmt.Sprintf("run as uid %d or with sudo", p.uid), "%v", err)
+		add("attach-dir", CheckSkip, "", "requires the target's credentials")
+		add("socket", CheckSkip, "", "requires the target's credentials")
+		return checks
+	}
+	if err := checkAttachOwner(p.pid, p.nsUid); err != nil {
+		add("credential-switch", CheckFail, "run as root", "%v", err)
+		add("attach-dir", CheckSkip, "", "requires the target's credentials")
+		add("socket", CheckSkip, "", "requires the target's credentials")
+		return checks
+	}
+	add("credential-switch", CheckPass, "", "acting as uid %d gid %d", os.Geteuid(), os.Getegid())
+
+	tmpPath, err := p.getTempPath(jvm, options)
+	if err != nil {
+		add("attach-dir", CheckFail, "pass --attach-path or set JAMBO_ATTACH_PATH to the JVM's temporary directory", "%v", err)
+		return checks
+	}
+	if err := unix.Access(tmpPath, unix.W_OK|unix.X_OK); err != nil {
+		add("attach-dir", CheckFail, "pass --attach-path or set JAMBO_ATTACH_PATH to the JVM's temporary directory", "%s is not writable by uid %d: %v", tmpPath, os.Geteuid(), err)
+	} else {
+		add("attach-dir", CheckPass, "", "%s is writable", tmpPath)
+	}
+
+	if o, ok := jvm.(*openJ9); ok {
+		attachInfo := fmt.Sprintf("%s/%d/attachInfo", o.attachDir(tmpPath, p.nsPid, options), p.nsPid)
+		if _, err := os.Stat(attachInfo); err != nil {
+			add("socket", CheckFail, "", "%v", err)
+		} else {
+			add("socket", CheckPass, "", "%s present", attachInfo)
+		}
+		return checks
+	}
+
+	socketPath := fmt.Sprintf("%s/.java_pid%d", tmpPath, p.nsPid)
+	if !(&hotSpot{}).checkSocket(socketPath) {
+		add("socket", CheckPass, "", "no socket at %s yet; the listener will be started with SIGQUIT", socketPath)
+		return checks
+	}
+	if err := verifySocket(socketPath); err != nil {
+		add("socket", CheckFail, "remove the file if it does not belong to the JVM", "%v", err)
+		return checks
+	}
+
+	// Connecting without sending a request does not change the JVM's state
+	conn, err := connectToSocket(socketPath)
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		add("socket", CheckWarn, "", "%s is stale; it will be removed and the listener started again", socketPath)
+	case err != nil:
+		add("socket", CheckFail, "", "cannot connect to %s: %v", socketPath, err)
+	default:
+		defer conn.Close()
+		if err := verifyPeer(conn); err != nil {
+			add("socket", CheckFail, "", "%v", err)
+		} else {
+			add("socket", CheckPass, "", "attach listener is running at %s", socketPath)
+		}
+	}
+
+	return checks
+}
+
+// containsArg reports whether args contains arg.
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCapabilities reports whether the effective capability set of the
+// current process includes all of caps.
+func hasCapabilities(caps ...int) bool {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			if err != nil {
+				return false
+			}
+			for _, c := range caps {
+				if mask&(1<<uint(c)) == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// readStatusKB returns a "kB" field of /proc/{pid}/status, or 0.
+func readStatusKB(pid int, field string) uint64 {
+	status, err := os.ReadFile(fmt.Sprintf(statusPath, pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, field); ok {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb
+		}
+	}
+	return 0
+}
+
+// formatBytes formats n with a binary unit.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,6 +2,7 @@
 package jambo_test
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
@@ -132,6 +133,24 @@ func Example_jcmd() {
 	fmt.Println(output)
 }
 
+// Example_jcmdRequest demonstrates building a jcmd command whose arguments
+// need quoting.
+func Example_jcmdRequest() {
+	proc, err := jambo.NewProcess(12345)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req := jambo.NewJcmdRequest("JFR.start").
+		Option("name", "startup").
+		Option("filename", "/var/tmp/startup recording.jfr")
+	output, err := proc.Jcmd(req, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(output)
+}
+
 // Example_errorHandling demonstrates proper error handling.
 func Example_errorHandling() {
 	// Parse PID from string
@@ -157,9 +176,9 @@ func Example_errorHandling() {
 	output, err := proc.Attach("threaddump", nil, nil)
 	if err != nil {
 		switch {
-		case err == jambo.ErrPermission:
+		case errors.Is(err, jambo.ErrPermission):
 			log.Fatal("Permission denied - try running with sudo")
-		case err == jambo.ErrCommandFailed:
+		case errors.Is(err, jambo.ErrCommandFailed):
 			log.Fatal("Command execution failed in JVM")
 		default:
 			log.Fatal("Error:", err)
@@ -52,10 +52,16 @@
 package jambo
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"os"
+	"runtime"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
@@ -70,6 +76,32 @@ var (
 
 	// ErrCommandFailed indicates the attach command execution failed in the target JVM.
 	ErrCommandFailed = errors.New("command execution failed")
+
+	// ErrNotJVM indicates the target process has no JVM library mapped.
+	// HotSpot attach refuses to signal such a process, since SIGQUIT would
+	// terminate it.
+	ErrNotJVM = errors.New("not a JVM process")
+
+	// ErrAttachDisabled indicates the target JVM cannot start its attach
+	// listener: it does not handle SIGQUIT (for example when run with -Xrs)
+	// or was started with -XX:+DisableAttachMechanism.
+	ErrAttachDisabled = errors.New("attach mechanism disabled")
+
+	// ErrNamespace indicates that a namespace of the target could not be
+	// entered in Options.StrictNamespaces mode, or that the attach needs a
+	// namespace that was not entered, such as OpenJ9's network namespace
+	// with Options.NoSetns.
+	ErrNamespace = errors.New("cannot enter namespace")
+
+	// ErrInsecure indicates that an attach file or socket failed an
+	// ownership or symlink check, so another user could be impersonating
+	// the JVM. Nothing is sent to the socket in that case.
+	ErrInsecure = errors.New("attach security check failed")
+
+	// ErrUnsupportedCommand indicates that the target JVM does not
+	// implement the command, jcmd subcommand or option. It is returned
+	// before attaching; see Process.SupportedCommands.
+	ErrUnsupportedCommand = errors.New("command not supported by this JVM")
 )
 
 // JVMType represents the type of JVM implementation.
@@ -86,14 +118,247 @@ const (
 	Unknown
 )
 
+// String returns the name of the JVM implementation.
+func (t JVMType) String() string {
+	switch t {
+	case HotSpot:
+		return "HotSpot"
+	case OpenJ9:
+		return "OpenJ9"
+	default:
+		return "Unknown"
+	}
+}
+
 // Options configures the behavior of attach operations.
 type Options struct {
 	// PrintOutput determines whether command output should be printed to stdout.
 	PrintOutput bool
 
+	// Output, if set, receives the output of a successful command in place
+	// of the returned string, which is then empty. On Linux, HotSpot output
+	// is written as it is read from the JVM, so that large thread dumps and
+	// histograms are not held in memory; otherwise it is written once
+	// complete. The output of a failed command is returned as usual. After
+	// a timeout, the attach thread may write to Output until it finishes.
+	Output io.Writer
+
 	// Timeout specifies the maximum time in milliseconds to wait for command completion.
-	// A value of 0 means no timeout (not yet implemented).
+	// A value of 0 means no timeout.
 	Timeout int
+
+	// Policy, if set, is checked before anything is sent to the target.
+	// Rejected operations fail with an error matching ErrPolicyDenied.
+	Policy *Policy
+
+	// CallerUID is the user on whose behalf the operation runs, as seen by
+	// Policy rules and the audit log. nil means the real user ID of the
+	// current process.
+	CallerUID *int
+
+	// Audit, if set, receives an AuditEvent for every operation, including
+	// those rejected by Policy. Audit failures are joined to the returned error.
+	Audit AuditSink
+
+	// Tracer, if set, receives an event for each protocol step, including
+	// the raw bytes exchanged with the JVM.
+	Tracer Tracer
+
+	// DryRun reports what would be sent without creating attach files,
+	// signalling the process or connecting to it. The returned output
+	// describes the request.
+	DryRun bool
+
+	// StrictNamespaces makes a failure to enter one of the target's
+	// namespaces an error matching ErrNamespace. By default such a failure
+	// is only traced and the attach continues in the current namespace;
+	// the target's files are then reached through /proc/{pid}/root, which
+	// suffices for HotSpot but not for OpenJ9, whose semaphore lives in
+	// the target's IPC namespace.
+	StrictNamespaces bool
+
+	// NoSetns attaches without entering any namespace of the target, for
+	// callers that have CAP_SYS_PTRACE and CAP_KILL but not CAP_SYS_ADMIN.
+	// The target's files are reached through /proc/{pid}/root. This works
+	// for HotSpot, whose socket is a file; OpenJ9 fails with ErrNamespace
+	// unless the target shares jambo's network and IPC namespaces.
+	NoSetns bool
+
+	// Retry controls how transient errors connecting to the attach
+	// listener are retried. nil means DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// HotSpotWait controls polling for the HotSpot attach socket after
+	// SIGQUIT. nil means DefaultHotSpotWait.
+	HotSpotWait *WaitPolicy
+
+	// OpenJ9Wait controls waiting for an OpenJ9 JVM to connect back.
+	// nil means DefaultOpenJ9Wait.
+	OpenJ9Wait *WaitPolicy
+
+	// LockTimeout bounds how long to wait for OpenJ9's attach and
+	// notification locks held by another process. 0 means
+	// DefaultLockTimeout.
+	LockTimeout time.Duration
+
+	// AttachPath is the directory in which attach files are created and
+	// looked up, as seen from jambo, e.g. /proc/1234/root/var/tmp. It
+	// replaces the JAMBO_ATTACH_PATH environment variable for this call.
+	// Empty means the directory is derived from the target: its /tmp, or
+	// for OpenJ9 its com.ibm.tools.attach.directory or java.io.tmpdir.
+	// A process taken for HotSpot is checked again for an OpenJ9
+	// advertisement in this directory before attaching.
+	AttachPath string
+
+	// procPid is the PID of the target in /proc as seen by the attaching
+	// thread, set by Process.attach; 0 means the namespace PID.
+	procPid int
+
+	// threads, if set, counts the attach threads still running, which may
+	// outlive AttachContext after a timeout; used by AttachMany.
+	threads *sync.WaitGroup
+}
+
+// WaitPolicy describes how long to wait for the JVM's attach listener, and
+// how often to check in the meantime. Each delay is the previous one plus
+// Increment, times Multiplier.
+type WaitPolicy struct {
+	// InitialDelay is the wait before the first check.
+	InitialDelay time.Duration
+
+	// Increment is added to the delay after each check.
+	Increment time.Duration
+
+	// Multiplier scales the delay after each check. Values below 1 are
+	// treated as 1.
+	Multiplier float64
+
+	// MaxWait bounds the total wait.
+	MaxWait time.Duration
+}
+
+// DefaultHotSpotWait polls every 20ms, 40ms, ... for about 6 seconds.
+var DefaultHotSpotWait = WaitPolicy{
+	InitialDelay: 20 * time.Millisecond,
+	Increment:    20 * time.Millisecond,
+	Multiplier:   1,
+	MaxWait:      6 * time.Second,
+}
+
+// DefaultOpenJ9Wait waits up to 5 seconds, checking every 100ms, 200ms, ...
+// that the target is still alive.
+var DefaultOpenJ9Wait = WaitPolicy{
+	InitialDelay: 100 * time.Millisecond,
+	Increment:    100 * time.Millisecond,
+	Multiplier:   1,
+	MaxWait:      5 * time.Second,
+}
+
+// delays yields the successive delays of the policy, the last one shortened
+// so that their sum is MaxWait.
+func (w *WaitPolicy) delays() iter.Seq[time.Duration] {
+	return func(yield func(time.Duration) bool) {
+		delay := max(w.InitialDelay, time.Millisecond)
+		multiplier := max(w.Multiplier, 1)
+
+		for total := time.Duration(0); total < w.MaxWait; {
+			delay = min(delay, w.MaxWait-total)
+			if !yield(delay) {
+				return
+			}
+			total += delay
+			delay = time.Duration(float64(delay+w.Increment) * multiplier)
+		}
+	}
+}
+
+// hotSpotWait returns HotSpotWait or DefaultHotSpotWait.
+func (o *Options) hotSpotWait() *WaitPolicy {
+	if o.HotSpotWait != nil {
+		return o.HotSpotWait
+	}
+	return &DefaultHotSpotWait
+}
+
+// DefaultLockTimeout is the lock wait used when Options.LockTimeout is 0.
+const DefaultLockTimeout = 10 * time.Second
+
+// lockTimeout returns LockTimeout or DefaultLockTimeout.
+func (o *Options) lockTimeout() time.Duration {
+	if o.LockTimeout > 0 {
+		return o.LockTimeout
+	}
+	return DefaultLockTimeout
+}
+
+// attachPathOverride returns AttachPath, or else JAMBO_ATTACH_PATH.
+func (o *Options) attachPathOverride() string {
+	if o.AttachPath != "" {
+		return o.AttachPath
+	}
+	return os.Getenv("JAMBO_ATTACH_PATH")
+}
+
+// procPID returns the PID under which the target with namespace PID nspid
+// appears in /proc of the attaching thread.
+func (o *Options) procPID(nspid int) int {
+	if o.procPid != 0 {
+		return o.procPid
+	}
+	return nspid
+}
+
+// openJ9Wait returns OpenJ9Wait or DefaultOpenJ9Wait.
+func (o *Options) openJ9Wait() *WaitPolicy {
+	if o.OpenJ9Wait != nil {
+		return o.OpenJ9Wait
+	}
+	return &DefaultOpenJ9Wait
+}
+
+// RetryPolicy describes retries with exponential backoff.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, including the first.
+	Attempts int
+
+	// InitialBackoff is the wait before the second attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between attempts.
+	MaxBackoff time.Duration
+
+	// Multiplier scales the wait after each attempt. Values below 1 are
+	// treated as 1.
+	Multiplier float64
+}
+
+// DefaultRetryPolicy is used when Options.Retry is nil.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+}
+
+// backoff returns the wait after the given failed attempt (starting at 1).
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := max(r.Multiplier, 1)
+	delay := float64(r.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if r.MaxBackoff > 0 && delay >= float64(r.MaxBackoff) {
+			return r.MaxBackoff
+		}
+	}
+	return time.Duration(delay)
+}
+
+// retryPolicy returns Retry or DefaultRetryPolicy.
+func (o *Options) retryPolicy() *RetryPolicy {
+	if o.Retry != nil {
+		return o.Retry
+	}
+	return &DefaultRetryPolicy
 }
 
 // JVM defines the interface for JVM attach operations.
@@ -106,17 +371,21 @@ type JVM interface {
 	//   - pid: The process ID of the target JVM
 	//   - nspid: The namespace PID (for container support, same as pid if not in container)
 	//   - args: Command and its arguments
-	//   - printOutput: Whether to print output to stdout
+	//   - options: Attach options (output printing, tracing, dry run); must not be nil
 	//   - tmpPath: Temporary directory path for attach files
 	//
 	// Returns:
 	//   - string: Command output from the JVM
 	//   - error: Any error that occurred during attach
-	Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error)
+	Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error)
 
 	// Detect checks if the target process is running this JVM type.
 	// Returns true if this JVM implementation is detected.
-	Detect(nspid int) bool
+	//
+	// Parameters:
+	//   - pid: The process ID of the target JVM
+	//   - nspid: The namespace PID (for container support, same as pid if not in container)
+	Detect(pid, nspid int) bool
 
 	// Type returns the JVM implementation type.
 	Type() JVMType
@@ -138,6 +407,10 @@ type JVM interface {
 //	}
 //	fmt.Printf("JVM Type: %v\n", proc.JVM().Type())
 //
+// On Linux the process is pinned with a pidfd and its start time, which are
+// verified before every attach, so a PID reused by another process is
+// never signalled.
+//
 // Returns ErrInvalidPID if pid <= 0.
 // Returns ErrProcessNotFound if the process doesn't exist or can't be accessed.
 
@@ -146,13 +419,25 @@ func NewProcess(pid int) (*Process, error) {
 		return nil, ErrInvalidPID
 	}
 
+	// Pin the process before reading its details, so that they are
+	// verified to belong to the same process below.
+	handle, err := openProcessHandle(pid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProcessNotFound, err)
+	}
+
 	proc := &Process{
-		pid: pid,
+		pid:    pid,
+		handle: handle,
 	}
+	runtime.AddCleanup(proc, func(h *processHandle) { h.close() }, handle)
 
 	if err := proc.getProcessInfo(); err != nil {
 		return nil, err
 	}
+	if err := handle.verify(); err != nil {
+		return nil, err
+	}
 
 	proc.detectJVM()
 	return proc, nil
@@ -163,11 +448,31 @@ func NewProcess(pid int) (*Process, error) {
 //
 // Process instances should be created using NewProcess() to ensure proper initialization.
 type Process struct {
-	pid   int // Process ID
-	uid   int // User ID of the process owner
-	gid   int // Group ID of the process owner
-	nsPid int // Namespace PID (for container support)
-	jvm   JVM // JVM implementation instance (HotSpot or OpenJ9)
+	pid    int            // Process ID
+	uid    int            // User ID of the process owner
+	gid    int            // Group ID of the process owner
+	nsPid  int            // Namespace PID (for container support)
+	nsUid  int            // User ID in the process's user namespace
+	nsGid  int            // Group ID in the process's user namespace
+	jvm    JVM            // JVM implementation instance (HotSpot or OpenJ9)
+	handle *processHandle // pidfd and start time pinning the process identity
+
+	jcmdCatalog *JcmdCatalog // set by JcmdCommands, guarded by jcmdCatalogsMu
+}
+
+// processHandle pins the identity of a process, so that a PID reused by
+// another process after NewProcess is detected rather than signalled.
+type processHandle struct {
+	pid       int
+	pidfd     int    // -1 where pidfd_open is unavailable
+	startTime uint64 // start time in clock ticks after boot, 0 if unknown
+}
+
+// Close releases the pidfd held for the process. It is also released when
+// the Process is garbage collected; calling Close is only needed to free it
+// promptly, and must not be done while an attach is still running.
+func (proc *Process) Close() error {
+	return proc.handle.close()
 }
 
 // Pid returns the process ID of the target JVM process.
@@ -193,6 +498,30 @@ func (proc *Process) NsPid() int {
 	return proc.nsPid
 }
 
+// NsUid returns the user ID of the process owner in the process's user
+// namespace. In rootless containers, this differs from Uid(); it is -1 if
+// the owner is not mapped into the namespace.
+func (proc *Process) NsUid() int {
+	return proc.nsUid
+}
+
+// NsGid returns the group ID of the process owner in the process's user
+// namespace. In rootless containers, this differs from Gid(); it is -1 if
+// the group is not mapped into the namespace.
+func (proc *Process) NsGid() int {
+	return proc.nsGid
+}
+
+// OpenJ9Info returns the attachInfo advertisement of an OpenJ9 JVM, read
+// when the Process was created. It returns nil for other JVMs.
+func (proc *Process) OpenJ9Info() *OpenJ9Info {
+	if o, ok := proc.jvm.(*openJ9); ok && o.info != nil {
+		info := *o.info
+		return &info
+	}
+	return nil
+}
+
 // JVM returns the JVM implementation instance for this process.
 // The instance type (HotSpot or OpenJ9) is automatically detected during Process creation.
 func (proc *Process) JVM() JVM {
@@ -208,6 +537,7 @@ func (p *Process) getProcessInfo() error {
 	p.uid = uid
 	p.gid = gid
 	p.nsPid = nsPid
+	p.nsUid, p.nsGid = getNamespaceIDs(p.pid, uid, gid)
 
 	return nil
 }
@@ -220,22 +550,49 @@ func (p *Process) detectJVM() {
 	openJ9 := &openJ9{}
 	hotSpot := &hotSpot{}
 
-	if openJ9.Detect(p.nsPid) {
+	hotSpot.process = p.handle
+	openJ9.process = p.handle
+
+	if openJ9.Detect(p.pid, p.nsPid) {
 		p.jvm = openJ9
 	} else {
 		p.jvm = hotSpot
 	}
 }
 
+// detectInAttachPath returns the JVM to attach to with options. It repeats
+// OpenJ9 detection in options.AttachPath, which NewProcess does not know
+// about: an OpenJ9 JVM only advertised there would otherwise be taken for
+// HotSpot and sent SIGQUIT, which makes it write a javacore. The result
+// only applies to this call; the Process is not changed, so concurrent
+// calls with other options are unaffected.
+func (p *Process) detectInAttachPath(options *Options) JVM {
+	if options == nil || options.AttachPath == "" {
+		return p.jvm
+	}
+	if _, ok := p.jvm.(*hotSpot); !ok {
+		return p.jvm
+	}
+	if openJ9 := detectOpenJ9(p.pid, p.nsPid, options.AttachPath); openJ9 != nil {
+		openJ9.process = p.handle
+		return openJ9
+	}
+	return p.jvm
+}
+
 // Attach performs an attach operation with the specified command and arguments.
 // This is the main method for executing commands in the target JVM.
 //
-// The method performs the following steps:
+// The method performs the following steps on a dedicated OS thread:
 //  1. Enters target process namespaces (for container support)
 //  2. Switches to target process credentials (if needed)
 //  3. Determines the appropriate temp path
 //  4. Delegates to the JVM-specific implementation
 //
+// Namespace and credential changes are confined to that thread, which is
+// discarded once the operation completes, so Attach may be called
+// concurrently from multiple goroutines.
+//
 // Parameters:
 //   - command: The attach command to execute (e.g., "threaddump", "jcmd", "load")
 //   - args: Additional arguments for the command
@@ -259,21 +616,144 @@ func (p *Process) detectJVM() {
 //
 //	output, err := proc.Attach("load", []string{"/path/to/agent.so", "false", "options"}, nil)
 //
+// Returns ErrPolicyDenied if options.Policy rejects the operation.
 // Returns ErrCommandFailed if the command execution fails in the JVM.
 func (p *Process) Attach(command string, args []string, options *Options) (string, error) {
+	return p.AttachContext(context.Background(), command, args, options)
+}
+
+// AttachContext is like Attach but gives up waiting for the result when ctx
+// is done or when options.Timeout elapses, whichever comes first.
+//
+// The returned error wraps ctx.Err() in that case, so callers can test it with
+// errors.Is(err, context.DeadlineExceeded). The operation itself keeps running
+// on its own thread until the JVM answers or the protocol-level waits expire.
+func (p *Process) AttachContext(ctx context.Context, command string, args []string, options *Options) (string, error) {
 	if options == nil {
 		options = &Options{PrintOutput: true}
 	}
 
-	if err := p.enterNamespaces(); err != nil {
+	if options.Policy == nil && options.Audit == nil {
+		return p.attachContext(ctx, command, args, options)
+	}
+
+	start := time.Now()
+	info := p.vmInfo()
+	callerUID := options.callerUID()
+
+	var event *AuditEvent
+	if options.Audit != nil {
+		event = p.auditEvent(info, callerUID, command, args, start, options)
+	}
+
+	var output string
+	var err error
+	if options.Policy != nil {
+		err = options.Policy.Check(info, callerUID, command, args)
+	}
+	if err == nil {
+		output, err = p.attachContext(ctx, command, args, options)
+	}
+
+	if options.Audit != nil {
+		if auditErr := audit(options.Audit, event, err); auditErr != nil {
+			err = errors.Join(err, fmt.Errorf("audit: %w", auditErr))
+		}
+	}
+
+	return output, err
+}
+
+// attachContext runs the attach sequence on a dedicated OS thread and waits
+// for it, or for ctx and options.Timeout.
+func (p *Process) attachContext(ctx context.Context, command string, args []string, options *Options) (string, error) {
+	jvm := p.detectInAttachPath(options)
+	if err := p.checkCommand(jvm, command, args); err != nil {
+		return "", err
+	}
+
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(options.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	type result struct {
+		output string
+		err    error
+	}
+
+	done := make(chan result, 1)
+	if options.threads != nil {
+		options.threads.Add(1)
+	}
+	go func() {
+		if options.threads != nil {
+			defer options.threads.Done()
+		}
+
+		// The thread is intentionally never unlocked: when this goroutine
+		// returns, the runtime terminates it instead of reusing a thread whose
+		// namespaces and credentials now belong to the target process.
+		runtime.LockOSThread()
+
+		output, err := p.attach(jvm, command, args, options)
+		done <- result{output: output, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.output, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("attach to process %d: %w", p.pid, ctx.Err())
+	}
+}
+
+// vmInfo describes the process for matching against target selectors.
+func (p *Process) vmInfo() VMInfo {
+	cmdline := readCmdline(p.pid)
+	return VMInfo{
+		Pid:         p.pid,
+		MainClass:   parseMainClass(cmdline),
+		CommandLine: cmdline,
+	}
+}
+
+// callerUID returns CallerUID, or the real user ID of the current process.
+func (o *Options) callerUID() int {
+	if o.CallerUID != nil {
+		return *o.CallerUID
+	}
+	return os.Getuid()
+}
+
+// attach runs the attach sequence against jvm on the calling goroutine.
+// It must only be called from a goroutine that is locked to its OS thread.
+func (p *Process) attach(jvm JVM, command string, args []string, options *Options) (string, error) {
+	// Verify through the host /proc, before entering the mount namespace
+	if err := p.handle.verify(); err != nil {
+		return "", err
+	}
+
+	inMount, err := p.enterNamespaces(jvm, options)
+	if err != nil {
 		return "", err
 	}
+	if !inMount {
+		// The target's /proc entries are only reachable by host PID
+		opts := *options
+		opts.procPid = p.pid
+		options = &opts
+	}
 
 	if err := p.setCredentials(); err != nil {
 		return "", err
 	}
+	if err := checkAttachOwner(p.pid, p.nsUid); err != nil {
+		return "", err
+	}
 
-	tmpPath, err := p.getTempPath()
+	tmpPath, err := p.getTempPath(jvm, options)
 	if err != nil {
 		return "", err
 	}
@@ -281,40 +761,100 @@ func (p *Process) Attach(command string, args []string, options *Options) (strin
 	allArgs := append([]string{command}, args...)
 
 	// Use the JVM instance to perform the attach operation
-	if p.jvm == nil {
+	if jvm == nil {
 		return "", errors.New("JVM not initialized")
 	}
 
-	output, err := p.jvm.Attach(p.pid, p.nsPid, allArgs, options.PrintOutput, tmpPath)
+	output, err := jvm.Attach(p.pid, p.nsPid, allArgs, options, tmpPath)
+	if errors.Is(err, ErrNotJVM) || errors.Is(err, ErrAttachDisabled) || errors.Is(err, ErrInsecure) {
+		return output, err
+	}
 	if err != nil {
-		return output, fmt.Errorf("%w: %v", ErrCommandFailed, err)
+		return output, fmt.Errorf("%w: %w", ErrCommandFailed, err)
+	}
+
+	// Output streamed by the JVM implementation has already been written
+	if options.Output != nil && output != "" {
+		if _, err := io.WriteString(options.Output, output); err != nil {
+			return "", fmt.Errorf("write output: %w", err)
+		}
+		output = ""
 	}
 
 	return output, nil
 }
 
-// enterNamespaces enters the target process's Linux namespaces.
-// This is necessary when attaching to JVMs running in containers.
-// Enters net, ipc, and mnt namespaces.
+// enterNamespaces enters the target process's Linux namespaces for an
+// attach to jvm. This is necessary when attaching to JVMs running in
+// containers.
+// Enters net, ipc, and mnt namespaces, and reports whether the current
+// thread is in the target's mount namespace afterwards.
+//
+// The user namespace is never joined: the kernel only allows
+// single-threaded processes to do so, and a Go program never is. Root in
+// the initial user namespace does not need to, and the owner of a rootless
+// container cannot enter its other namespaces without CAP_SYS_ADMIN; its
+// files are reached through /proc/{pid}/root instead.
+//
+// A namespace that cannot be entered is an error with
+// Options.StrictNamespaces; otherwise the attach continues in the current
+// namespace. Either way, the outcome for each namespace is traced. With
+// Options.NoSetns, no namespace is entered at all. OpenJ9 cannot be
+// attached to from outside its network and IPC namespaces, which is
+// reported as ErrNamespace rather than left to time out.
 //
 // On non-Linux platforms or when namespace support is not available,
-// this is a no-op that returns nil.
-func (p *Process) enterNamespaces() error {
-	if err := enterNamespace(p.pid, "net"); err != nil {
-		return err
+// this is a no-op that returns true.
+func (p *Process) enterNamespaces(jvm JVM, options *Options) (bool, error) {
+	if p.nsUid != p.uid || p.nsGid != p.gid {
+		options.trace(TraceNamespace, nil, "process %d runs as uid %d gid %d in its user namespace", p.pid, p.nsUid, p.nsGid)
 	}
-	if err := enterNamespace(p.pid, "ipc"); err != nil {
-		return err
+
+	inMount := true
+	var outside []string
+	for _, nsType := range []string{"net", "ipc", "mnt"} {
+		if options.NoSetns {
+			if !sharesNamespace(p.pid, nsType) {
+				options.trace(TraceNamespace, nil, "not entering %s namespace (no-setns mode)", nsType)
+				outside = append(outside, nsType)
+			}
+			continue
+		}
+
+		joined, err := joinNamespace(p.pid, nsType)
+		switch {
+		case err != nil && options.StrictNamespaces:
+			options.trace(TraceNamespace, nil, "cannot enter %s namespace: %v", nsType, err)
+			return false, fmt.Errorf("%w: %s namespace of process %d: %v", ErrNamespace, nsType, p.pid, err)
+		case err != nil:
+			options.trace(TraceNamespace, nil, "cannot enter %s namespace: %v; continuing in the current one", nsType, err)
+			outside = append(outside, nsType)
+		case joined:
+			options.trace(TraceNamespace, nil, "entered %s namespace of process %d", nsType, p.pid)
+		default:
+			options.trace(TraceNamespace, nil, "%s namespace is shared with the target", nsType)
+		}
 	}
-	if err := enterNamespace(p.pid, "mnt"); err != nil {
-		return err
+
+	for _, nsType := range outside {
+		switch nsType {
+		case "mnt":
+			inMount = false
+		case "net", "ipc":
+			// The JVM connects back to 127.0.0.1 in its own network
+			// namespace and waits on a semaphore in its IPC namespace
+			if jvm != nil && jvm.Type() == OpenJ9 {
+				return false, fmt.Errorf("%w: OpenJ9 attach needs the %s namespace of process %d, which was not entered", ErrNamespace, nsType, p.pid)
+			}
+		}
 	}
-	return nil
+	// In no-setns mode, files are always reached by host PID
+	return inMount && !options.NoSetns, nil
 }
 
 // setCredentials switches to the target process's user and group IDs.
 // This is necessary when the current process has different credentials
-// than the target JVM process.
+// than the target JVM process. Only the calling OS thread is affected.
 //
 // Requires appropriate permissions (typically root or CAP_SETUID/CAP_SETGID).
 // Returns ErrPermission if the credential switch fails.
@@ -324,6 +864,9 @@ func (p *Process) setCredentials() error {
 
 	if myUID != p.uid || myGID != p.gid {
 		if err := setCredentials(p.uid, p.gid); err != nil {
+			if p.nsUid != p.uid {
+				return fmt.Errorf("%w: %v (uid %d is uid %d in the process's user namespace)", ErrPermission, err, p.uid, p.nsUid)
+			}
 			return fmt.Errorf("%w: %v", ErrPermission, err)
 		}
 	}
@@ -331,17 +874,24 @@ func (p *Process) setCredentials() error {
 	return nil
 }
 
-// getTempPath returns the appropriate temporary directory path for attach files.
-// For containerized processes (nsPid != pid), uses the namespace PID.
-// Otherwise, uses the regular PID.
-//
-// The path can be overridden using the JAMBO_ATTACH_PATH environment variable.
-func (p *Process) getTempPath() (string, error) {
-	// Always use nsPid for temp path in containers
-	if p.nsPid != p.pid {
-		return getTempPath(p.nsPid)
+// getTempPath returns the appropriate temporary directory path for the
+// attach files of jvm. For containerized processes, the target's /tmp is found through /proc
+// under the PID it has in the attaching thread's mount namespace. An OpenJ9
+// JVM creates its attach files in its java.io.tmpdir instead.
+//
+// The path can be overridden per call with Options.AttachPath, or using
+// the JAMBO_ATTACH_PATH environment variable.
+func (p *Process) getTempPath(jvm JVM, options *Options) (string, error) {
+	if options.AttachPath != "" {
+		if _, err := os.Stat(options.AttachPath); err != nil {
+			return "", fmt.Errorf("attach path: %w", err)
+		}
+		return options.AttachPath, nil
+	}
+	if o, ok := jvm.(*openJ9); ok && o.tmpDir != "" && os.Getenv("JAMBO_ATTACH_PATH") == "" {
+		return targetFilePath(options.procPID(p.nsPid), o.tmpDir), nil
 	}
-	return getTempPath(p.pid)
+	return getTempPath(options.procPID(p.nsPid))
 }
 
 // Attach is a convenience function that creates a Process and performs an attach operation.
@@ -367,6 +917,7 @@ func Attach(pid int, command string, args []string, printOutput bool) (string, e
 	if err != nil {
 		return "", err
 	}
+	defer proc.Close()
 
 	options := &Options{
 		PrintOutput: printOutput,
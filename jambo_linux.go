@@ -10,11 +10,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -29,9 +32,20 @@ const (
 	attachPath = "/tmp/.java_pid%d" // HotSpot attach file pattern
 )
 
+// Limits of HotSpot attach protocol version 1, enforced by the JVM.
+// Version 2 (JDK 24+) has none of them.
+const (
+	protocolV1NameMax  = 16   // command name, in bytes
+	protocolV1ArgMax   = 1024 // each argument, in bytes
+	protocolV1ArgCount = 3
+)
+
 // hotSpot implements JVM interface for HotSpot JVM on Linux.
 // HotSpot uses Unix domain sockets for attach communication.
-type hotSpot struct{}
+type hotSpot struct {
+	process  *processHandle // signals go through the pidfd when set
+	protocol atomic.Int32   // attach protocol version, 0 until negotiated
+}
 
 // Type returns the JVM type (HotSpot).
 func (h *hotSpot) Type() JVMType {
@@ -49,53 +63,191 @@ func (h *hotSpot) Type() JVMType {
 //
 // HotSpot attach protocol:
 //   - Uses Unix domain sockets at /tmp/.java_pid{nspid}
-//   - Protocol version 1
+//   - Protocol version 1, or 2 for requests version 1 cannot carry
 //   - Commands sent as null-terminated strings
 //   - Response includes status code and output
-func (h *hotSpot) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func (h *hotSpot) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
 	// Ignore SIGPIPE to prevent abnormal process termination
 	// Make write() return EPIPE instead of terminating the process
 	signal.Ignore(syscall.SIGPIPE)
 
 	socketPath := fmt.Sprintf("%s/.java_pid%d", tmpPath, nspid)
 
-	if !h.checkSocket(socketPath) {
-		if err := h.startAttachMechanism(pid, nspid, tmpPath); err != nil {
+	request, err := h.encodeCommand(args)
+	if err != nil {
+		return "", err
+	}
+
+	socketExists := h.checkSocket(socketPath)
+	if !socketExists {
+		// SIGQUIT terminates a process that does not handle it
+		if err := checkAttachable(options.procPID(nspid)); err != nil {
+			return "", err
+		}
+	}
+
+	exact := fitsProtocolV1(args)
+
+	if options.DryRun {
+		if !exact {
+			version := int(h.protocol.Load())
+			if version == 0 {
+				options.trace(TraceDryRun, nil, "would ask %s for the attach protocol version; showing the version 2 request", socketPath)
+				version = 2
+			}
+			if request, err = encodeForProtocol(version, args, request); err != nil {
+				return "", err
+			}
+		}
+		return h.dryRun(pid, nspid, request, options, socketPath), nil
+	}
+
+	if !socketExists {
+		if err := h.startAttachMechanism(pid, nspid, tmpPath, options); err != nil {
+			if errors.Is(err, ErrInsecure) {
+				return "", err
+			}
 			return "", fmt.Errorf("failed to start attach mechanism: %v", err)
 		}
 	}
 
-	conn, err := connectToSocket(socketPath)
+	if !exact {
+		version := h.protocolVersion(pid, nspid, tmpPath, socketPath, options)
+		if request, err = encodeForProtocol(version, args, request); err != nil {
+			return "", err
+		}
+	}
+
+	conn, err := h.connect(pid, nspid, tmpPath, socketPath, options)
 	if err != nil {
 		return "", err
 	}
 	defer conn.Close()
 
-	if err := h.sendCommand(conn, args); err != nil {
+	if err := h.sendCommand(conn, request, options); err != nil {
 		return "", err
 	}
 
-	output, err := h.readResponse(conn, args)
+	output, err := h.readResponse(conn, args, options, options.Output)
 	if err != nil {
 		return "", err
 	}
 
-	if printOutput {
+	if options.PrintOutput {
 		fmt.Print(output)
 	}
 
 	return output, nil
 }
 
+// connect opens the verified attach socket. A stale socket, left by a JVM
+// that is gone, is removed and the attach listener started again; other
+// transient errors are retried according to options.Retry.
+func (h *hotSpot) connect(pid, nspid int, tmpPath, socketPath string, options *Options) (*socketConn, error) {
+	retry := options.retryPolicy()
+	restarted := false
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dialVerified(socketPath)
+		if err == nil {
+			options.traceConn(conn.id, TraceConnect, nil, "connected to %s", socketPath)
+			return conn, nil
+		}
+		if errors.Is(err, ErrInsecure) {
+			return nil, err
+		}
+		options.trace(TraceConnect, nil, "connect to %s failed (attempt %d): %v", socketPath, attempt, err)
+
+		// Nobody listens on the socket: the JVM that created it is gone
+		if errors.Is(err, syscall.ECONNREFUSED) && !restarted {
+			restarted = true
+			if err := h.restartAttachListener(pid, nspid, tmpPath, socketPath, options); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !isTransientConnectError(err) || attempt >= retry.Attempts {
+			return nil, err
+		}
+		time.Sleep(retry.backoff(attempt))
+	}
+}
+
+// dialVerified connects to the attach socket after checking its owner, and
+// checks the owner of the listening process once connected.
+func dialVerified(socketPath string) (*socketConn, error) {
+	if err := verifySocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	conn, err := connectToSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyPeer(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// restartAttachListener removes a stale attach socket and triggers the
+// attach listener again.
+func (h *hotSpot) restartAttachListener(pid, nspid int, tmpPath, socketPath string, options *Options) error {
+	if err := syscall.Unlink(socketPath); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("stale attach socket %s cannot be removed: %v", socketPath, err)
+	}
+	options.trace(TraceAttachFile, nil, "removed stale socket %s", socketPath)
+
+	if err := checkAttachable(options.procPID(nspid)); err != nil {
+		return err
+	}
+	if err := h.startAttachMechanism(pid, nspid, tmpPath, options); err != nil {
+		if errors.Is(err, ErrInsecure) {
+			return err
+		}
+		return fmt.Errorf("failed to start attach mechanism: %v", err)
+	}
+	return nil
+}
+
+// isTransientConnectError reports whether a failed connect may succeed
+// when retried: the listener's backlog is full, the call was interrupted,
+// or the socket is being recreated.
+func isTransientConnectError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.ENOENT)
+}
+
+// dryRun describes the request Attach would send, without touching the target.
+func (h *hotSpot) dryRun(pid, nspid int, request []byte, options *Options, socketPath string) string {
+	if h.checkSocket(socketPath) {
+		options.trace(TraceDryRun, nil, "socket %s exists, would connect", socketPath)
+	} else {
+		options.trace(TraceDryRun, nil, "would create /proc/%d/cwd/.attach_pid%d and send SIGQUIT to %d", options.procPID(nspid), nspid, pid)
+	}
+	options.trace(TraceDryRun, request, "would send %d bytes to %s", len(request), socketPath)
+
+	return fmt.Sprintf("socket: %s\nrequest: %s\n", socketPath, strconv.Quote(string(request)))
+}
+
 // Detect checks if the process is a HotSpot JVM.
 // Always returns true as HotSpot is used as the fallback/default JVM type.
-func (h *hotSpot) Detect(nspid int) bool {
+func (h *hotSpot) Detect(pid, nspid int) bool {
 	return true // HotSpot is the default
 }
 
 // openJ9 implements JVM interface for OpenJ9 JVM on Linux.
 // OpenJ9 uses a different attach mechanism than HotSpot.
-type openJ9 struct{}
+type openJ9 struct {
+	info      *OpenJ9Info    // advertisement found by Detect
+	directory string         // -Dcom.ibm.tools.attach.directory, as the JVM sees it
+	tmpDir    string         // -Djava.io.tmpdir, as the JVM sees it
+	process   *processHandle // liveness is checked through the pidfd when set
+}
 
 // getProcessInfo retrieves process information from /proc/{pid}/status.
 // Returns:
@@ -153,6 +305,108 @@ func getProcessInfo(pid int) (uid, gid, nspid int, err error) {
 	return uid, gid, nspid, nil
 }
 
+// openProcessHandle opens a pidfd for pid and records its start time.
+// Kernels without pidfd_open (before 5.3) fall back to the start time alone.
+func openProcessHandle(pid int) (*processHandle, error) {
+	h := &processHandle{pid: pid, pidfd: -1}
+
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == nil {
+		h.pidfd = fd
+	} else if errors.Is(err, unix.ESRCH) {
+		return nil, err
+	}
+
+	startTime, err := readStartTime(pid)
+	if err != nil {
+		h.close()
+		return nil, err
+	}
+	h.startTime = startTime
+
+	return h, nil
+}
+
+// verify checks that the process is still running and that its PID has not
+// been reused. It reads /proc/{pid}/stat, so it must be called before
+// entering the target's mount namespace.
+func (h *processHandle) verify() error {
+	if h == nil {
+		return nil
+	}
+
+	if !h.alive() {
+		return fmt.Errorf("%w: process %d has exited", ErrProcessNotFound, h.pid)
+	}
+
+	if h.startTime != 0 {
+		startTime, err := readStartTime(h.pid)
+		if err != nil || startTime != h.startTime {
+			return fmt.Errorf("%w: process %d has exited and its PID was reused", ErrProcessNotFound, h.pid)
+		}
+	}
+
+	return nil
+}
+
+// alive reports whether the process is still running.
+func (h *processHandle) alive() bool {
+	var err error
+	if h.pidfd >= 0 {
+		err = unix.PidfdSendSignal(h.pidfd, 0, nil, 0)
+	} else {
+		err = syscall.Kill(h.pid, 0)
+	}
+	// EPERM means the process exists but belongs to someone else
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// signal sends sig to the process. Through a pidfd the signal cannot
+// reach a different process that has reused the PID.
+func (h *processHandle) signal(sig syscall.Signal) error {
+	if h.pidfd >= 0 {
+		return unix.PidfdSendSignal(h.pidfd, sig, nil, 0)
+	}
+	return syscall.Kill(h.pid, sig)
+}
+
+// close releases the pidfd.
+func (h *processHandle) close() error {
+	if h == nil || h.pidfd < 0 {
+		return nil
+	}
+	err := syscall.Close(h.pidfd)
+	h.pidfd = -1
+	return err
+}
+
+// readStartTime returns the start time of pid, in clock ticks after boot,
+// from field 22 of /proc/{pid}/stat.
+func readStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseStartTime(data)
+}
+
+// parseStartTime extracts the start time from a /proc/{pid}/stat line.
+// The command name may contain spaces and parentheses, so fields are
+// counted from the last ')'.
+func parseStartTime(stat []byte) (uint64, error) {
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, errors.New("invalid stat format")
+	}
+
+	// Fields after the command start at field 3 (state)
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return 0, errors.New("invalid stat format")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
 func schedGetHostPID(path string) int {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -224,108 +478,384 @@ func altLookupNSPID(pid int) int {
 	return pid
 }
 
+// listJVMs scans /proc for processes started by a java launcher.
+func listJVMs() ([]VMInfo, error) {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	var vms []VMInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		cmdline := readCmdline(pid)
+		if len(cmdline) == 0 || !isJavaLauncher(pid, cmdline[0]) {
+			continue
+		}
+
+		vms = append(vms, VMInfo{
+			Pid:         pid,
+			MainClass:   parseMainClass(cmdline),
+			CommandLine: cmdline,
+		})
+	}
+
+	return vms, nil
+}
+
+// readCmdline returns the NUL-separated arguments from /proc/{pid}/cmdline.
+func readCmdline(pid int) []string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
+
+// readEnviron returns the NAME=value entries of /proc/{pid}/environ.
+func readEnviron(pid int) []string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
+
+// readCgroupPaths returns the cgroup paths listed in /proc/{pid}/cgroup,
+// one per hierarchy (a single entry on cgroup v2).
+func readCgroupPaths(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Format: hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) == 3 {
+			paths = append(paths, parts[2])
+		}
+	}
+	return paths, nil
+}
+
+// targetFilePath returns the host path of a file as the target process sees
+// it: absolute paths are resolved in its mount namespace, relative paths
+// against its working directory.
+func targetFilePath(pid int, path string) string {
+	if filepath.IsAbs(path) {
+		return fmt.Sprintf("/proc/%d/root%s", pid, path)
+	}
+	return fmt.Sprintf("/proc/%d/cwd/%s", pid, path)
+}
+
+// readTargetFile reads a file of process pid, at the path the process
+// sees.
+func readTargetFile(pid int, path string) ([]byte, error) {
+	return os.ReadFile(targetFilePath(pid, path))
+}
+
+// isJavaLauncher reports whether the process executable is a java launcher.
+// The executable link is preferred; argv[0] is used when it is not readable.
+func isJavaLauncher(pid int, argv0 string) bool {
+	name := argv0
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		name = exe
+	}
+	name = filepath.Base(name)
+	return name == "java" || name == "javaw"
+}
+
+// checkSocket reports whether a socket exists at path. Symlinks are not
+// followed.
 func (h *hotSpot) checkSocket(path string) bool {
 	var stat syscall.Stat_t
-	if err := syscall.Stat(path, &stat); err != nil {
+	if err := syscall.Lstat(path, &stat); err != nil {
 		return false
 	}
-	return stat.Mode&syscall.S_IFSOCK != 0
+	return stat.Mode&syscall.S_IFMT == syscall.S_IFSOCK
+}
+
+// verifySocket checks that the attach socket at path is a socket owned by
+// the current effective user, which is the target's user after credential
+// switching, or by root. Anyone else could be impersonating the JVM.
+func verifySocket(path string) error {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		return fmt.Errorf("%w: %s is not a socket", ErrInsecure, path)
+	}
+	if euid := os.Geteuid(); int(stat.Uid) != euid && stat.Uid != 0 {
+		return fmt.Errorf("%w: %s is owned by uid %d, expected %d or root", ErrInsecure, path, stat.Uid, euid)
+	}
+	return nil
+}
+
+// verifyPeer checks the credentials of the process listening on conn, which
+// closes the window between verifySocket and connect.
+func verifyPeer(conn *socketConn) error {
+	cred, err := unix.GetsockoptUcred(conn.fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return err
+	}
+	if euid := os.Geteuid(); int(cred.Uid) != euid && cred.Uid != 0 {
+		return fmt.Errorf("%w: attach listener runs as uid %d (pid %d), expected %d or root", ErrInsecure, cred.Uid, cred.Pid, euid)
+	}
+	return nil
+}
+
+// createAttachFile creates the .attach_pid trigger file without following
+// symlinks. A file left behind by an earlier attempt is reused only if it is
+// a regular file owned by the current effective user.
+func createAttachFile(path string) error {
+	fd, err := syscall.Open(path, syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0660)
+	if err == nil {
+		return syscall.Close(fd)
+	}
+	if errors.Is(err, syscall.ELOOP) {
+		return fmt.Errorf("%w: %s is a symlink", ErrInsecure, path)
+	}
+	if !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return fmt.Errorf("%w: %s exists and is not a regular file", ErrInsecure, path)
+	}
+	if int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("%w: %s exists and is owned by uid %d", ErrInsecure, path, stat.Uid)
+	}
+	return nil
+}
+
+// signal sends sig to the target through its pidfd, if known.
+func (h *hotSpot) signal(pid int, sig syscall.Signal) error {
+	if h.process != nil {
+		return h.process.signal(sig)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// alive reports whether the target is still running.
+func (h *hotSpot) alive(pid int) bool {
+	return processAlive(h.process, pid)
+}
+
+// processAlive reports whether the target is still running, through its
+// pidfd if the handle is known. Without one, the check goes by PID.
+func processAlive(handle *processHandle, pid int) bool {
+	if handle == nil {
+		handle = &processHandle{pid: pid, pidfd: -1}
+	}
+	return handle.alive()
+}
+
+// checkAttachable verifies that the process can be sent SIGQUIT safely.
+// It returns ErrNotJVM if no JVM library is mapped into the process, and
+// ErrAttachDisabled if SIGQUIT is not caught or the attach mechanism was
+// disabled on the command line. pid is resolved in the current mount
+// namespace's /proc, like the .attach_pid file.
+func checkAttachable(pid int) error {
+	// maps needs ptrace read access; if it is unreadable, rely on SigCgt alone
+	if maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid)); err == nil && !mapsHaveJVM(maps) {
+		return fmt.Errorf("%w: process %d has neither libjvm nor libj9vm loaded", ErrNotJVM, pid)
+	}
+
+	status, err := os.ReadFile(fmt.Sprintf(statusPath, pid))
+	if err != nil {
+		return err
+	}
+	caught, err := signalCaught(status, syscall.SIGQUIT)
+	if err != nil {
+		return err
+	}
+	if !caught {
+		return fmt.Errorf("%w: process %d does not handle SIGQUIT (started with -Xrs?)", ErrAttachDisabled, pid)
+	}
+
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		for _, arg := range strings.Split(string(cmdline), "\x00") {
+			if arg == "-XX:+DisableAttachMechanism" {
+				return fmt.Errorf("%w: process %d was started with -XX:+DisableAttachMechanism", ErrAttachDisabled, pid)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mapsHaveJVM reports whether a /proc/<pid>/maps listing contains a
+// HotSpot (libjvm) or OpenJ9 (libj9vm) library.
+func mapsHaveJVM(maps []byte) bool {
+	return jvmLibrary(maps) != ""
+}
+
+// jvmLibrary returns the path of the first HotSpot or OpenJ9 library in a
+// /proc/<pid>/maps listing, or "".
+func jvmLibrary(maps []byte) string {
+	for _, line := range strings.Split(string(maps), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		name := filepath.Base(fields[5])
+		if strings.HasPrefix(name, "libjvm.") || strings.HasPrefix(name, "libj9vm") {
+			return fields[5]
+		}
+	}
+	return ""
+}
+
+// signalCaught reports whether sig is set in the SigCgt mask of a
+// /proc/<pid>/status file.
+func signalCaught(status []byte, sig syscall.Signal) (bool, error) {
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "SigCgt:") {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "SigCgt:")), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid SigCgt mask: %v", err)
+		}
+		return mask&(1<<(uint(sig)-1)) != 0, nil
+	}
+	return false, errors.New("SigCgt not found in process status")
 }
 
 func getFileOwner(path string) int {
 	var stat syscall.Stat_t
-	if err := syscall.Stat(path, &stat); err != nil {
+	if err := syscall.Lstat(path, &stat); err != nil {
 		return -1
 	}
 	return int(stat.Uid)
 }
 
-func (h *hotSpot) startAttachMechanism(pid, nspid int, tmpPath string) error {
+func (h *hotSpot) startAttachMechanism(pid, nspid int, tmpPath string, options *Options) error {
 	// Try current directory first
-	path := fmt.Sprintf("/proc/%d/cwd/.attach_pid%d", nspid, nspid)
-	fd, err := syscall.Open(path, syscall.O_CREAT|syscall.O_WRONLY, 0660)
-	if err != nil || (syscall.Close(fd) == nil && getFileOwner(path) != os.Geteuid()) {
-		syscall.Unlink(path)
+	path := fmt.Sprintf("/proc/%d/cwd/.attach_pid%d", options.procPID(nspid), nspid)
+	err := createAttachFile(path)
+	if errors.Is(err, ErrInsecure) {
+		return err
+	}
+	if err != nil || getFileOwner(path) != os.Geteuid() {
+		// Some filesystems change the owner of new files; the JVM
+		// does not trust such a file
+		if err == nil {
+			syscall.Unlink(path)
+		}
 
 		// Try /tmp
 		path = fmt.Sprintf("%s/.attach_pid%d", tmpPath, nspid)
-		fd, err = syscall.Open(path, syscall.O_CREAT|syscall.O_WRONLY, 0660)
-		if err != nil {
+		if err := createAttachFile(path); err != nil {
 			return err
 		}
-		syscall.Close(fd)
 	}
+	options.trace(TraceAttachFile, nil, "created %s", path)
 
 	// Send SIGQUIT to trigger attach mechanism
-	if err := syscall.Kill(pid, syscall.SIGQUIT); err != nil {
+	if err := h.signal(pid, syscall.SIGQUIT); err != nil {
 		return err
 	}
+	options.trace(TraceSignal, nil, "sent SIGQUIT to %d", pid)
 
-	// Wait for socket to appear with incremental backoff
-	// Start with 20ms and increment by 20ms each iteration up to 500ms
-	// Total timeout is approximately 6000ms
+	// Wait for socket to appear, polling with increasing delays
 	socketPath := fmt.Sprintf("%s/.java_pid%d", tmpPath, nspid)
-	delay := 20 * time.Millisecond
+	start := time.Now()
 
-	for delay < 500*time.Millisecond {
+	for delay := range options.hotSpotWait().delays() {
 		time.Sleep(delay)
 		if h.checkSocket(socketPath) {
+			options.trace(TracePoll, nil, "socket %s found after %v", socketPath, time.Since(start).Round(time.Millisecond))
 			syscall.Unlink(path)
+			options.trace(TraceAttachFile, nil, "removed %s", path)
 			return nil
 		}
+		options.trace(TracePoll, nil, "socket %s not present after %v", socketPath, time.Since(start).Round(time.Millisecond))
 
 		// Check if process still exists
-		if err := syscall.Kill(pid, 0); err != nil {
-			break
+		if !h.alive(pid) {
+			syscall.Unlink(path)
+			return fmt.Errorf("process %d exited while waiting for attach socket", pid)
 		}
-
-		delay += 20 * time.Millisecond
 	}
 
 	syscall.Unlink(path)
-	return errors.New("timeout waiting for attach socket")
+	options.trace(TraceAttachFile, nil, "removed %s", path)
+	return fmt.Errorf("timeout waiting for attach socket %s: waited %v", socketPath, time.Since(start).Round(time.Millisecond))
 }
 
-func enterNamespace(pid int, nsType string) error {
-	nsFile := fmt.Sprintf(nsPath, pid, nsType)
-	selfNsFile := fmt.Sprintf("/proc/self/ns/%s", nsType)
+// sharesNamespace reports whether the calling thread is in the nsType
+// namespace of pid.
+func sharesNamespace(pid int, nsType string) bool {
+	var self, target syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/thread-self/ns/%s", nsType), &self); err != nil {
+		return false
+	}
+	if err := syscall.Stat(fmt.Sprintf(nsPath, pid, nsType), &target); err != nil {
+		return false
+	}
+	return self.Ino == target.Ino
+}
 
-	// Check if we're already in the same namespace
-	var oldStat, newStat syscall.Stat_t
-	if err := syscall.Stat(selfNsFile, &oldStat); err == nil {
-		if err := syscall.Stat(nsFile, &newStat); err == nil {
-			if oldStat.Ino == newStat.Ino {
-				// Already in the same namespace
-				return nil
-			}
-		}
+// joinNamespace moves the calling thread into a namespace of pid. It
+// reports whether the namespace differed from the current one and was
+// joined; a shared namespace is not an error. The caller must have locked
+// the thread with runtime.LockOSThread and must not unlock it.
+func joinNamespace(pid int, nsType string) (bool, error) {
+	if sharesNamespace(pid, nsType) {
+		// Already in the same namespace
+		return false, nil
 	}
 
+	nsFile := fmt.Sprintf(nsPath, pid, nsType)
 	fd, err := syscall.Open(nsFile, syscall.O_RDONLY, 0)
 	if err != nil {
-		// If we can't open the namespace file, it's likely we're in the same namespace already
-		return nil
+		return false, err
 	}
 	defer syscall.Close(fd)
 
+	// The threads of a Go process share their root and working directory,
+	// and setns refuses to change the mount namespace of a thread that
+	// shares them with others
+	if nsType == "mnt" {
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			return false, err
+		}
+	}
+
 	// Try to enter the namespace using setns syscall
 	// Note: This requires CAP_SYS_ADMIN capability
-	err = unix.Setns(fd, 0)
-	if err != nil {
-		// Fail silently if we don't have permission
-		// The attach may still work if we're in the same namespace
-		return nil
+	if err := unix.Setns(fd, 0); err != nil {
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
 
+// setCredentials switches the effective uid/gid of the calling OS thread.
+//
+// syscall.Setreuid and syscall.Setregid apply the change to every thread of
+// the process, which would leak the target's identity into unrelated
+// goroutines. The raw syscalls only affect the current thread, which the
+// caller must have locked with runtime.LockOSThread.
 func setCredentials(uid, gid int) error {
-	if err := syscall.Setregid(-1, gid); err != nil {
-		return err
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETREGID, ^uintptr(0), uintptr(gid), 0); errno != 0 {
+		return errno
 	}
-	if err := syscall.Setreuid(-1, uid); err != nil {
-		return err
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETREUID, ^uintptr(0), uintptr(uid), 0); errno != 0 {
+		return errno
 	}
 	return nil
 }
@@ -354,10 +884,12 @@ func (o *openJ9) Type() JVMType {
 	return OpenJ9
 }
 
-// translateCommand translates HotSpot commands to OpenJ9 equivalents
-func (o *openJ9) translateCommand(args []string) string {
+// translateCommand translates HotSpot commands to OpenJ9 equivalents.
+// Diagnostic command arguments containing commas are an error, since
+// OpenJ9 separates them with commas and has no escape.
+func (o *openJ9) translateCommand(args []string) (string, error) {
 	if len(args) == 0 {
-		return ""
+		return "", nil
 	}
 
 	cmd := args[0]
@@ -372,80 +904,152 @@ func (o *openJ9) translateCommand(args []string) string {
 
 		// Check if absolute path (third argument is "true")
 		if len(args) > 2 && args[2] == "true" {
-			return fmt.Sprintf("ATTACH_LOADAGENTPATH(%s,%s)", agentPath, options)
+			return fmt.Sprintf("ATTACH_LOADAGENTPATH(%s,%s)", agentPath, options), nil
 		}
-		return fmt.Sprintf("ATTACH_LOADAGENT(%s,%s)", agentPath, options)
+		return fmt.Sprintf("ATTACH_LOADAGENT(%s,%s)", agentPath, options), nil
 	}
 
-	// jcmd command: ATTACH_DIAGNOSTICS with comma-separated arguments
+	// jcmd command: ATTACH_DIAGNOSTICS with comma-separated arguments,
+	// except for the management agent, which has its own commands
 	if cmd == "jcmd" {
+		// Arguments are passed as given; a single command line, as sent
+		// to HotSpot, is split where it is not quoted
+		fields := args[1:]
+		if len(fields) == 1 {
+			fields = splitJavaOptions(fields[0])
+		}
+		if len(fields) > 0 && fields[0] == "ManagementAgent.start_local" {
+			return "ATTACH_START_LOCAL_MANAGEMENT_AGENT", nil
+		}
+		if len(fields) > 0 && fields[0] == "ManagementAgent.start" {
+			// The agent properties follow the command, NUL-terminated
+			return "ATTACH_START_MANAGEMENT_AGENT\x00" + managementAgentProperties(fields[1:]), nil
+		}
 		if len(args) > 1 {
 			// Join all arguments after "jcmd" with commas
-			return "ATTACH_DIAGNOSTICS:" + strings.Join(args[1:], ",")
+			joined, err := diagnosticArgs(args[1:])
+			if err != nil {
+				return "", err
+			}
+			return "ATTACH_DIAGNOSTICS:" + joined, nil
 		}
-		return "ATTACH_DIAGNOSTICS:help"
+		return "ATTACH_DIAGNOSTICS:help", nil
 	}
 
 	// threaddump command
 	if cmd == "threaddump" {
 		if len(args) > 1 {
-			return fmt.Sprintf("ATTACH_DIAGNOSTICS:Thread.print,%s", args[1])
+			arg, err := diagnosticArgs(args[1:2])
+			if err != nil {
+				return "", err
+			}
+			return "ATTACH_DIAGNOSTICS:Thread.print," + arg, nil
 		}
-		return "ATTACH_DIAGNOSTICS:Thread.print,"
+		return "ATTACH_DIAGNOSTICS:Thread.print,", nil
 	}
 
 	// dumpheap command
 	if cmd == "dumpheap" {
 		if len(args) > 1 {
-			return fmt.Sprintf("ATTACH_DIAGNOSTICS:Dump.heap,%s", args[1])
+			arg, err := diagnosticArgs(args[1:2])
+			if err != nil {
+				return "", err
+			}
+			return "ATTACH_DIAGNOSTICS:Dump.heap," + arg, nil
 		}
-		return "ATTACH_DIAGNOSTICS:Dump.heap,"
+		return "ATTACH_DIAGNOSTICS:Dump.heap,", nil
 	}
 
 	// inspectheap command
 	if cmd == "inspectheap" {
 		if len(args) > 1 {
-			return fmt.Sprintf("ATTACH_DIAGNOSTICS:GC.class_histogram,%s", args[1])
+			arg, err := diagnosticArgs(args[1:2])
+			if err != nil {
+				return "", err
+			}
+			return "ATTACH_DIAGNOSTICS:GC.class_histogram," + arg, nil
 		}
-		return "ATTACH_DIAGNOSTICS:GC.class_histogram,"
+		return "ATTACH_DIAGNOSTICS:GC.class_histogram,", nil
 	}
 
 	// datadump command
 	if cmd == "datadump" {
 		if len(args) > 1 {
-			return fmt.Sprintf("ATTACH_DIAGNOSTICS:Dump.java,%s", args[1])
+			arg, err := diagnosticArgs(args[1:2])
+			if err != nil {
+				return "", err
+			}
+			return "ATTACH_DIAGNOSTICS:Dump.java," + arg, nil
 		}
-		return "ATTACH_DIAGNOSTICS:Dump.java,"
+		return "ATTACH_DIAGNOSTICS:Dump.java,", nil
 	}
 
 	// properties command
 	if cmd == "properties" {
-		return "ATTACH_GETSYSTEMPROPERTIES"
+		return "ATTACH_GETSYSTEMPROPERTIES", nil
 	}
 
 	// agentProperties command
 	if cmd == "agentProperties" {
-		return "ATTACH_GETAGENTPROPERTIES"
+		return "ATTACH_GETAGENTPROPERTIES", nil
 	}
 
 	// For unknown commands, return as-is
-	return cmd
+	return cmd, nil
+}
+
+// diagnosticArgs joins the arguments of an ATTACH_DIAGNOSTICS request with
+// commas, rejecting arguments that contain one.
+func diagnosticArgs(args []string) (string, error) {
+	for _, arg := range args {
+		if strings.ContainsRune(arg, ',') {
+			return "", fmt.Errorf("argument %q: OpenJ9 cannot pass commas in jcmd arguments", arg)
+		}
+	}
+	return strings.Join(args, ","), nil
 }
 
 // Attach performs the attach operation for OpenJ9 JVM
-func (o *openJ9) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func (o *openJ9) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
 	// Verify attachInfo exists
-	attachInfoPath := fmt.Sprintf("%s/.com_ibm_tools_attach/%d/attachInfo", tmpPath, nspid)
+	attachDir := o.attachDir(tmpPath, nspid, options)
+	attachInfoPath := fmt.Sprintf("%s/%d/attachInfo", attachDir, nspid)
 	if _, err := os.Stat(attachInfoPath); err != nil {
 		return "", fmt.Errorf("OpenJ9 attachInfo not found at %s: %v (JVM may not have attach enabled)", attachInfoPath, err)
 	}
 
+	translatedCmd, err := o.translateCommand(args)
+	if err != nil {
+		return "", err
+	}
+	if len(translatedCmd)+1 > MaxRequestSize {
+		return "", fmt.Errorf("%w: %d bytes, limit %d", ErrRequestTooLarge, len(translatedCmd)+1, MaxRequestSize)
+	}
+	if options.DryRun {
+		options.trace(TraceDryRun, nil, "would lock %s/_attachlock and notify %s", attachDir, attachInfoPath)
+		options.trace(TraceDryRun, []byte(translatedCmd+"\x00"), "would send command")
+		return fmt.Sprintf("attachInfo: %s\ncommand: %s\n", attachInfoPath, strconv.Quote(translatedCmd+"\x00")), nil
+	}
+
 	// Step 1: Acquire attach lock
-	attachLock, err := o.acquireLock(tmpPath, "", "_attachlock")
+	attachLock, err := o.acquireLock(attachDir, "", "_attachlock", options.lockTimeout())
 	if err != nil {
 		return "", fmt.Errorf("could not acquire attach lock: %v", err)
 	}
 	defer o.releaseLock(attachLock)
+	options.trace(TraceLock, nil, "acquired %s/_attachlock", attachDir)
+
+	// No other attach is running while the lock is held, so anything an
+	// earlier one left behind can be repaired now
+	procRoot := targetFilePath(options.procPID(nspid), "/proc")
+	for _, stale := range removeStaleOpenJ9Entries(attachDir, procRoot, nspid, false) {
+		options.trace(TraceCleanup, nil, "removed %s: %s", stale.Path, stale.Reason)
+	}
+	if stale, err := o.repairSemaphore(attachDir, false); err != nil {
+		options.trace(TraceSemop, nil, "cannot check semaphore: %v", err)
+	} else if stale != nil {
+		options.trace(TraceCleanup, nil, "reset %s: %s", stale.Path, stale.Reason)
+	}
 
 	// Step 2: Create TCP listen socket
 	listener, port, err := o.createAttachSocket()
@@ -453,50 +1057,55 @@ func (o *openJ9) Attach(pid, nspid int, args []string, printOutput bool, tmpPath
 		return "", fmt.Errorf("failed to create attach socket: %v", err)
 	}
 	defer listener.Close()
+	options.trace(TraceConnect, nil, "listening on %s", listener.Addr())
 
 	// Step 3: Generate random key for connection verification
 	key := o.randomKey()
 
 	// Step 4: Write replyInfo file with port and key
-	if err := o.writeReplyInfo(tmpPath, nspid, port, key); err != nil {
+	if err := o.writeReplyInfo(attachDir, nspid, port, key, options); err != nil {
 		return "", fmt.Errorf("could not write replyInfo: %v", err)
 	}
-	defer o.cleanupReplyInfo(tmpPath, nspid)
+	defer o.cleanupReplyInfo(attachDir, nspid)
 
 	// Step 5: Lock notification files and notify semaphore
-	notifLocks, notifCount := o.lockNotificationFiles(tmpPath)
+	notifLocks, notifCount := o.lockNotificationFiles(attachDir, options)
 	defer o.unlockNotificationFiles(notifLocks)
+	options.trace(TraceLock, nil, "locked %d attachNotificationSync files", notifCount)
 
-	if err := o.notifySemaphore(tmpPath, 1, notifCount); err != nil {
+	if err := o.notifySemaphore(attachDir, 1, notifCount, options); err != nil {
 		return "", fmt.Errorf("could not notify semaphore: %v", err)
 	}
-	defer o.notifySemaphore(tmpPath, -1, notifCount)
+	defer o.notifySemaphore(attachDir, -1, notifCount, options)
 
 	// Step 6: Accept connection from JVM
-	conn, err := o.acceptClient(listener, key)
+	conn, err := o.acceptClient(listener.(*net.TCPListener), pid, key, options)
 	if err != nil {
 		return "", fmt.Errorf("JVM did not respond: %v", err)
 	}
 	defer conn.Close()
+	connID := newConnID()
+	options.traceConn(connID, TraceAccept, nil, "accepted %s with key %016x", conn.RemoteAddr(), key)
 
-	if printOutput {
+	if options.PrintOutput {
 		fmt.Println("Connected to remote JVM")
 	}
 
-	// Step 7: Translate and send command
-	translatedCmd := o.translateCommand(args)
+	// Step 7: Send translated command
+	options.traceConn(connID, TraceSend, []byte(translatedCmd+"\x00"), "command")
 	if err := o.writeCommand(conn, translatedCmd); err != nil {
 		return "", fmt.Errorf("error writing command: %v", err)
 	}
 
 	// Step 8: Read response
-	output, exitCode, err := o.readResponse(conn, translatedCmd, printOutput)
+	output, exitCode, err := o.readResponse(conn, connID, translatedCmd, options)
 	if err != nil {
 		return output, err
 	}
 
 	// Step 9: Send detach command if successful
 	if exitCode != 1 {
+		options.traceConn(connID, TraceSend, []byte("ATTACH_DETACHED\x00"), "detach")
 		o.detach(conn)
 	}
 
@@ -507,17 +1116,18 @@ func (o *openJ9) Attach(pid, nspid int, args []string, printOutput bool, tmpPath
 	return output, nil
 }
 
-// acquireLock acquires a file lock for synchronization
-func (o *openJ9) acquireLock(tmpPath, subdir, filename string) (int, error) {
+// acquireLock acquires a file lock for synchronization, waiting at most
+// timeout for a holder to release it.
+func (o *openJ9) acquireLock(attachDir, subdir, filename string, timeout time.Duration) (int, error) {
 	var path string
 	if subdir == "" {
-		path = fmt.Sprintf("%s/.com_ibm_tools_attach/%s", tmpPath, filename)
+		path = fmt.Sprintf("%s/%s", attachDir, filename)
 	} else {
-		path = fmt.Sprintf("%s/.com_ibm_tools_attach/%s/%s", tmpPath, subdir, filename)
+		path = fmt.Sprintf("%s/%s/%s", attachDir, subdir, filename)
 	}
 
 	// Ensure parent directory exists
-	dir := fmt.Sprintf("%s/.com_ibm_tools_attach", tmpPath)
+	dir := attachDir
 	if subdir != "" {
 		dir = fmt.Sprintf("%s/%s", dir, subdir)
 	}
@@ -530,7 +1140,7 @@ func (o *openJ9) acquireLock(tmpPath, subdir, filename string) (int, error) {
 		return -1, fmt.Errorf("failed to open %s: %v", path, err)
 	}
 
-	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+	if err := lockFile(fd, timeout); err != nil {
 		syscall.Close(fd)
 		return -1, fmt.Errorf("failed to lock %s: %v", path, err)
 	}
@@ -538,6 +1148,22 @@ func (o *openJ9) acquireLock(tmpPath, subdir, filename string) (int, error) {
 	return fd, nil
 }
 
+// lockFile takes an exclusive flock on fd, polling until timeout so that a
+// hung holder cannot block the attach forever.
+func lockFile(fd int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still held by another process after %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // releaseLock releases a file lock
 func (o *openJ9) releaseLock(fd int) {
 	if fd >= 0 {
@@ -579,8 +1205,8 @@ func (o *openJ9) randomKey() uint64 {
 }
 
 // writeReplyInfo writes the replyInfo file with port and key
-func (o *openJ9) writeReplyInfo(tmpPath string, pid, port int, key uint64) error {
-	path := fmt.Sprintf("%s/.com_ibm_tools_attach/%d/replyInfo", tmpPath, pid)
+func (o *openJ9) writeReplyInfo(attachDir string, pid, port int, key uint64, options *Options) error {
+	path := fmt.Sprintf("%s/%d/replyInfo", attachDir, pid)
 
 	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, 0600)
 	if err != nil {
@@ -589,22 +1215,24 @@ func (o *openJ9) writeReplyInfo(tmpPath string, pid, port int, key uint64) error
 	defer syscall.Close(fd)
 
 	content := fmt.Sprintf("%016x\n%d\n", key, port)
+	options.trace(TraceReplyInfo, []byte(content), "writing %s", path)
 	_, err = syscall.Write(fd, []byte(content))
 	return err
 }
 
 // cleanupReplyInfo removes the replyInfo file
-func (o *openJ9) cleanupReplyInfo(tmpPath string, pid int) {
-	path := fmt.Sprintf("%s/.com_ibm_tools_attach/%d/replyInfo", tmpPath, pid)
+func (o *openJ9) cleanupReplyInfo(attachDir string, pid int) {
+	path := fmt.Sprintf("%s/%d/replyInfo", attachDir, pid)
 	syscall.Unlink(path)
 }
 
-// lockNotificationFiles locks all notification files and returns the locks
-func (o *openJ9) lockNotificationFiles(tmpPath string) ([]int, int) {
+// lockNotificationFiles locks all notification files and returns the locks.
+// The lock timeout applies to all files together; a file that stays locked
+// past it is skipped, and its JVM then not counted when notifying the
+// semaphore. Files still free after the deadline are locked all the same.
+func (o *openJ9) lockNotificationFiles(attachDir string, options *Options) ([]int, int) {
 	var locks []int
-	path := fmt.Sprintf("%s/.com_ibm_tools_attach", tmpPath)
-
-	dir, err := os.Open(path)
+	dir, err := os.Open(attachDir)
 	if err != nil {
 		return locks, 0
 	}
@@ -615,12 +1243,15 @@ func (o *openJ9) lockNotificationFiles(tmpPath string) ([]int, int) {
 		return locks, 0
 	}
 
+	deadline := time.Now().Add(options.lockTimeout())
 	for _, entry := range entries {
 		if len(entry) > 0 && entry[0] >= '1' && entry[0] <= '9' {
-			fd, err := o.acquireLock(tmpPath, entry, "attachNotificationSync")
-			if err == nil {
-				locks = append(locks, fd)
+			fd, err := o.acquireLock(attachDir, entry, "attachNotificationSync", time.Until(deadline))
+			if err != nil {
+				options.trace(TraceLock, nil, "skipping %s: %v", entry, err)
+				continue
 			}
+			locks = append(locks, fd)
 		}
 	}
 
@@ -634,32 +1265,19 @@ func (o *openJ9) unlockNotificationFiles(locks []int) {
 	}
 }
 
-// notifySemaphore notifies the JVM via semaphore
-func (o *openJ9) notifySemaphore(tmpPath string, value, count int) error {
+// notifySemaphore notifies the JVM via semaphore. Posts (value > 0) fail
+// on error; taking back posts no JVM consumed (value < 0) never blocks,
+// and stops at the first post already consumed.
+func (o *openJ9) notifySemaphore(attachDir string, value, count int, options *Options) error {
 	if count == 0 {
 		return nil
 	}
 
-	path := fmt.Sprintf("%s/.com_ibm_tools_attach/_notifier", tmpPath)
-
-	// Use ftok to generate semaphore key
-	// ftok formula: (st.st_ino & 0xFFFF) | ((proj_id & 0xFF) << 16) | ((st.st_dev & 0xFF) << 24)
-	var stat syscall.Stat_t
-	if err := syscall.Stat(path, &stat); err != nil {
+	semid, key, err := o.semaphore(attachDir)
+	if err != nil {
 		return err
 	}
 
-	// Standard ftok implementation
-	// OpenJ9 uses a different byte order: (proj_id << 24) | (dev << 16) | (inode & 0xFFFF)
-	projId := 0xa1
-	key := int((uint64(projId&0xFF) << 24) | ((stat.Dev & 0xFF) << 16) | (stat.Ino & 0xFFFF))
-
-	// Get or create semaphore using syscall directly
-	semid, _, errno := syscall.Syscall(syscall.SYS_SEMGET, uintptr(key), 1, unix.IPC_CREAT|0666)
-	if errno != 0 {
-		return fmt.Errorf("semget failed: %v", errno)
-	}
-
 	// Perform semaphore operation
 	flags := 0
 	if value < 0 {
@@ -670,8 +1288,18 @@ func (o *openJ9) notifySemaphore(tmpPath string, value, count int) error {
 		// sembuf structure: {sem_num, sem_op, sem_flg}
 		ops := [3]int16{0, int16(value), int16(flags)}
 		_, _, errno := syscall.Syscall(syscall.SYS_SEMOP, semid, uintptr(unsafe.Pointer(&ops[0])), 1)
-		if errno != 0 && value >= 0 {
-			// Only return error for increment operations
+		switch {
+		case errno == 0:
+			options.trace(TraceSemop, nil, "semop(key=0x%x, semid=%d, op=%d, flags=%d)", key, semid, value, flags)
+		case value >= 0:
+			options.trace(TraceSemop, nil, "semop(key=0x%x, semid=%d, op=%d, flags=%d) failed: %v", key, semid, value, flags, errno)
+			return fmt.Errorf("semop failed: %v", errno)
+		case errno == syscall.EAGAIN:
+			// The remaining posts were consumed by the JVMs
+			options.trace(TraceSemop, nil, "semop(key=0x%x, semid=%d): %d posts consumed", key, semid, count-i)
+			return nil
+		default:
+			options.trace(TraceSemop, nil, "semop(key=0x%x, semid=%d, op=%d, flags=%d) failed: %v", key, semid, value, flags, errno)
 			return fmt.Errorf("semop failed: %v", errno)
 		}
 	}
@@ -679,16 +1307,121 @@ func (o *openJ9) notifySemaphore(tmpPath string, value, count int) error {
 	return nil
 }
 
-// acceptClient accepts connection from JVM and verifies the key
-func (o *openJ9) acceptClient(listener net.Listener, key uint64) (net.Conn, error) {
-	// Set shorter timeout for initial debugging (5 seconds like jattach)
-	if tcpListener, ok := listener.(*net.TCPListener); ok {
-		tcpListener.SetDeadline(time.Now().Add(5 * time.Second))
+// semaphore returns the ID and key of the notification semaphore of an
+// attach directory, creating it if needed.
+func (o *openJ9) semaphore(attachDir string) (uintptr, int, error) {
+	key, err := o.semaphoreKey(attachDir)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	conn, err := listener.Accept()
+	// Get or create semaphore using syscall directly
+	semid, _, errno := syscall.Syscall(syscall.SYS_SEMGET, uintptr(key), 1, unix.IPC_CREAT|0666)
+	if errno != 0 {
+		return 0, 0, fmt.Errorf("semget failed: %v", errno)
+	}
+	return semid, key, nil
+}
+
+// lookupSemaphore returns the ID of the notification semaphore of an
+// attach directory, and false if it does not exist. Unlike semaphore, it
+// never creates one.
+func (o *openJ9) lookupSemaphore(attachDir string) (uintptr, bool, error) {
+	key, err := o.semaphoreKey(attachDir)
 	if err != nil {
-		return nil, fmt.Errorf("JVM did not respond: %v", err)
+		return 0, false, err
+	}
+
+	semid, _, errno := syscall.Syscall(syscall.SYS_SEMGET, uintptr(key), 1, 0)
+	if errno == syscall.ENOENT {
+		return 0, false, nil
+	}
+	if errno != 0 {
+		return 0, false, fmt.Errorf("semget failed: %v", errno)
+	}
+	return semid, true, nil
+}
+
+// semaphoreKey returns the System V IPC key of the notification semaphore,
+// derived from the _notifier file of the attach directory.
+func (o *openJ9) semaphoreKey(attachDir string) (int, error) {
+	path := fmt.Sprintf("%s/_notifier", attachDir)
+
+	// Use ftok to generate semaphore key
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+
+	// OpenJ9 uses a different byte order than glibc's ftok:
+	// (proj_id << 24) | (dev << 16) | (inode & 0xFFFF)
+	projId := 0xa1
+	return int((uint64(projId&0xFF) << 24) | ((stat.Dev & 0xFF) << 16) | (stat.Ino & 0xFFFF)), nil
+}
+
+// semctl commands, from <linux/sem.h>
+const (
+	semGetVal = 12
+	semSetVal = 16
+)
+
+// repairSemaphore resets the notification semaphore if an aborted attach
+// left posts on it, which would wake JVMs that nobody is attaching to. It
+// must only be called while holding _attachlock, when the count should be
+// zero. With dryRun, the leftover count is only reported. A semaphore that
+// does not exist is not created.
+func (o *openJ9) repairSemaphore(attachDir string, dryRun bool) (*StaleFile, error) {
+	semid, exists, err := o.lookupSemaphore(attachDir)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	count, _, errno := syscall.Syscall6(unix.SYS_SEMCTL, semid, 0, semGetVal, 0, 0, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("semctl GETVAL failed: %v", errno)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	stale := &StaleFile{
+		Path:   attachDir + "/_notifier",
+		Reason: fmt.Sprintf("semaphore count %d left by an aborted attach", count),
+	}
+	if !dryRun {
+		if _, _, errno := syscall.Syscall6(unix.SYS_SEMCTL, semid, 0, semSetVal, 0, 0, 0); errno != 0 {
+			return nil, fmt.Errorf("semctl SETVAL failed: %v", errno)
+		}
+	}
+	return stale, nil
+}
+
+// acceptClient accepts connection from JVM and verifies the key.
+// It waits according to options.OpenJ9Wait, checking between waits that
+// the target is still alive.
+func (o *openJ9) acceptClient(listener *net.TCPListener, pid int, key uint64, options *Options) (net.Conn, error) {
+	start := time.Now()
+
+	var conn net.Conn
+	for delay := range options.openJ9Wait().delays() {
+		listener.SetDeadline(time.Now().Add(delay))
+
+		var err error
+		conn, err = listener.Accept()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		options.trace(TraceAccept, nil, "no connection after %v", time.Since(start).Round(time.Millisecond))
+
+		if !processAlive(o.process, pid) {
+			return nil, fmt.Errorf("process %d exited while waiting for it to connect", pid)
+		}
+	}
+	if conn == nil {
+		return nil, fmt.Errorf("timeout waiting for JVM to connect: waited %v", time.Since(start).Round(time.Millisecond))
 	}
 
 	// Read and verify connection key
@@ -754,8 +1487,11 @@ func (o *openJ9) detach(conn net.Conn) {
 	}
 }
 
-// readResponse reads and processes OpenJ9-specific response format
-func (o *openJ9) readResponse(conn net.Conn, cmd string, printOutput bool) (string, int, error) {
+// readResponse reads and processes OpenJ9-specific response format.
+// connID identifies conn in trace events.
+func (o *openJ9) readResponse(conn net.Conn, connID uint64, cmd string, options *Options) (string, int, error) {
+	printOutput := options.PrintOutput
+
 	// Read response until null terminator
 	buf := make([]byte, 0, 8192)
 	tmp := make([]byte, 1024)
@@ -770,6 +1506,7 @@ func (o *openJ9) readResponse(conn net.Conn, cmd string, printOutput bool) (stri
 		}
 
 		buf = append(buf, tmp[:n]...)
+		options.traceConn(connID, TraceRecv, tmp[:n], "read %d bytes", n)
 
 		// Check for null terminator
 		if buf[len(buf)-1] == 0 {
@@ -808,6 +1545,12 @@ func (o *openJ9) readResponse(conn net.Conn, cmd string, printOutput bool) (stri
 		}
 	}
 
+	// Handle ATTACH_START_MANAGEMENT_AGENT and
+	// ATTACH_START_LOCAL_MANAGEMENT_AGENT responses
+	if strings.HasPrefix(cmd, "ATTACH_START_") && strings.HasPrefix(response, "ATTACH_ERR") {
+		resultCode = -1
+	}
+
 	// Handle ATTACH_DIAGNOSTICS response
 	if strings.HasPrefix(cmd, "ATTACH_DIAGNOSTICS:") && printOutput {
 		// Look for diagnostic result in Java Properties format
@@ -869,33 +1612,95 @@ func (o *openJ9) unescapeString(s string) string {
 	return result.String()
 }
 
-// Detect checks if the process is an OpenJ9 JVM
-// OpenJ9 creates .com_ibm_tools_attach/{pid}/attachInfo file
-// This follows the official jattach implementation
-func (o *openJ9) Detect(nspid int) bool {
-	// Try different potential tmp paths
-	paths := []string{
-		fmt.Sprintf("/proc/%d/root/tmp", nspid),
-		"/tmp",
+// Detect checks if the process is an OpenJ9 JVM.
+// OpenJ9 advertises itself in {attach directory}/{nspid}/attachInfo. The
+// attach directory is .com_ibm_tools_attach in the JVM's java.io.tmpdir
+// unless set with com.ibm.tools.attach.directory; both are read from its
+// command line and options variables, and looked up through its host PID.
+// The file must name nspid as its process ID, since the directory may be
+// shared with JVMs of other containers, and libj9vm must be loaded if the
+// memory maps are readable. The parsed advertisement is kept for
+// OpenJ9Info.
+func (o *openJ9) Detect(pid, nspid int) bool {
+	return o.detect(pid, nspid, os.Getenv("JAMBO_ATTACH_PATH"))
+}
+
+// detectOpenJ9 returns the OpenJ9 JVM advertised in attachPath, which
+// replaces JAMBO_ATTACH_PATH, or nil.
+func detectOpenJ9(pid, nspid int, attachPath string) *openJ9 {
+	o := &openJ9{}
+	if !o.detect(pid, nspid, attachPath) {
+		return nil
 	}
+	return o
+}
 
-	// Check JAMBO_ATTACH_PATH environment variable
-	if envPath := os.Getenv("JAMBO_ATTACH_PATH"); envPath != "" {
-		paths = append([]string{envPath}, paths...)
+// detect implements Detect, looking first in attachPath if set.
+func (o *openJ9) detect(pid, nspid int, attachPath string) bool {
+	if maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid)); err == nil && !mapsHaveOpenJ9(maps) {
+		return false
 	}
 
-	for _, tmpPath := range paths {
-		attachInfoPath := fmt.Sprintf("%s/.com_ibm_tools_attach/%d/attachInfo", tmpPath, nspid)
-		if _, err := os.Stat(attachInfoPath); err == nil {
-			return true
+	o.directory, o.tmpDir = openJ9AttachDirectories(javaOptions(readEnviron(pid), readCmdline(pid)))
+
+	// Try different potential attach directories
+	var dirs []string
+	if attachPath != "" {
+		dirs = append(dirs, attachPath+"/.com_ibm_tools_attach")
+	}
+	if o.directory != "" {
+		dirs = append(dirs, targetFilePath(pid, o.directory))
+	}
+	if o.tmpDir != "" {
+		dirs = append(dirs, targetFilePath(pid, o.tmpDir)+"/.com_ibm_tools_attach")
+	}
+	dirs = append(dirs, fmt.Sprintf("/proc/%d/root/tmp/.com_ibm_tools_attach", pid))
+	if sharesNamespace(pid, "mnt") {
+		dirs = append(dirs, "/tmp/.com_ibm_tools_attach")
+	}
+
+	for _, dir := range dirs {
+		data, err := os.ReadFile(fmt.Sprintf("%s/%d/attachInfo", dir, nspid))
+		if err != nil {
+			continue
 		}
+		info, err := parseAttachInfo(data)
+		if err != nil || info.ProcessID != nspid {
+			continue
+		}
+		o.info = info
+		return true
 	}
 
 	return false
 }
 
+// attachDir returns the directory of the attach files. A path given with
+// Options.AttachPath or JAMBO_ATTACH_PATH takes precedence over the JVM's
+// com.ibm.tools.attach.directory; tmpPath already reflects its
+// java.io.tmpdir.
+func (o *openJ9) attachDir(tmpPath string, nspid int, options *Options) string {
+	if o.directory != "" && options.attachPathOverride() == "" {
+		return targetFilePath(options.procPID(nspid), o.directory)
+	}
+	return tmpPath + "/.com_ibm_tools_attach"
+}
+
+// mapsHaveOpenJ9 reports whether the OpenJ9 VM library is mapped. OpenJ9
+// also ships a libjvm, so jvmLibrary cannot tell the two apart.
+func mapsHaveOpenJ9(maps []byte) bool {
+	for _, line := range strings.Split(string(maps), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 6 && strings.HasPrefix(filepath.Base(fields[5]), "libj9vm") {
+			return true
+		}
+	}
+	return false
+}
+
 type socketConn struct {
 	fd int
+	id uint64 // for TraceEvent.Conn
 }
 
 // connectToSocket connects to a Unix domain socket (shared by HotSpot and OpenJ9)
@@ -911,14 +1716,24 @@ func connectToSocket(path string) (*socketConn, error) {
 		return nil, err
 	}
 
-	return &socketConn{fd: fd}, nil
+	return &socketConn{fd: fd, id: newConnID()}, nil
 }
 
 func (c *socketConn) Close() error {
 	return syscall.Close(c.fd)
 }
 
-func (h *hotSpot) sendCommand(conn *socketConn, args []string) error {
+func (h *hotSpot) sendCommand(conn *socketConn, request []byte, options *Options) error {
+	options.traceConn(conn.id, TraceSend, request, "request of %d bytes", len(request))
+
+	_, err := syscall.Write(conn.fd, request)
+	return err
+}
+
+// encodeCommand builds the NUL-separated protocol version 1 request. It
+// fails with ErrRequestTooLarge rather than truncate a request longer than
+// MaxRequestSize.
+func (h *hotSpot) encodeCommand(args []string) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// Protocol version
@@ -934,7 +1749,7 @@ func (h *hotSpot) sendCommand(conn *socketConn, args []string) error {
 	}
 
 	// Write arguments
-	for i := 0; i < len(args) && buf.Len() < 8192; i++ {
+	for i := 0; i < len(args); i++ {
 		if i >= cmdArgs {
 			// Merge excessive arguments with spaces
 			buf.Bytes()[buf.Len()-1] = ' '
@@ -944,27 +1759,200 @@ func (h *hotSpot) sendCommand(conn *socketConn, args []string) error {
 	}
 
 	// Pad to 4 arguments if needed
-	for i := cmdArgs; i < 4 && buf.Len() < 8192; i++ {
+	for i := cmdArgs; i < 4; i++ {
 		buf.WriteByte(0)
 	}
 
-	data := buf.Bytes()
-	_, err := syscall.Write(conn.fd, data)
-	return err
+	if buf.Len() > MaxRequestSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrRequestTooLarge, buf.Len(), MaxRequestSize)
+	}
+	return buf.Bytes(), nil
 }
 
-func (h *hotSpot) readResponse(conn *socketConn, args []string) (string, error) {
-	buf := make([]byte, 8192)
-	bytesRead, err := syscall.Read(conn.fd, buf)
-	if bytesRead == 0 {
-		return "", errors.New("unexpected EOF reading response")
+// encodeCommandV2 builds a protocol version 2 request: the version, the
+// size in bytes of the rest of the request, then the command and each
+// argument, NUL-terminated. Unlike version 1, arguments are passed as
+// given; jcmd arguments are still joined into one command line. At least
+// three arguments are sent, empty if need be, as version 1 commands expect.
+func encodeCommandV2(args []string) ([]byte, error) {
+	fields := args
+	if len(args) >= 2 && args[0] == "jcmd" {
+		fields = []string{"jcmd", strings.Join(args[1:], " ")}
 	}
+	for len(fields) < 1+protocolV1ArgCount {
+		fields = append(fields, "")
+	}
+
+	var body bytes.Buffer
+	for _, field := range fields {
+		body.WriteString(field)
+		body.WriteByte(0)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("2")
+	buf.WriteByte(0)
+	buf.WriteString(strconv.Itoa(body.Len()))
+	buf.WriteByte(0)
+	buf.Write(body.Bytes())
+
+	if buf.Len() > MaxRequestSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrRequestTooLarge, buf.Len(), MaxRequestSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// fitsProtocolV1 reports whether a version 1 request carries args as
+// given: jcmd arguments form one command line, other commands take at most
+// three arguments, and the JVM limits the length of each.
+func fitsProtocolV1(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	if len(args[0]) > protocolV1NameMax {
+		return false
+	}
+	rest := args[1:]
+	if args[0] == "jcmd" && len(rest) > 0 {
+		rest = []string{strings.Join(rest, " ")}
+	}
+	if len(rest) > protocolV1ArgCount {
+		return false
+	}
+	for _, arg := range rest {
+		if len(arg) > protocolV1ArgMax {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeForProtocol returns the request for args in the given protocol
+// version, v1 being its version 1 encoding. A JVM that only speaks version
+// 1 rejects a field longer than it accepts, so such a request fails here
+// with ErrRequestTooLarge; extra arguments are merged with spaces as
+// before.
+func encodeForProtocol(version int, args []string, v1 []byte) ([]byte, error) {
+	if version >= 2 {
+		return encodeCommandV2(args)
+	}
+	for i, field := range bytes.Split(bytes.TrimSuffix(v1, []byte{0}), []byte{0})[1:] {
+		limit := protocolV1ArgMax
+		if i == 0 {
+			limit = protocolV1NameMax
+		}
+		if len(field) > limit {
+			return nil, fmt.Errorf("%w: field of %d bytes, the JVM's attach protocol version 1 accepts %d", ErrRequestTooLarge, len(field), limit)
+		}
+	}
+	return v1, nil
+}
+
+// protocolVersion returns the attach protocol version of the JVM, asked
+// once per process with the getversion command. JVMs before JDK 24 do not
+// know the command and answer with an error, which means version 1. The
+// answer is not remembered if the JVM could not be reached.
+func (h *hotSpot) protocolVersion(pid, nspid int, tmpPath, socketPath string, options *Options) int {
+	if version := h.protocol.Load(); version != 0 {
+		return int(version)
+	}
+
+	conn, err := h.connect(pid, nspid, tmpPath, socketPath, options)
 	if err != nil {
-		return "", err
+		return 1
 	}
+	defer conn.Close()
+
+	args := []string{"getversion"}
+	request, _ := h.encodeCommand(args)
+	if err := h.sendCommand(conn, request, options); err != nil {
+		return 1
+	}
+	output, err := h.readResponse(conn, args, options, nil)
+	if err != nil {
+		// An unknown command is answered with a message
+		if output != "" {
+			h.protocol.Store(1)
+		}
+		return 1
+	}
+
+	version := parseProtocolVersion(output)
+	h.protocol.Store(int32(version))
+	return version
+}
+
+// parseProtocolVersion reads the answer to getversion, e.g. "2" or
+// "2 streaming". Anything else is version 1.
+func parseProtocolVersion(output string) int {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 1
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+// readResponse reads the result code and output of a command until the JVM
+// closes the connection. If out is set and the command succeeded, the
+// output is written to out as it arrives and not returned.
+func (h *hotSpot) readResponse(conn *socketConn, args []string, options *Options, out io.Writer) (string, error) {
+	// The output of load holds the agent's result code, so it is always
+	// read in full
+	if len(args) > 0 && args[0] == "load" {
+		out = nil
+	}
+
+	// The JVM writes the result code and the output separately, then
+	// closes the connection; read everything up to that
+	var buf []byte
+	streaming := false
+	chunk := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(conn.fd, chunk)
+		if n > 0 {
+			options.traceConn(conn.id, TraceRecv, chunk[:n], "read %d bytes", n)
+			if streaming {
+				if _, err := out.Write(chunk[:n]); err != nil {
+					return "", fmt.Errorf("write output: %w", err)
+				}
+			} else {
+				buf = append(buf, chunk[:n]...)
+			}
+			// Stream once the result code line shows success
+			if out != nil && !streaming {
+				if code, rest, ok := bytes.Cut(buf, []byte("\n")); ok {
+					if string(code) != "0" {
+						out = nil
+					} else {
+						streaming = true
+						if _, err := out.Write(rest); err != nil {
+							return "", fmt.Errorf("write output: %w", err)
+						}
+						buf = buf[:len(code)+1]
+					}
+				}
+			}
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if n <= 0 || err != nil {
+			if len(buf) == 0 {
+				if err != nil {
+					return "", err
+				}
+				return "", errors.New("unexpected EOF reading response")
+			}
+			break
+		}
+	}
+	bytesRead := len(buf)
 
 	// First line is result code
-	buf = buf[:bytesRead]
 	lines := strings.SplitN(string(buf), "\n", 2)
 	if len(lines) < 1 {
 		return "", errors.New("invalid response format")
@@ -980,18 +1968,6 @@ func (h *hotSpot) readResponse(conn *socketConn, args []string) (string, error)
 
 	// Special treatment of 'load' command
 	if len(args) > 0 && args[0] == "load" {
-		// Read the entire output of the 'load' command
-		total := bytesRead
-		for total < len(buf)-1 {
-			n, err := syscall.Read(conn.fd, buf[total:])
-			if err != nil || n <= 0 {
-				break
-			}
-			total += n
-		}
-		bytesRead = total
-		buf = buf[:bytesRead]
-
 		// Parse the return code of Agent_OnAttach
 		if resultCode == 0 && bytesRead >= 2 {
 			output := string(buf)
@@ -0,0 +1,1108 @@
+//go:build linux
+
+package jambo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingTracer collects trace events in memory.
+type recordingTracer struct {
+	events []TraceEvent
+}
+
+func (r *recordingTracer) Trace(event TraceEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestHotSpotEncodeCommand(t *testing.T) {
+	h := &hotSpot{}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"no args", []string{"threaddump"}, "1\x00threaddump\x00\x00\x00\x00"},
+		{"jcmd merges args", []string{"jcmd", "Thread.print", "-l"}, "1\x00jcmd\x00Thread.print -l\x00\x00\x00"},
+		{"load", []string{"load", "instrument", "false", "agent.jar"}, "1\x00load\x00instrument\x00false\x00agent.jar\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := h.encodeCommand(tt.args)
+			if err != nil {
+				t.Fatalf("encodeCommand(%v) error: %v", tt.args, err)
+			}
+			if string(result) != tt.expected {
+				t.Errorf("encodeCommand(%v) = %q, want %q", tt.args, result, tt.expected)
+			}
+		})
+	}
+
+	long := []string{"jcmd", "GC.heap_dump " + strings.Repeat("x", MaxRequestSize)}
+	if _, err := h.encodeCommand(long); !errors.Is(err, ErrRequestTooLarge) {
+		t.Errorf("encodeCommand(long) error = %v, want ErrRequestTooLarge", err)
+	}
+}
+
+func TestHotSpotEncodeCommandV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"no args", []string{"threaddump"}, "2\x0014\x00threaddump\x00\x00\x00\x00"},
+		{"jcmd merges args", []string{"jcmd", "Thread.print", "-l"}, "2\x0023\x00jcmd\x00Thread.print -l\x00\x00\x00"},
+		{"more than three args", []string{"load", "a", "b", "c", "d"}, "2\x0013\x00load\x00a\x00b\x00c\x00d\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := encodeCommandV2(tt.args)
+			if err != nil {
+				t.Fatalf("encodeCommandV2(%v) error: %v", tt.args, err)
+			}
+			if string(result) != tt.expected {
+				t.Errorf("encodeCommandV2(%v) = %q, want %q", tt.args, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFitsProtocolV1(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected bool
+	}{
+		{[]string{"threaddump"}, true},
+		{[]string{"jcmd", "Thread.print", "-l"}, true},
+		{[]string{"jcmd", "VM.set_flag " + strings.Repeat("x", protocolV1ArgMax)}, false},
+		{[]string{"load", "a", "b", "c", "d"}, false},
+		{[]string{"a_very_long_command_name"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := fitsProtocolV1(tt.args); got != tt.expected {
+			t.Errorf("fitsProtocolV1(%.40q) = %v, want %v", tt.args, got, tt.expected)
+		}
+	}
+}
+
+// serveAttach answers each connection to a fake HotSpot attach socket with
+// respond(request) and returns the requests received once done is closed.
+func serveAttach(t *testing.T, socketPath string, respond func(request string) string) (requests func() []string) {
+	t.Helper()
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+
+	result := make(chan []string, 1)
+	go func() {
+		var received []string
+		defer func() { result <- received }()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, MaxRequestSize)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _ := conn.Read(buf)
+			received = append(received, string(buf[:n]))
+			conn.Write([]byte(respond(string(buf[:n]))))
+			conn.Close()
+		}
+	}()
+
+	return func() []string {
+		listener.Close()
+		return <-result
+	}
+}
+
+func TestHotSpotProtocolNegotiation(t *testing.T) {
+	line := "VM.set_flag " + strings.Repeat("x", 2000)
+	args := []string{"jcmd", line}
+
+	tests := []struct {
+		name     string
+		answer   string // response to getversion
+		requests []string
+		err      error
+	}{
+		{
+			name:     "version 2",
+			answer:   "0\n2 streaming\n",
+			requests: []string{"1\x00getversion\x00\x00\x00\x00", "2\x002020\x00jcmd\x00" + line + "\x00\x00\x00"},
+		},
+		{
+			name:     "version 1",
+			answer:   "-1\nOperation getversion not recognized!\n",
+			requests: []string{"1\x00getversion\x00\x00\x00\x00"},
+			err:      ErrRequestTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpPath := t.TempDir()
+			requests := serveAttach(t, fmt.Sprintf("%s/.java_pid%d", tmpPath, os.Getpid()), func(request string) string {
+				if strings.Contains(request, "getversion") {
+					return tt.answer
+				}
+				return "0\nok\n"
+			})
+
+			h := &hotSpot{}
+			output, err := h.Attach(os.Getpid(), os.Getpid(), args, &Options{}, tmpPath)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Attach() error = %v, want %v", err, tt.err)
+				}
+			} else if err != nil || output != "ok\n" {
+				t.Errorf("Attach() = %q, %v", output, err)
+			}
+
+			// The version is asked once per process
+			h.Attach(os.Getpid(), os.Getpid(), []string{"threaddump"}, &Options{}, tmpPath)
+			received := requests()
+			if len(received) < len(tt.requests) {
+				t.Fatalf("received %d requests, want at least %d", len(received), len(tt.requests))
+			}
+			for i, want := range tt.requests {
+				if received[i] != want {
+					t.Errorf("request %d = %.60q, want %.60q", i, received[i], want)
+				}
+			}
+			if last := received[len(received)-1]; last != "1\x00threaddump\x00\x00\x00\x00" {
+				t.Errorf("short request = %q, want version 1", last)
+			}
+			if len(received) != len(tt.requests)+1 {
+				t.Errorf("received %d requests, want %d", len(received), len(tt.requests)+1)
+			}
+		})
+	}
+}
+
+func TestAttachErrorChain(t *testing.T) {
+	proc := &Process{pid: os.Getpid(), nsPid: os.Getpid(), uid: os.Geteuid(), gid: os.Getegid(), nsUid: os.Geteuid(), nsGid: os.Getegid(), jvm: &hotSpot{}}
+	_, err := proc.Attach("jcmd", []string{"VM.version " + strings.Repeat("x", MaxRequestSize)}, &Options{})
+	if !errors.Is(err, ErrCommandFailed) || !errors.Is(err, ErrRequestTooLarge) {
+		t.Errorf("Attach() error = %v, want ErrCommandFailed wrapping ErrRequestTooLarge", err)
+	}
+}
+
+// chunkWriter records each write.
+type chunkWriter struct {
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestAttachOutputStreaming(t *testing.T) {
+	dump := strings.Repeat("\"main\" #1 prio=5 tid=0x1 nid=0x2 runnable\n", 1000)
+	tmpPath := t.TempDir()
+	requests := serveAttach(t, fmt.Sprintf("%s/.java_pid%d", tmpPath, os.Getpid()), func(request string) string {
+		if strings.Contains(request, "threaddump") {
+			return "0\n" + dump
+		}
+		return "-1\nOperation not recognized!\n"
+	})
+	defer requests()
+
+	proc := &Process{pid: os.Getpid(), nsPid: os.Getpid(), uid: os.Geteuid(), gid: os.Getegid(), nsUid: os.Geteuid(), nsGid: os.Getegid(), jvm: &hotSpot{}}
+	out := &chunkWriter{}
+	output, err := proc.Attach("threaddump", nil, &Options{Output: out, AttachPath: tmpPath})
+	if err != nil || output != "" {
+		t.Fatalf("Attach() = %.40q, %v, want the output streamed", output, err)
+	}
+	if got := strings.Join(out.chunks, ""); got != dump {
+		t.Errorf("streamed %d bytes, want %d", len(got), len(dump))
+	}
+	if len(out.chunks) < 2 {
+		t.Errorf("output written in %d chunks, want it written as it is read", len(out.chunks))
+	}
+
+	// A failed command's output is returned with the error
+	out = &chunkWriter{}
+	_, err = proc.Attach("jcmd", []string{"VM.unknown"}, &Options{Output: out, AttachPath: tmpPath})
+	if !errors.Is(err, ErrCommandFailed) || len(out.chunks) != 0 {
+		t.Errorf("Attach() error = %v, streamed %q, want ErrCommandFailed and nothing streamed", err, out.chunks)
+	}
+}
+
+func TestAttachManyHoldsSlotAfterTimeout(t *testing.T) {
+	tmpPath := t.TempDir()
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	var pids []int
+	for range 2 {
+		cmd := exec.Command("sleep", "60")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		pids = append(pids, cmd.Process.Pid)
+
+		// A JVM that answers well after the timeout
+		listener, err := net.Listen("unix", fmt.Sprintf("%s/.java_pid%d", tmpPath, cmd.Process.Pid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				active++
+				maxActive = max(maxActive, active)
+				mu.Unlock()
+				time.Sleep(300 * time.Millisecond)
+				conn.Write([]byte("0\nok\n"))
+				conn.Close()
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}
+		}()
+	}
+
+	results := AttachMany(context.Background(), pids, "threaddump", nil, &ManyOptions{
+		Options:     Options{Timeout: 50, AttachPath: tmpPath},
+		Parallelism: 1,
+	})
+	for pid, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("%d: error = %v, want a timeout", pid, r.Err)
+		}
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive != 1 {
+		t.Errorf("%d attaches ran at once, want 1", maxActive)
+	}
+}
+
+func TestHotSpotDryRun(t *testing.T) {
+	tracer := &recordingTracer{}
+	tmpPath := t.TempDir()
+
+	// The test binary is not a JVM, so a listening socket is needed to get
+	// past the pre-flight check.
+	listener, err := net.Listen("unix", fmt.Sprintf("%s/.java_pid%d", tmpPath, os.Getpid()))
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer listener.Close()
+
+	output, err := (&hotSpot{}).Attach(os.Getpid(), os.Getpid(), []string{"threaddump"}, &Options{
+		Tracer: tracer,
+		DryRun: true,
+	}, tmpPath)
+	if err != nil {
+		t.Fatalf("Attach() error: %v", err)
+	}
+
+	if !strings.Contains(output, `"1\x00threaddump\x00\x00\x00\x00"`) {
+		t.Errorf("dry-run output does not show the request: %q", output)
+	}
+	for _, event := range tracer.events {
+		if event.Step != TraceDryRun {
+			t.Errorf("dry run performed step %q: %s", event.Step, event.Message)
+		}
+	}
+	if entries, _ := os.ReadDir(tmpPath); len(entries) != 1 {
+		t.Errorf("dry run created files: %v", entries)
+	}
+}
+
+func TestCheckAttachable(t *testing.T) {
+	// The test binary handles SIGQUIT but is not a JVM
+	if err := checkAttachable(os.Getpid()); !errors.Is(err, ErrNotJVM) {
+		t.Errorf("checkAttachable(self) = %v, want ErrNotJVM", err)
+	}
+
+	tracer := &recordingTracer{}
+	_, err := (&hotSpot{}).Attach(os.Getpid(), os.Getpid(), []string{"threaddump"}, &Options{Tracer: tracer}, t.TempDir())
+	if !errors.Is(err, ErrNotJVM) {
+		t.Errorf("Attach() = %v, want ErrNotJVM", err)
+	}
+	for _, event := range tracer.events {
+		if event.Step == TraceSignal {
+			t.Errorf("Attach() signalled a non-JVM process: %s", event.Message)
+		}
+	}
+}
+
+func TestMapsHaveJVM(t *testing.T) {
+	tests := []struct {
+		name     string
+		maps     string
+		expected bool
+	}{
+		{"hotspot", "7f3c2d000000-7f3c2e1a2000 r-xp 00000000 fd:01 1311 /usr/lib/jvm/java-21-openjdk/lib/server/libjvm.so\n", true},
+		{"openj9", "7f1a40000000-7f1a40100000 r-xp 00000000 fd:01 2201 /opt/java/openjdk/lib/default/libj9vm29.so\n", true},
+		{"deleted", "7f3c2d000000-7f3c2e1a2000 r-xp 00000000 fd:01 1311 /usr/lib/jvm/lib/server/libjvm.so (deleted)\n", true},
+		{"not java", "55d0c0a00000-55d0c0a21000 r-xp 00000000 fd:01 77 /usr/sbin/nginx\n7ffd1c9d0000-7ffd1c9f1000 rw-p 00000000 00:00 0 [stack]\n", false},
+		{"similar name", "7f0000000000-7f0000001000 r-xp 00000000 fd:01 5 /opt/app/libjvmti_helper.so\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := mapsHaveJVM([]byte(tt.maps)); result != tt.expected {
+				t.Errorf("mapsHaveJVM() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMapsHaveOpenJ9(t *testing.T) {
+	openJ9Maps := []byte("7f0000000000-7f0000001000 r-xp 00000000 08:01 1 /opt/java/openjdk/lib/server/libjvm.so\n" +
+		"7f0000002000-7f0000003000 r-xp 00000000 08:01 2 /opt/java/openjdk/lib/default/libj9vm29.so\n")
+	hotSpotMaps := []byte("7f0000000000-7f0000001000 r-xp 00000000 08:01 1 /usr/lib/jvm/java-21/lib/server/libjvm.so\n")
+
+	if !mapsHaveOpenJ9(openJ9Maps) {
+		t.Error("mapsHaveOpenJ9() = false for libj9vm29")
+	}
+	if mapsHaveOpenJ9(hotSpotMaps) {
+		t.Error("mapsHaveOpenJ9() = true for HotSpot's libjvm")
+	}
+}
+
+func TestSignalCaught(t *testing.T) {
+	tests := []struct {
+		name     string
+		sigCgt   string
+		expected bool
+	}{
+		{"hotspot", "0000000181005ccf", true},
+		{"Xrs", "0000000181005ccb", false},
+		{"none", "0000000000000000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := "Name:\tjava\nSigIgn:\t0000000000000000\nSigCgt:\t" + tt.sigCgt + "\nCapInh:\t0000000000000000\n"
+			result, err := signalCaught([]byte(status), syscall.SIGQUIT)
+			if err != nil {
+				t.Fatalf("signalCaught() error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("signalCaught(%s) = %v, want %v", tt.sigCgt, result, tt.expected)
+			}
+		})
+	}
+
+	if _, err := signalCaught([]byte("Name:\tjava\n"), syscall.SIGQUIT); err == nil {
+		t.Error("signalCaught() without SigCgt succeeded")
+	}
+}
+
+// TestReplaySessions replays the sessions in testdata. They were assembled
+// by hand from the wire format of each JVM rather than recorded; replace
+// them with jambo --record captures from real JVMs when available.
+func TestReplaySessions(t *testing.T) {
+	tests := []struct {
+		file    string
+		jvm     JVM
+		wantErr string
+	}{
+		{"testdata/hotspot-threaddump.json", &hotSpot{}, ""},
+		{"testdata/hotspot-load-jdk21.json", &hotSpot{}, "command failed with code -1"},
+		{"testdata/hotspot-jcmd-v2.json", &hotSpot{}, ""},
+		{"testdata/openj9-properties.json", &openJ9{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			session, err := LoadSession(tt.file)
+			if err != nil {
+				t.Fatalf("LoadSession() error: %v", err)
+			}
+
+			tmpPath := t.TempDir()
+			replay, err := session.Replay(tmpPath, session.NsPid)
+			if err != nil {
+				t.Fatalf("Replay() error: %v", err)
+			}
+
+			args := append([]string{session.Command}, session.Args...)
+			output, err := tt.jvm.Attach(os.Getpid(), session.NsPid, args, &Options{}, tmpPath)
+			if replayErr := replay.Close(); replayErr != nil {
+				t.Fatalf("replay mismatch: %v", replayErr)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Attach() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Attach() error: %v", err)
+			}
+			if output != session.Output {
+				t.Errorf("Attach() output = %q, want %q", output, session.Output)
+			}
+		})
+	}
+}
+
+func TestReplayRecordsConnections(t *testing.T) {
+	session, err := LoadSession("testdata/hotspot-jcmd-v2.json")
+	if err != nil {
+		t.Fatalf("LoadSession() error: %v", err)
+	}
+
+	tmpPath := t.TempDir()
+	replay, err := session.Replay(tmpPath, session.NsPid)
+	if err != nil {
+		t.Fatalf("Replay() error: %v", err)
+	}
+
+	rec := NewRecorder()
+	args := append([]string{session.Command}, session.Args...)
+	proc := &Process{pid: os.Getpid(), nsPid: session.NsPid, jvm: &hotSpot{}}
+	output, err := proc.jvm.Attach(proc.pid, session.NsPid, args, &Options{Tracer: rec}, tmpPath)
+	if replayErr := replay.Close(); replayErr != nil {
+		t.Fatalf("replay mismatch: %v", replayErr)
+	}
+	if err != nil {
+		t.Fatalf("Attach() error: %v", err)
+	}
+
+	// The getversion probe and the request are recorded as two connections
+	recorded := rec.Session(proc, session.Command, session.Args, output, err).connections()
+	want := session.connections()
+	if len(recorded) != len(want) {
+		t.Fatalf("recorded %d connections, want %d", len(recorded), len(want))
+	}
+	for i := range want {
+		if got := sent(recorded[i]); !bytes.Equal(got, sent(want[i])) {
+			t.Errorf("connection %d sent %q, want %q", i+1, got, sent(want[i]))
+		}
+		if conn := recorded[i][0].Conn; conn != i+1 {
+			t.Errorf("connection %d numbered %d", i+1, conn)
+		}
+	}
+}
+
+func TestReplayRequestMismatch(t *testing.T) {
+	session, err := LoadSession("testdata/hotspot-threaddump.json")
+	if err != nil {
+		t.Fatalf("LoadSession() error: %v", err)
+	}
+
+	tmpPath := t.TempDir()
+	replay, err := session.Replay(tmpPath, session.NsPid)
+	if err != nil {
+		t.Fatalf("Replay() error: %v", err)
+	}
+
+	(&hotSpot{}).Attach(os.Getpid(), session.NsPid, []string{"properties"}, &Options{}, tmpPath)
+	if err := replay.Close(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Close() = %v, want request mismatch", err)
+	}
+}
+
+func TestParseStartTime(t *testing.T) {
+	stat := "4711 (java (main) x) S 1 4711 4711 0 -1 4194560 30021 0 12 0 1502 311 0 0 20 0 41 0 98765432 10584387584 76543 18446744073709551615\n"
+	startTime, err := parseStartTime([]byte(stat))
+	if err != nil {
+		t.Fatalf("parseStartTime() error: %v", err)
+	}
+	if startTime != 98765432 {
+		t.Errorf("parseStartTime() = %d, want 98765432", startTime)
+	}
+
+	if _, err := parseStartTime([]byte("4711 (java) S 1")); err == nil {
+		t.Error("parseStartTime() of a truncated line succeeded")
+	}
+}
+
+func TestProcessHandleExited(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+
+	handle, err := openProcessHandle(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("openProcessHandle() error: %v", err)
+	}
+	defer handle.close()
+
+	if err := handle.verify(); err != nil {
+		t.Fatalf("verify() of a running process: %v", err)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if err := handle.verify(); !errors.Is(err, ErrProcessNotFound) {
+		t.Errorf("verify() after exit = %v, want ErrProcessNotFound", err)
+	}
+	if handle.alive() {
+		t.Error("alive() after exit = true")
+	}
+}
+
+func TestCreateAttachFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, ".attach_pid1")
+	if err := createAttachFile(path); err != nil {
+		t.Fatalf("createAttachFile() error: %v", err)
+	}
+	// A file left by an earlier attempt of the same user is reused
+	if err := createAttachFile(path); err != nil {
+		t.Errorf("createAttachFile() of own existing file: %v", err)
+	}
+
+	target := filepath.Join(dir, "victim")
+	link := filepath.Join(dir, ".attach_pid2")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Symlink() error: %v", err)
+	}
+	if err := createAttachFile(link); !errors.Is(err, ErrInsecure) {
+		t.Errorf("createAttachFile(symlink) = %v, want ErrInsecure", err)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("createAttachFile(symlink) created the link target")
+	}
+}
+
+func TestVerifySocket(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, ".java_pid1")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer listener.Close()
+
+	if err := verifySocket(path); err != nil {
+		t.Errorf("verifySocket() of own socket: %v", err)
+	}
+
+	link := filepath.Join(dir, ".java_pid2")
+	os.Symlink(path, link)
+	if err := verifySocket(link); !errors.Is(err, ErrInsecure) {
+		t.Errorf("verifySocket(symlink) = %v, want ErrInsecure", err)
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, 4242, 4242); err != nil {
+			t.Fatalf("Lchown() error: %v", err)
+		}
+		if err := verifySocket(path); !errors.Is(err, ErrInsecure) {
+			t.Errorf("verifySocket() of foreign socket = %v, want ErrInsecure", err)
+		}
+	}
+}
+
+func TestHotSpotStaleSocket(t *testing.T) {
+	tmpPath := t.TempDir()
+	socketPath := fmt.Sprintf("%s/.java_pid%d", tmpPath, os.Getpid())
+
+	// Leave the socket file behind without a listener
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix() error: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	// The stale socket is removed; restarting the listener then stops at
+	// the pre-flight check, since the test binary is not a JVM.
+	_, err = (&hotSpot{}).Attach(os.Getpid(), os.Getpid(), []string{"threaddump"}, &Options{}, tmpPath)
+	if !errors.Is(err, ErrNotJVM) {
+		t.Errorf("Attach() = %v, want ErrNotJVM", err)
+	}
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("stale socket was not removed: %v", err)
+	}
+}
+
+func TestHotSpotConnectRetry(t *testing.T) {
+	tracer := &recordingTracer{}
+	options := &Options{
+		Tracer: tracer,
+		Retry:  &RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond},
+	}
+
+	socketPath := filepath.Join(t.TempDir(), ".java_pid1")
+	_, err := (&hotSpot{}).connect(os.Getpid(), 1, filepath.Dir(socketPath), socketPath, options)
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("connect() = %v, want ENOENT", err)
+	}
+
+	attempts := 0
+	for _, event := range tracer.events {
+		if event.Step == TraceConnect {
+			attempts++
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("connect() made %d attempts, want 3", attempts)
+	}
+}
+
+func TestOpenJ9AcceptTimeout(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP() error: %v", err)
+	}
+	defer listener.Close()
+
+	options := &Options{OpenJ9Wait: &WaitPolicy{InitialDelay: 10 * time.Millisecond, MaxWait: 50 * time.Millisecond}}
+	_, err = (&openJ9{}).acceptClient(listener, os.Getpid(), 1, options)
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for JVM to connect: waited ") {
+		t.Errorf("acceptClient() = %v, want timeout after about 50ms", err)
+	}
+}
+
+func TestOpenJ9AcceptExited(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP() error: %v", err)
+	}
+	defer listener.Close()
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+	handle, err := openProcessHandle(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("openProcessHandle() error: %v", err)
+	}
+	defer handle.close()
+	if handle.pidfd < 0 {
+		t.Skip("pidfd_open is not available")
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	// The handle decides, not whichever process now has the PID
+	options := &Options{OpenJ9Wait: &WaitPolicy{InitialDelay: 10 * time.Millisecond, MaxWait: time.Second}}
+	_, err = (&openJ9{process: handle}).acceptClient(listener, os.Getpid(), 1, options)
+	if err == nil || !strings.Contains(err.Error(), "exited while waiting") {
+		t.Errorf("acceptClient() = %v, want the exit to be noticed", err)
+	}
+}
+
+func TestDiagnoseNotJVM(t *testing.T) {
+	checks := Diagnose(os.Getpid(), nil)
+	if len(checks) != 2 || checks[0].Status != CheckPass || checks[1].Name != "jvm" || checks[1].Status != CheckFail {
+		t.Errorf("Diagnose(self) = %+v, want a passing process check and a failing jvm check", checks)
+	}
+	if Healthy(checks) {
+		t.Error("Healthy() = true with a failed check")
+	}
+
+	if checks := Diagnose(1<<30, nil); len(checks) != 1 || checks[0].Status != CheckFail {
+		t.Errorf("Diagnose(missing) = %+v, want a single failing process check", checks)
+	}
+}
+
+func TestProbeOptions(t *testing.T) {
+	proc, err := NewProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("NewProcess() error: %v", err)
+	}
+	defer proc.Close()
+
+	probe := func(options *Options) map[string]Check {
+		probed := make(chan []Check)
+		go func() {
+			runtime.LockOSThread()
+			probed <- proc.probe(proc.jvm, options)
+		}()
+		checks := make(map[string]Check)
+		for _, check := range <-probed {
+			checks[check.Name] = check
+		}
+		return checks
+	}
+
+	dir := t.TempDir()
+	checks := probe(&Options{AttachPath: dir, NoSetns: true})
+	for _, name := range []string{"namespace-net", "namespace-ipc", "namespace-mnt"} {
+		if checks[name].Status != CheckPass {
+			t.Errorf("%s = %+v, want pass", name, checks[name])
+		}
+	}
+	if check := checks["attach-dir"]; check.Status != CheckPass || !strings.Contains(check.Detail, dir) {
+		t.Errorf("attach-dir = %+v, want %s to pass", check, dir)
+	}
+
+	checks = probe(&Options{AttachPath: filepath.Join(dir, "missing")})
+	if check := checks["attach-dir"]; check.Status != CheckFail || !strings.Contains(check.Detail, "attach path") {
+		t.Errorf("attach-dir = %+v, want a failure for the missing attach path", check)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[uint64]string{
+		512:             "512 B",
+		2048:            "2.0 KiB",
+		5 << 30:         "5.0 GiB",
+		3<<20 + 512<<10: "3.5 MiB",
+	}
+	for n, expected := range tests {
+		if result := formatBytes(n); result != expected {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, result, expected)
+		}
+	}
+}
+
+func TestDetectInAttachPath(t *testing.T) {
+	// No such process: only the attach directory can tell it is OpenJ9
+	pid := 1 << 30
+	attachPath := t.TempDir()
+	dir := filepath.Join(attachPath, ".com_ibm_tools_attach", strconv.Itoa(pid))
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "attachInfo"), []byte(fmt.Sprintf("vmId=%d\nprocessId=%d\n", pid, pid)), 0644)
+
+	p := &Process{pid: pid, nsPid: pid, jvm: &hotSpot{}}
+	if jvm := p.detectInAttachPath(&Options{}); jvm.Type() != HotSpot {
+		t.Errorf("detected %v without AttachPath", jvm.Type())
+	}
+
+	if jvm := p.detectInAttachPath(&Options{AttachPath: attachPath}); jvm.Type() != OpenJ9 {
+		t.Errorf("detected %v with AttachPath, want OpenJ9", jvm.Type())
+	}
+
+	// The detection only applies to the call it was made for
+	if p.jvm.Type() != HotSpot {
+		t.Errorf("Process changed to %v", p.jvm.Type())
+	}
+	if jvm := p.detectInAttachPath(nil); jvm.Type() != HotSpot {
+		t.Errorf("detected %v for a later call without AttachPath", jvm.Type())
+	}
+}
+
+func TestJavacoreDryRun(t *testing.T) {
+	pid := os.Getpid()
+	attachPath := t.TempDir()
+	dir := filepath.Join(attachPath, ".com_ibm_tools_attach", strconv.Itoa(pid))
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "attachInfo"), []byte(fmt.Sprintf("vmId=%d\nprocessId=%d\n", pid, pid)), 0644)
+
+	tracer := &recordingTracer{}
+	proc := &Process{pid: pid, nsPid: pid, uid: os.Geteuid(), gid: os.Getegid(), nsUid: os.Geteuid(), nsGid: os.Getegid(), jvm: &openJ9{}}
+	jc, err := proc.Javacore(&Options{DryRun: true, AttachPath: attachPath, Tracer: tracer})
+	if jc != nil || err == nil || !strings.Contains(err.Error(), "dry run") {
+		t.Errorf("Javacore() = %v, %v, want a dry-run error", jc, err)
+	}
+	if len(tracer.events) == 0 {
+		t.Error("dry run traced nothing")
+	}
+}
+
+func TestEnterNamespacesStrict(t *testing.T) {
+	// A process that does not exist has no namespace files to enter
+	p := &Process{pid: 1 << 30}
+
+	tracer := &recordingTracer{}
+	inMount, err := p.enterNamespaces(nil, &Options{Tracer: tracer})
+	if err != nil || inMount {
+		t.Errorf("enterNamespaces() = %v, %v, want false, nil without StrictNamespaces", inMount, err)
+	}
+	if len(tracer.events) != 3 || tracer.events[0].Step != TraceNamespace || !strings.Contains(tracer.events[0].Message, "continuing") {
+		t.Errorf("enterNamespaces() traced %+v, want one failure per namespace", tracer.events)
+	}
+
+	_, err = p.enterNamespaces(nil, &Options{StrictNamespaces: true})
+	if !errors.Is(err, ErrNamespace) || !strings.Contains(err.Error(), "net namespace") {
+		t.Errorf("enterNamespaces() = %v, want ErrNamespace for the net namespace", err)
+	}
+}
+
+func TestEnterMountNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a mount namespace needs CAP_SYS_ADMIN")
+	}
+
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start a process in a new mount namespace: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	type result struct {
+		inMount  bool
+		err      error
+		ns, want string
+	}
+	done := make(chan result)
+	go func() {
+		// Never unlocked: the thread ends up in the child's namespace
+		runtime.LockOSThread()
+		p := &Process{pid: cmd.Process.Pid}
+		inMount, err := p.enterNamespaces(nil, &Options{StrictNamespaces: true})
+		ns, _ := os.Readlink("/proc/thread-self/ns/mnt")
+		want, _ := os.Readlink(fmt.Sprintf("/proc/%d/ns/mnt", cmd.Process.Pid))
+		done <- result{inMount, err, ns, want}
+	}()
+
+	r := <-done
+	if r.err != nil || !r.inMount {
+		t.Fatalf("enterNamespaces() = %v, %v, want true, nil", r.inMount, r.err)
+	}
+	if r.ns != r.want {
+		t.Errorf("thread is in mount namespace %s, want %s", r.ns, r.want)
+	}
+}
+
+func TestEnterNamespacesNoSetns(t *testing.T) {
+	options := &Options{NoSetns: true}
+
+	// Shared namespaces are fine for OpenJ9, but files still go by host PID
+	self := &Process{pid: os.Getpid()}
+	inMount, err := self.enterNamespaces(&openJ9{}, options)
+	if err != nil || inMount {
+		t.Errorf("enterNamespaces() = %v, %v, want false, nil", inMount, err)
+	}
+
+	other := &Process{pid: 1 << 30}
+	if _, err := other.enterNamespaces(&openJ9{}, options); !errors.Is(err, ErrNamespace) || !strings.Contains(err.Error(), "OpenJ9 attach needs the net namespace") {
+		t.Errorf("enterNamespaces() = %v, want ErrNamespace for OpenJ9's net namespace", err)
+	}
+
+	if _, err := other.enterNamespaces(&hotSpot{}, options); err != nil {
+		t.Errorf("enterNamespaces() = %v, want nil for HotSpot", err)
+	}
+}
+
+func TestParseIDMap(t *testing.T) {
+	m, err := parseIDMap([]byte("         0       1000          1\n         1     100000      65536\n"))
+	if err != nil {
+		t.Fatalf("parseIDMap() error = %v", err)
+	}
+
+	tests := []struct {
+		outside, inside int
+		mapped          bool
+	}{
+		{1000, 0, true},
+		{100000, 1, true},
+		{100998, 999, true},
+		{165535, 65536, true},
+		{165536, -1, false},
+		{0, -1, false},
+	}
+	for _, tt := range tests {
+		inside, mapped := m.toInside(tt.outside)
+		if inside != tt.inside || mapped != tt.mapped {
+			t.Errorf("toInside(%d) = %d, %v, want %d, %v", tt.outside, inside, mapped, tt.inside, tt.mapped)
+		}
+	}
+
+	if _, err := parseIDMap([]byte("0 1000\n")); err == nil {
+		t.Error("parseIDMap() accepted a line with two fields")
+	}
+}
+
+func TestRemoveStaleHotSpotFiles(t *testing.T) {
+	tmpPath := t.TempDir()
+	procRoot := t.TempDir()
+	for _, pid := range []string{"100", "200"} {
+		os.Mkdir(filepath.Join(procRoot, pid), 0755)
+	}
+
+	// Live process: attach file and listening socket are kept
+	os.WriteFile(filepath.Join(tmpPath, ".attach_pid100"), nil, 0600)
+	listener, err := net.Listen("unix", filepath.Join(tmpPath, ".java_pid100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Socket of a JVM in another PID namespace, invisible in procRoot
+	other, err := net.Listen("unix", filepath.Join(tmpPath, ".java_pid900"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// Gone process, and a live one whose listener is gone
+	os.WriteFile(filepath.Join(tmpPath, ".attach_pid300"), nil, 0600)
+	stale, err := net.Listen("unix", filepath.Join(tmpPath, ".java_pid200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	removed := removeStaleHotSpotFiles(tmpPath, procRoot, 0, false)
+	if len(removed) != 2 {
+		t.Fatalf("removeStaleHotSpotFiles() = %+v, want 2 entries", removed)
+	}
+	for _, name := range []string{".attach_pid300", ".java_pid200"} {
+		if _, err := os.Lstat(filepath.Join(tmpPath, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for _, name := range []string{".attach_pid100", ".java_pid100", ".java_pid900"} {
+		if _, err := os.Lstat(filepath.Join(tmpPath, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestRepairSemaphoreDoesNotCreate(t *testing.T) {
+	attachDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(attachDir, "_notifier"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &openJ9{}
+	if _, exists, err := o.lookupSemaphore(attachDir); err != nil || exists {
+		t.Skipf("semaphore key already in use: %v", err)
+	}
+	if stale, err := o.repairSemaphore(attachDir, true); stale != nil || err != nil {
+		t.Errorf("repairSemaphore() = %+v, %v, want nil, nil", stale, err)
+	}
+	if _, exists, _ := o.lookupSemaphore(attachDir); exists {
+		t.Error("repairSemaphore() created the semaphore")
+	}
+}
+
+func TestRemoveStaleOpenJ9Entries(t *testing.T) {
+	attachDir := t.TempDir()
+	procRoot := t.TempDir()
+	os.Mkdir(filepath.Join(procRoot, "1"), 0755)
+
+	for _, pid := range []int{1, 42} {
+		dir := filepath.Join(attachDir, fmt.Sprint(pid))
+		os.Mkdir(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "attachInfo"), []byte(fmt.Sprintf("vmId=%d\nprocessId=%d\n", pid, pid)), 0644)
+		os.WriteFile(filepath.Join(dir, "replyInfo"), []byte("0000000000000001\n1234\n"), 0600)
+	}
+	// A JVM that has not written its attachInfo yet
+	os.Mkdir(filepath.Join(attachDir, "7"), 0755)
+
+	if dry := removeStaleOpenJ9Entries(attachDir, procRoot, 1, true); len(dry) != 2 {
+		t.Errorf("dry run = %+v, want 2 entries", dry)
+	}
+	if _, err := os.Stat(filepath.Join(attachDir, "42")); err != nil {
+		t.Errorf("dry run removed the directory of process 42")
+	}
+
+	removed := removeStaleOpenJ9Entries(attachDir, procRoot, 1, false)
+	if len(removed) != 2 {
+		t.Fatalf("removeStaleOpenJ9Entries() = %+v, want 2 entries", removed)
+	}
+	if _, err := os.Stat(filepath.Join(attachDir, "42")); !os.IsNotExist(err) {
+		t.Error("directory of gone process 42 was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(attachDir, "1", "replyInfo")); !os.IsNotExist(err) {
+		t.Error("leftover replyInfo of process 1 was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(attachDir, "7")); err != nil {
+		t.Error("directory without attachInfo was removed")
+	}
+
+	// A /proc that does not show the target is the wrong view
+	if removed := removeStaleOpenJ9Entries(attachDir, procRoot, 99, false); removed != nil {
+		t.Errorf("removeStaleOpenJ9Entries() = %+v with the wrong /proc, want nil", removed)
+	}
+}
+
+func TestLockNotificationFilesDeadline(t *testing.T) {
+	attachDir := t.TempDir()
+	for _, vmID := range []string{"101", "102", "103"} {
+		os.Mkdir(filepath.Join(attachDir, vmID), 0755)
+		os.WriteFile(filepath.Join(attachDir, vmID, "attachNotificationSync"), nil, 0644)
+	}
+
+	// Two JVMs hold their notification files
+	for _, vmID := range []string{"101", "102"} {
+		holder, err := os.Open(filepath.Join(attachDir, vmID, "attachNotificationSync"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer holder.Close()
+		if err := syscall.Flock(int(holder.Fd()), syscall.LOCK_EX); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const timeout = 150 * time.Millisecond
+	o := &openJ9{}
+	start := time.Now()
+	locks, count := o.lockNotificationFiles(attachDir, &Options{LockTimeout: timeout})
+	elapsed := time.Since(start)
+	o.unlockNotificationFiles(locks)
+
+	if count != 1 {
+		t.Errorf("locked %d files, want the free one", count)
+	}
+	if elapsed >= 2*timeout {
+		t.Errorf("took %v, want the timeout of %v shared by all files", elapsed, timeout)
+	}
+}
+
+func TestLockFileTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "_attachlock")
+	holder, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	if err := syscall.Flock(int(holder.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	// flock locks belong to the open file description, so a second open
+	// contends with the first
+	fd, err := syscall.Open(path, syscall.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	if err := lockFile(fd, 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "still held") {
+		t.Errorf("lockFile() = %v, want a timeout", err)
+	}
+
+	syscall.Flock(int(holder.Fd()), syscall.LOCK_UN)
+	if err := lockFile(fd, 50*time.Millisecond); err != nil {
+		t.Errorf("lockFile() = %v after release, want nil", err)
+	}
+}
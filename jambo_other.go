@@ -11,10 +11,22 @@ func getProcessInfo(pid int) (uid, gid, nspid int, err error) {
 	return 0, 0, pid, errors.New("platform not supported")
 }
 
-func enterNamespace(pid int, nsType string) error {
+func joinNamespace(pid int, nsType string) (bool, error) {
+	return false, nil
+}
+
+func getNamespaceIDs(pid, uid, gid int) (nsUid, nsGid int) {
+	return uid, gid
+}
+
+func checkAttachOwner(pid, nsUid int) error {
 	return nil
 }
 
+func sharesNamespace(pid int, nsType string) bool {
+	return true
+}
+
 func setCredentials(uid, gid int) error {
 	myUID := os.Geteuid()
 	myGID := os.Getegid()
@@ -25,49 +37,110 @@ func setCredentials(uid, gid int) error {
 	return nil
 }
 
+func listJVMs() ([]VMInfo, error) {
+	return nil, errors.New("listing JVMs not supported on this platform")
+}
+
+func readCgroupPaths(pid int) ([]string, error) {
+	return nil, errors.New("cgroups not supported on this platform")
+}
+
+func readCmdline(pid int) []string {
+	return nil
+}
+
+func targetFilePath(pid int, path string) string {
+	return path
+}
+
+func openProcessHandle(pid int) (*processHandle, error) {
+	return &processHandle{pid: pid, pidfd: -1}, nil
+}
+
+func (h *processHandle) verify() error {
+	return nil
+}
+
+func (h *processHandle) close() error {
+	return nil
+}
+
 func getTempPath(pid int) (string, error) {
 	return os.TempDir(), nil
 }
 
 // hotSpot implements JVM interface for HotSpot JVM
-type hotSpot struct{}
+type hotSpot struct {
+	process *processHandle // unused on this platform
+}
 
 func (h *hotSpot) Type() JVMType {
 	return HotSpot
 }
 
-func (h *hotSpot) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func (h *hotSpot) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
 	return "", errors.New("HotSpot attach not supported on this platform")
 }
 
-func (h *hotSpot) Detect(nspid int) bool {
+func (h *hotSpot) Detect(pid, nspid int) bool {
 	return true // Default to HotSpot
 }
 
 // openJ9 implements JVM interface for OpenJ9 JVM
-type openJ9 struct{}
+type openJ9 struct {
+	info    *OpenJ9Info
+	tmpDir  string
+	process *processHandle // unused on this platform
+}
 
 func (o *openJ9) Type() JVMType {
 	return OpenJ9
 }
 
-func (o *openJ9) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func (o *openJ9) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
 	return "", errors.New("OpenJ9 attach not supported on this platform")
 }
 
-func (o *openJ9) Detect(nspid int) bool {
+func (o *openJ9) Detect(pid, nspid int) bool {
 	return false // OpenJ9 detection not supported
 }
 
+func detectOpenJ9(pid, nspid int, attachPath string) *openJ9 {
+	return nil
+}
+
 // translateCommand is a stub for non-Linux platforms
-func (o *openJ9) translateCommand(args []string) string {
+func (o *openJ9) translateCommand(args []string) (string, error) {
 	if len(args) > 0 {
-		return args[0]
+		return args[0], nil
 	}
-	return ""
+	return "", nil
 }
 
 // unescapeString is a stub for non-Linux platforms
 func (o *openJ9) unescapeString(s string) string {
 	return s
 }
+
+// Replay serves a recorded Session back to the client code in place of the JVM.
+type Replay struct{}
+
+func (s *Session) Replay(tmpPath string, nspid int) (*Replay, error) {
+	return nil, errors.New("session replay not supported on this platform")
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+func diagnose(pid int, options *Options) []Check {
+	return []Check{{Name: "platform", Status: CheckFail, Detail: "diagnostics not supported on this platform"}}
+}
+
+func cleanup(pid int, options *Options) ([]StaleFile, error) {
+	return nil, errors.New("cleanup not supported on this platform")
+}
+
+func readTargetFile(pid int, path string) ([]byte, error) {
+	return nil, errors.New("reading target files not supported on this platform")
+}
@@ -1,7 +1,17 @@
 package jambo
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParsePID(t *testing.T) {
@@ -149,6 +159,26 @@ func TestOpenJ9CommandTranslation(t *testing.T) {
 			args:     []string{"jcmd"},
 			expected: "ATTACH_DIAGNOSTICS:help",
 		},
+		{
+			name:     "jcmd start local management agent",
+			args:     []string{"jcmd", "ManagementAgent.start_local"},
+			expected: "ATTACH_START_LOCAL_MANAGEMENT_AGENT",
+		},
+		{
+			name:     "jcmd start management agent",
+			args:     []string{"jcmd", "ManagementAgent.start", "jmxremote.port=9999", "jmxremote.ssl=false"},
+			expected: "ATTACH_START_MANAGEMENT_AGENT\x00com.sun.management.jmxremote.port=9999\ncom.sun.management.jmxremote.ssl=false\n",
+		},
+		{
+			name:     "jcmd start management agent with a space in a value",
+			args:     []string{"jcmd", "ManagementAgent.start", "config.file=/etc/my jmx.properties"},
+			expected: "ATTACH_START_MANAGEMENT_AGENT\x00com.sun.management.config.file=/etc/my jmx.properties\n",
+		},
+		{
+			name:     "jcmd start management agent as one line",
+			args:     []string{"jcmd", `ManagementAgent.start config.file="/etc/my jmx.properties" jmxremote.port=9999`},
+			expected: "ATTACH_START_MANAGEMENT_AGENT\x00com.sun.management.config.file=/etc/my jmx.properties\ncom.sun.management.jmxremote.port=9999\n",
+		},
 		{
 			name:     "threaddump",
 			args:     []string{"threaddump"},
@@ -198,12 +228,24 @@ func TestOpenJ9CommandTranslation(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := o9.translateCommand(tt.args)
-			if result != tt.expected {
-				t.Errorf("translateCommand(%v) = %q, want %q", tt.args, result, tt.expected)
+			result, err := o9.translateCommand(tt.args)
+			if err != nil || result != tt.expected {
+				t.Errorf("translateCommand(%v) = %q, %v, want %q", tt.args, result, err, tt.expected)
 			}
 		})
 	}
+
+	// Diagnostic arguments are separated by commas, which cannot be escaped
+	for _, args := range [][]string{
+		{"jcmd", "JFR.start", "settings=default,profile"},
+		{"jcmd", "Dump.heap", "/tmp/a,b.phd"},
+		{"dumpheap", "/tmp/a,b.phd"},
+		{"threaddump", "a,b"},
+	} {
+		if result, err := o9.translateCommand(args); err == nil {
+			t.Errorf("translateCommand(%q) = %q, want an error", args, result)
+		}
+	}
 }
 
 func TestOpenJ9UnescapeString(t *testing.T) {
@@ -260,3 +302,911 @@ func TestOpenJ9UnescapeString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMainClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdline  []string
+		expected string
+	}{
+		{"main class", []string{"java", "-Xmx1g", "-Dfoo=bar", "com.example.App", "arg"}, "com.example.App"},
+		{"classpath", []string{"java", "-cp", "/opt/lib/*", "com.example.App"}, "com.example.App"},
+		{"jar", []string{"/usr/bin/java", "-jar", "/opt/app.jar", "--port", "8080"}, "/opt/app.jar"},
+		{"module", []string{"java", "-p", "mods", "-m", "app/com.example.App"}, "app/com.example.App"},
+		{"module equals", []string{"java", "--module=app/com.example.App"}, "app/com.example.App"},
+		{"no main", []string{"java", "-version"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := parseMainClass(tt.cmdline); result != tt.expected {
+				t.Errorf("parseMainClass(%v) = %q, want %q", tt.cmdline, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVMInfoMatches(t *testing.T) {
+	vm := VMInfo{Pid: 42, MainClass: "com.example.OrderService"}
+	jar := VMInfo{Pid: 43, MainClass: "/opt/app/billing.jar"}
+
+	tests := []struct {
+		vm       VMInfo
+		selector string
+		expected bool
+	}{
+		{vm, "*", true},
+		{vm, "all", true},
+		{vm, "42", true},
+		{vm, "43", false},
+		{vm, "com.example.*", true},
+		{vm, "OrderService", true},
+		{vm, "*Service", true},
+		{vm, "org.*", false},
+		{jar, "billing.jar", true},
+		{jar, "billing*", true},
+		{jar, "jar", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.vm.MainClass+"/"+tt.selector, func(t *testing.T) {
+			if result := tt.vm.Matches(tt.selector); result != tt.expected {
+				t.Errorf("Matches(%q) = %v, want %v", tt.selector, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseKubepodsCgroup(t *testing.T) {
+	const id = "3f1c9a0b7d2e4f6a8b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a"
+
+	tests := []struct {
+		name        string
+		path        string
+		podUID      string
+		containerID string
+		ok          bool
+	}{
+		{
+			name:        "cgroupfs v1",
+			path:        "/kubepods/burstable/pod0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b/" + id,
+			podUID:      "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b",
+			containerID: id,
+			ok:          true,
+		},
+		{
+			name:        "cgroupfs guaranteed",
+			path:        "/kubepods/pod0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b/" + id,
+			podUID:      "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b",
+			containerID: id,
+			ok:          true,
+		},
+		{
+			name:        "systemd containerd",
+			path:        "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0b8e3c4a_1f2d_4e5f_9a8b_7c6d5e4f3a2b.slice/cri-containerd-" + id + ".scope",
+			podUID:      "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b",
+			containerID: id,
+			ok:          true,
+		},
+		{
+			name:        "systemd crio besteffort",
+			path:        "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod0b8e3c4a_1f2d_4e5f_9a8b_7c6d5e4f3a2b.slice/crio-" + id + ".scope",
+			podUID:      "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b",
+			containerID: id,
+			ok:          true,
+		},
+		{
+			name:   "pod level",
+			path:   "/kubepods.slice/kubepods-pod0b8e3c4a_1f2d_4e5f_9a8b_7c6d5e4f3a2b.slice",
+			podUID: "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b",
+			ok:     true,
+		},
+		{
+			name: "not a pod",
+			path: "/system.slice/docker-" + id + ".scope",
+		},
+		{
+			name: "kubepods root",
+			path: "/kubepods.slice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podUID, containerID, ok := parseKubepodsCgroup(tt.path)
+			if ok != tt.ok || podUID != tt.podUID || containerID != tt.containerID {
+				t.Errorf("parseKubepodsCgroup(%q) = (%q, %q, %v), want (%q, %q, %v)",
+					tt.path, podUID, containerID, ok, tt.podUID, tt.containerID, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResolveKubeNames(t *testing.T) {
+	podLogDir := t.TempDir()
+	containerLogDir := t.TempDir()
+
+	const uid = "0b8e3c4a-1f2d-4e5f-9a8b-7c6d5e4f3a2b"
+	for _, dir := range []string{"app", "istio-proxy"} {
+		if err := os.MkdirAll(filepath.Join(podLogDir, "shop_orders-7d9f_"+uid, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(containerLogDir, "orders-7d9f_shop_istio-proxy-abc123.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kc := &KubeContainer{PodUID: uid, ContainerID: "abc123"}
+	resolveKubeNames(kc, podLogDir, containerLogDir)
+
+	if kc.Namespace != "shop" || kc.Pod != "orders-7d9f" || kc.Container != "istio-proxy" {
+		t.Errorf("resolveKubeNames() = %+v", kc)
+	}
+	if kc.String() != "shop/orders-7d9f/istio-proxy" {
+		t.Errorf("String() = %q", kc.String())
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	orders := VMInfo{Pid: 10, MainClass: "com.example.Orders"}
+	payments := VMInfo{Pid: 20, MainClass: "com.example.Payments"}
+
+	policy := &Policy{
+		Preset: ReadOnlyPreset,
+		Rules: []PolicyRule{
+			{Name: "payments", Action: PolicyDeny, Targets: []string{"*Payments"}},
+			{Name: "sre-heap", Action: PolicyAllow, Commands: []string{"dumpheap", "jcmd:GC.heap_dump"}, UIDs: []int{1001}},
+			{Name: "jfr", Action: PolicyAllow, Commands: []string{"jcmd:JFR.*"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		target  VMInfo
+		uid     int
+		command string
+		args    []string
+		allowed bool
+	}{
+		{"read-only threaddump", orders, 1000, "threaddump", nil, true},
+		{"read-only jcmd", orders, 1000, "jcmd", []string{"VM.version"}, true},
+		{"jcmd line with options", orders, 1000, "jcmd", []string{"Thread.print -l"}, true},
+		{"jcmd help", orders, 1000, "jcmd", []string{"help"}, true},
+		{"empty jcmd line denied", orders, 1000, "jcmd", nil, false},
+		{"empty first arg denied", orders, 1000, "jcmd", []string{"", "VM.set_flag", "X", "1"}, false},
+		{"second line denied", orders, 1000, "jcmd", []string{"Thread.print\nVM.set_flag X 1"}, false},
+		{"blank line denied", orders, 1000, "jcmd", []string{"Thread.print\n\nVM.version"}, false},
+		{"all lines allowed", orders, 1000, "jcmd", []string{"Thread.print\nVM.version"}, true},
+		{"inspectheap", orders, 1000, "inspectheap", nil, true},
+		{"inspectheap -all", orders, 1000, "inspectheap", []string{"-all"}, true},
+		{"inspectheap -live denied", orders, 1000, "inspectheap", []string{"-live"}, false},
+		{"inspectheap filename denied", orders, 1000, "inspectheap", []string{"-all", "/tmp/histo.txt"}, false},
+		{"class_histogram -all", orders, 1000, "jcmd", []string{"GC.class_histogram -all -parallel=2"}, true},
+		{"class_histogram filename denied", orders, 1000, "jcmd", []string{"GC.class_histogram", "/tmp/histo.txt"}, false},
+		{"native_memory summary", orders, 1000, "jcmd", []string{"VM.native_memory summary scale=MB"}, true},
+		{"native_memory detail", orders, 1000, "jcmd", []string{"VM.native_memory", "detail"}, true},
+		{"native_memory baseline denied", orders, 1000, "jcmd", []string{"VM.native_memory baseline"}, false},
+		{"native_memory shutdown denied", orders, 1000, "jcmd", []string{"VM.native_memory", "shutdown"}, false},
+		{"native_memory second line denied", orders, 1000, "jcmd", []string{"VM.native_memory summary\nVM.native_memory baseline"}, false},
+		{"load denied", orders, 0, "load", []string{"/tmp/agent.so"}, false},
+		{"setflag denied", orders, 0, "setflag", []string{"HeapDumpOnOutOfMemoryError", "true"}, false},
+		{"set_flag denied", orders, 0, "jcmd", []string{"VM.set_flag", "X", "1"}, false},
+		{"dumpheap for sre", orders, 1001, "dumpheap", []string{"/tmp/h.hprof"}, true},
+		{"dumpheap for others", orders, 1000, "dumpheap", []string{"/tmp/h.hprof"}, false},
+		{"heap_dump for sre", orders, 1001, "jcmd", []string{"GC.heap_dump", "/tmp/h.hprof"}, true},
+		{"jfr glob", orders, 1000, "jcmd", []string{"JFR.start"}, true},
+		{"payments target denied", payments, 1000, "threaddump", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.target, tt.uid, tt.command, tt.args)
+			if tt.allowed && err != nil {
+				t.Errorf("Check() unexpected error: %v", err)
+			}
+			if !tt.allowed {
+				if !errors.Is(err, ErrPolicyDenied) {
+					t.Errorf("Check() error = %v, want ErrPolicyDenied", err)
+				}
+				var policyErr *PolicyError
+				if !errors.As(err, &policyErr) || policyErr.Pid != tt.target.Pid {
+					t.Errorf("Check() error = %#v, want *PolicyError for pid %d", err, tt.target.Pid)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"default": "deny", "rules": [{"action": "allow", "commands": ["properties"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadPolicy() error: %v", err)
+	}
+	if err := policy.Check(VMInfo{Pid: 1}, 0, "properties", nil); err != nil {
+		t.Errorf("properties should be allowed: %v", err)
+	}
+	if err := policy.Check(VMInfo{Pid: 1}, 0, "threaddump", nil); err == nil {
+		t.Error("threaddump should be denied by default")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"action": "maybe"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy(path); err == nil {
+		t.Error("LoadPolicy() should reject invalid actions")
+	}
+
+	if policy, err := LoadPolicy(ReadOnlyPreset); err != nil || policy.Default != PolicyDeny {
+		t.Errorf("LoadPolicy(%q) = %+v, %v", ReadOnlyPreset, policy, err)
+	}
+}
+
+// recordingAuditSink collects audit events in memory.
+type recordingAuditSink struct {
+	events []*AuditEvent
+}
+
+func (r *recordingAuditSink) Audit(event *AuditEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestAuditDeniedOperation(t *testing.T) {
+	sink := &recordingAuditSink{}
+	uid := 1234
+	proc := &Process{pid: os.Getpid(), nsPid: os.Getpid(), jvm: &hotSpot{}}
+
+	_, err := proc.Attach("load", []string{"instrument", "false", "/opt/agent.jar=debug"}, &Options{
+		Policy:    ReadOnlyPolicy(),
+		CallerUID: &uid,
+		Audit:     sink,
+	})
+	if !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("Attach() error = %v, want ErrPolicyDenied", err)
+	}
+
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d audit events, want 1", len(sink.events))
+	}
+	event := sink.events[0]
+	if event.Outcome != AuditDenied || event.CallerUID != uid || event.Command != "load" || event.AgentPath != "/opt/agent.jar" {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestAuditAgentHashedBeforeLoad(t *testing.T) {
+	agent := filepath.Join(t.TempDir(), "agent.jar")
+	if err := os.WriteFile(agent, []byte("agent"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := fileSHA256(agent)
+
+	proc := &Process{pid: os.Getpid(), nsPid: os.Getpid()}
+	event := proc.auditEvent(VMInfo{}, 0, "load", []string{agent, "true", ""}, time.Now(), &Options{DryRun: true})
+
+	// Swapping the file afterwards does not change the record
+	os.WriteFile(agent, []byte("other"), 0644)
+	if err := audit(&recordingAuditSink{}, event, nil); err != nil {
+		t.Fatal(err)
+	}
+	if event.AgentSHA256 != want || !event.DryRun || event.Outcome != AuditSuccess {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestAuditTimeout(t *testing.T) {
+	event := &AuditEvent{Time: time.Now()}
+	err := fmt.Errorf("attach to process 1: %w", context.DeadlineExceeded)
+	audit(&recordingAuditSink{}, event, err)
+	if event.Outcome != AuditFailure || !event.TimedOut {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewJSONLinesAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for _, command := range []string{"threaddump", "properties"} {
+		if err := sink.Audit(&AuditEvent{Pid: 1, Command: command, Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"command":"properties"`) {
+		t.Errorf("unexpected audit log contents:\n%s", data)
+	}
+}
+
+func TestAgentFile(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"instrument", "false", "/opt/agent.jar=opt1,opt2"}, "/opt/agent.jar"},
+		{[]string{"instrument", "false", "/opt/agent.jar"}, "/opt/agent.jar"},
+		{[]string{"/opt/libagent.so", "true", "opts"}, "/opt/libagent.so"},
+		{[]string{"jdwp", "false"}, ""},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if result := agentFile(tt.args); result != tt.expected {
+			t.Errorf("agentFile(%v) = %q, want %q", tt.args, result, tt.expected)
+		}
+	}
+}
+
+func TestWriteJournalField(t *testing.T) {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "SIMPLE", "value")
+	writeJournalField(&buf, "EMPTY", "")
+	writeJournalField(&buf, "MULTI", "a\nb")
+
+	expected := "SIMPLE=value\nMULTI\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if buf.String() != expected {
+		t.Errorf("writeJournalField() = %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{
+		Attempts:       5,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+		Multiplier:     2,
+	}
+
+	expected := []time.Duration{50, 100, 200, 300, 300}
+	for i, want := range expected {
+		if got := policy.backoff(i + 1); got != want*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, want*time.Millisecond)
+		}
+	}
+
+	constant := &RetryPolicy{InitialBackoff: 10 * time.Millisecond}
+	if got := constant.backoff(4); got != 10*time.Millisecond {
+		t.Errorf("backoff without multiplier = %v, want 10ms", got)
+	}
+}
+
+func TestWaitPolicyDelays(t *testing.T) {
+	var delays []time.Duration
+	var total time.Duration
+	for delay := range DefaultHotSpotWait.delays() {
+		delays = append(delays, delay)
+		total += delay
+	}
+	if len(delays) != 24 || delays[0] != 20*time.Millisecond || delays[23] != 480*time.Millisecond {
+		t.Errorf("DefaultHotSpotWait delays = %v, want 20ms, 40ms, ... 480ms", delays)
+	}
+	if total != 6*time.Second {
+		t.Errorf("DefaultHotSpotWait total = %v, want 6s", total)
+	}
+
+	exponential := &WaitPolicy{InitialDelay: 100 * time.Millisecond, Multiplier: 2, MaxWait: time.Second}
+	delays = nil
+	for delay := range exponential.delays() {
+		delays = append(delays, delay)
+	}
+	expected := []time.Duration{100, 200, 400, 300}
+	if len(delays) != len(expected) {
+		t.Fatalf("exponential delays = %v, want %v ms", delays, expected)
+	}
+	for i := range expected {
+		if delays[i] != expected[i]*time.Millisecond {
+			t.Errorf("exponential delays = %v, want %v ms", delays, expected)
+			break
+		}
+	}
+}
+
+func TestParseAttachInfo(t *testing.T) {
+	data := []byte(`#attachInfo
+#Sun Oct 18 12:00:00 UTC 2026
+vmId=1
+displayName=com.example.Main\:worker \u00e9
+processId=1
+userUid=1001
+version=0x60000
+`)
+	info, err := parseAttachInfo(data)
+	if err != nil {
+		t.Fatalf("parseAttachInfo() error = %v", err)
+	}
+	expected := OpenJ9Info{VMID: "1", DisplayName: "com.example.Main:worker é", ProcessID: 1, UID: 1001, Version: "0x60000"}
+	if *info != expected {
+		t.Errorf("parseAttachInfo() = %+v, want %+v", *info, expected)
+	}
+
+	if info, err := parseAttachInfo([]byte("vmId=42\nprocessId=42\n")); err != nil || info.UID != -1 {
+		t.Errorf("parseAttachInfo() without userUid = %+v, %v, want UID -1", info, err)
+	}
+	if _, err := parseAttachInfo([]byte("vmId=42\nprocessId=x\n")); err == nil {
+		t.Error("parseAttachInfo() accepted an invalid processId")
+	}
+	if _, err := parseAttachInfo(nil); err == nil {
+		t.Error("parseAttachInfo() accepted an empty file")
+	}
+}
+
+func TestOpenJ9AttachDirectories(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"JAVA_TOOL_OPTIONS=-Djava.io.tmpdir=/var/tmp '-Dcom.ibm.tools.attach.displayName=my app'",
+		"JDK_JAVA_OPTIONS=-Dcom.ibm.tools.attach.directory=/env/attach",
+	}
+	cmdline := []string{"java", "-cp", "-Dnot.an.option=x", "-Dcom.ibm.tools.attach.directory=/data/attach", "com.example.Main", "-Djava.io.tmpdir=/app/arg"}
+
+	options := javaOptions(environ, cmdline)
+	if name, _ := systemProperty(options, "com.ibm.tools.attach.displayName"); name != "my app" {
+		t.Errorf("displayName = %q, want %q", name, "my app")
+	}
+
+	// The command line comes last and wins; arguments of the main class
+	// and option values are not JVM options
+	directory, tmpDir := openJ9AttachDirectories(options)
+	if directory != "/data/attach" || tmpDir != "/var/tmp" {
+		t.Errorf("openJ9AttachDirectories() = %q, %q, want %q, %q", directory, tmpDir, "/data/attach", "/var/tmp")
+	}
+
+	if directory, tmpDir := openJ9AttachDirectories(javaOptions(nil, []string{"java", "-jar", "app.jar"})); directory != "" || tmpDir != "" {
+		t.Errorf("openJ9AttachDirectories() = %q, %q, want defaults", directory, tmpDir)
+	}
+}
+
+func TestManagementAgentOptionsRequest(t *testing.T) {
+	agent := &ManagementAgentOptions{
+		Port:       9999,
+		RMIPort:    9998,
+		Host:       "127.0.0.1",
+		ConfigFile: "/etc/my jmx.properties",
+		Properties: map[string]string{
+			"jmxremote.ssl":          "false",
+			"jmxremote.authenticate": "false",
+		},
+	}
+
+	args, err := agent.request().Encode(HotSpot)
+	if err != nil {
+		t.Fatalf("Encode(HotSpot) error = %v", err)
+	}
+	want := []string{`ManagementAgent.start config.file="/etc/my jmx.properties" jmxremote.host=127.0.0.1 jmxremote.port=9999 jmxremote.rmi.port=9998 jmxremote.authenticate=false jmxremote.ssl=false`}
+	if !slices.Equal(args, want) {
+		t.Errorf("Encode(HotSpot) = %q, want %q", args, want)
+	}
+
+	args, err = agent.request().Encode(OpenJ9)
+	if err != nil {
+		t.Fatalf("Encode(OpenJ9) error = %v", err)
+	}
+	want = []string{
+		"ManagementAgent.start",
+		"config.file=/etc/my jmx.properties",
+		"jmxremote.host=127.0.0.1",
+		"jmxremote.port=9999",
+		"jmxremote.rmi.port=9998",
+		"jmxremote.authenticate=false",
+		"jmxremote.ssl=false",
+	}
+	if !slices.Equal(args, want) {
+		t.Errorf("Encode(OpenJ9) = %q, want %q", args, want)
+	}
+
+	args, err = (&ManagementAgentOptions{}).request().Encode(HotSpot)
+	if err != nil || !slices.Equal(args, []string{"ManagementAgent.start"}) {
+		t.Errorf("Encode(HotSpot) of empty options = %q, %v, want the bare command", args, err)
+	}
+}
+
+func TestManagementAgentPropertiesRoundTrip(t *testing.T) {
+	agent := &ManagementAgentOptions{
+		ConfigFile: "C:\\Program Files\\jmx.properties",
+		Host:       " 10.0.0.1",
+		Properties: map[string]string{
+			"jmxremote.password.file":         "/etc/jmx#1",
+			"jmxremote.ssl.enabled.protocols": "TLSv1.2,TLSv1.3",
+		},
+	}
+	args, err := agent.request().Encode(OpenJ9)
+	if err != nil {
+		t.Fatalf("Encode(OpenJ9) error = %v", err)
+	}
+
+	request, err := (&openJ9{}).translateCommand(append([]string{"jcmd"}, args...))
+	if err != nil {
+		t.Fatalf("translateCommand() error = %v", err)
+	}
+	text, ok := strings.CutPrefix(request, "ATTACH_START_MANAGEMENT_AGENT\x00")
+	if !ok {
+		t.Fatalf("translateCommand() = %q, want ATTACH_START_MANAGEMENT_AGENT", request)
+	}
+	props := parseProperties([]byte(text))
+	want := map[string]string{
+		"com.sun.management.config.file":                     "C:\\Program Files\\jmx.properties",
+		"com.sun.management.jmxremote.host":                  " 10.0.0.1",
+		"com.sun.management.jmxremote.password.file":         "/etc/jmx#1",
+		"com.sun.management.jmxremote.ssl.enabled.protocols": "TLSv1.2,TLSv1.3",
+	}
+	if !maps.Equal(props, want) {
+		t.Errorf("properties round trip = %q, want %q", props, want)
+	}
+}
+
+func TestCommandTableCheck(t *testing.T) {
+	tests := []struct {
+		jvm       JVMType
+		command   string
+		args      []string
+		supported bool
+	}{
+		{HotSpot, "setflag", []string{"PrintGC", "1"}, true},
+		{HotSpot, "jcmd", []string{"VM.set_flag PrintGC true"}, true},
+		{HotSpot, "unknownCommand", nil, false},
+		{OpenJ9, "setflag", []string{"PrintGC", "1"}, false},
+		{OpenJ9, "printflag", []string{"PrintGC"}, false},
+		{OpenJ9, "threaddump", nil, true},
+		{OpenJ9, "threaddump", []string{"-l"}, true},
+		{OpenJ9, "threaddump", []string{"-e"}, false},
+		{OpenJ9, "jcmd", nil, true},
+		{OpenJ9, "jcmd", []string{"Dump.system"}, true},
+		{OpenJ9, "jcmd", []string{"Dump.snap", "/tmp/snap.trc"}, true},
+		{OpenJ9, "jcmd", []string{"GC.run"}, true},
+		{OpenJ9, "jcmd", []string{"GC.run extra"}, false},
+		{OpenJ9, "jcmd", []string{"Thread.print", "-l"}, true},
+		{OpenJ9, "jcmd", []string{"VM.flags"}, false},
+		{OpenJ9, "jcmd", []string{"ManagementAgent.stop"}, false},
+		{OpenJ9, "jcmd", []string{"ManagementAgent.start", "jmxremote.port=9999"}, true},
+		{OpenJ9, "inspectheap", []string{"all"}, true},
+		{OpenJ9, "inspectheap", []string{"-live"}, false},
+	}
+
+	for _, tt := range tests {
+		err := commandTables[tt.jvm].check(tt.jvm, tt.command, tt.args)
+		if tt.supported && err != nil {
+			t.Errorf("%s %s %q: unexpected error %v", tt.jvm, tt.command, tt.args, err)
+		}
+		if !tt.supported && !errors.Is(err, ErrUnsupportedCommand) {
+			t.Errorf("%s %s %q: error = %v, want ErrUnsupportedCommand", tt.jvm, tt.command, tt.args, err)
+		}
+	}
+}
+
+func TestSupportedCommands(t *testing.T) {
+	hotSpot := (&Process{jvm: &hotSpot{}}).SupportedCommands()
+	if !slices.Contains(hotSpot, "jcmd") || !slices.Contains(hotSpot, "setflag") {
+		t.Errorf("HotSpot commands = %q, want jcmd and setflag", hotSpot)
+	}
+
+	openJ9 := (&Process{jvm: &openJ9{}}).SupportedCommands()
+	for _, name := range []string{"threaddump", "jcmd:Dump.system", "jcmd:Dump.snap", "jcmd:GC.run"} {
+		if !slices.Contains(openJ9, name) {
+			t.Errorf("OpenJ9 commands = %q, missing %s", openJ9, name)
+		}
+	}
+	for _, name := range []string{"jcmd", "setflag", "printflag"} {
+		if slices.Contains(openJ9, name) {
+			t.Errorf("OpenJ9 commands = %q, should not contain %s", openJ9, name)
+		}
+	}
+}
+
+func TestParseJavacore(t *testing.T) {
+	data, err := os.ReadFile("testdata/javacore.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc, err := ParseJavacore(data)
+	if err != nil {
+		t.Fatalf("ParseJavacore: %v", err)
+	}
+
+	if jc.Path != "/app/javacore.20240305.112451.1.0001.txt" || jc.Date != "2024/03/05 at 11:24:51:812" {
+		t.Errorf("path %q, date %q", jc.Path, jc.Date)
+	}
+	if len(jc.Sections) != 8 || jc.Section("THREADS") == nil || jc.Section("NATIVEMEMINFO") != nil {
+		t.Errorf("got %d sections", len(jc.Sections))
+	}
+
+	env := jc.Environment
+	if env.ProcessID != 1 || env.JavaHome != "/opt/java/openjdk" || env.CommandLine != "java -Xmx512m -cp /app/app.jar com.example.Main" {
+		t.Errorf("environment = %+v", env)
+	}
+	if len(env.UserArgs) != 3 || env.UserArgs[1] != "-Xmx512m" || env.Variables["JAVA_TOOL_OPTIONS"] != "-Dfoo=a=b" {
+		t.Errorf("user args %q, variables %q", env.UserArgs, env.Variables)
+	}
+
+	if jc.CurrentThread != "main" || len(jc.Threads) != 3 {
+		t.Fatalf("current thread %q, %d threads", jc.CurrentThread, len(jc.Threads))
+	}
+	main := jc.Threads[0]
+	if main.Name != "main" || main.VMThread != "0x00000000002D4E00" || main.State != "R" || main.Priority != 5 || main.ID != 1 || main.Daemon || main.NativeID != 7 {
+		t.Errorf("main thread = %+v", main)
+	}
+	if len(main.Stack) != 2 || main.Stack[0].Location != "com/example/Main.work(Main.java:42)" ||
+		len(main.Stack[0].Locks) != 1 || main.Stack[0].Locks[0] != "entered lock: java/lang/Object@0x00000000FFF04AD8, entry count: 1" {
+		t.Errorf("main stack = %+v", main.Stack)
+	}
+	if len(main.NativeStack) != 2 {
+		t.Errorf("main native stack = %q", main.NativeStack)
+	}
+	worker := jc.Threads[1]
+	if worker.State != "B" || worker.ID != 16 || !worker.Daemon || worker.NativeID != 26 || !strings.HasPrefix(worker.Blocker, "Blocked on: java/lang/Object@0x00000000FFF04AD8") {
+		t.Errorf("worker thread = %+v", worker)
+	}
+	if native := jc.Threads[2]; native.Name != "Anonymous native thread" || native.VMThread != "" || native.NativeID != 2 || len(native.NativeStack) != 1 {
+		t.Errorf("native thread = %+v", native)
+	}
+
+	if len(jc.Monitors) != 3 {
+		t.Fatalf("got %d monitors", len(jc.Monitors))
+	}
+	object := jc.Monitors[0]
+	if object.Object != "java/lang/Object@0x00000000FFF04AD8" || object.System || object.Owner != "main" || object.EntryCount != 1 ||
+		!slices.Equal(object.Waiting, []string{"worker-1"}) || !slices.Equal(object.Notify, []string{"worker-2"}) {
+		t.Errorf("object monitor = %+v", object)
+	}
+	if unowned := jc.Monitors[1]; !unowned.System || unowned.Owner != "" || unowned.Object != "Thread global lock (0x00007F5C8C00B3A8)" {
+		t.Errorf("system monitor = %+v", unowned)
+	}
+	if owned := jc.Monitors[2]; owned.Owner != "main" || owned.EntryCount != 1 {
+		t.Errorf("system monitor = %+v", owned)
+	}
+
+	if len(jc.MemorySegments) != 3 {
+		t.Fatalf("got %d segments", len(jc.MemorySegments))
+	}
+	if seg := jc.MemorySegments[1]; seg.Type != "Class Memory" || seg.Start != 0x00007F5C5C100030 || seg.Alloc != 0x00007F5C5C1083B8 || seg.Flags != 0x00010040 || seg.Size != 0x10000 {
+		t.Errorf("segment = %+v", seg)
+	}
+	if len(jc.GCHistory) != 2 || !strings.Contains(jc.GCHistory[0], "Allocation failure end") {
+		t.Errorf("GC history = %q", jc.GCHistory)
+	}
+
+	wantLibs := []JavacoreLibrary{
+		{Loader: "*System*(0x00000000FFF0B0E8)", Path: "/opt/java/openjdk/lib/libnet.so"},
+		{Loader: "*System*(0x00000000FFF0B0E8)", Path: "/opt/java/openjdk/lib/libnio.so"},
+		{Loader: "jdk/internal/loader/ClassLoaders$AppClassLoader(0x00000000FFF17E28)", Path: "/app/native/libapp.so"},
+	}
+	if !slices.Equal(jc.NativeLibraries, wantLibs) {
+		t.Errorf("native libraries = %+v", jc.NativeLibraries)
+	}
+
+	if _, err := ParseJavacore([]byte("not a javacore\n")); err == nil {
+		t.Error("ParseJavacore accepted a file without sections")
+	}
+}
+
+func TestJavacorePath(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"Dump written to /app/javacore.20240305.112451.1.0001.txt\n", "/app/javacore.20240305.112451.1.0001.txt"},
+		{"openj9_diagnostics.string_result=Dump written to /tmp/core.txt\\n\n", "/tmp/core.txt"},
+		{"JVMDUMP010I Java dump written to /app/javacore.20240305.112451.1.0002.txt", "/app/javacore.20240305.112451.1.0002.txt"},
+		{"javacore.20240305.112451.1.0003.txt", "javacore.20240305.112451.1.0003.txt"},
+		{"Error: dump failed", ""},
+	}
+	for _, tt := range tests {
+		if got := javacorePath(tt.output); got != tt.want {
+			t.Errorf("javacorePath(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestJcmdRequestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     *JcmdRequest
+		hotSpot []string
+		openJ9  []string
+	}{
+		{
+			name:    "plain",
+			req:     NewJcmdRequest("GC.heap_dump").Flag("-all").Arg("/tmp/heap.hprof"),
+			hotSpot: []string{"GC.heap_dump -all /tmp/heap.hprof"},
+			openJ9:  []string{"GC.heap_dump", "-all", "/tmp/heap.hprof"},
+		},
+		{
+			name:    "spaces",
+			req:     NewJcmdRequest("JFR.start").Option("name", "startup").Option("filename", "/tmp/my recording.jfr"),
+			hotSpot: []string{`JFR.start name=startup filename="/tmp/my recording.jfr"`},
+			openJ9:  []string{"JFR.start", "name=startup", "filename=/tmp/my recording.jfr"},
+		},
+		{
+			name:    "double quote in value",
+			req:     NewJcmdRequest("VM.log").Option("decorations", `say "hi"`),
+			hotSpot: []string{`VM.log decorations='say "hi"'`},
+			openJ9:  []string{"VM.log", `decorations=say "hi"`},
+		},
+		{
+			name:    "quote within value",
+			req:     NewJcmdRequest("JFR.start").Option("filename", "/tmp/it's.jfr").Arg(`a"b`),
+			hotSpot: []string{`JFR.start filename="/tmp/it's.jfr" 'a"b'`},
+			openJ9:  []string{"JFR.start", "filename=/tmp/it's.jfr", `a"b`},
+		},
+		{
+			name:    "positional with equals",
+			req:     NewJcmdRequest("Compiler.directives_add").Arg("a=b"),
+			hotSpot: []string{`Compiler.directives_add "a=b"`},
+			openJ9:  []string{"Compiler.directives_add", "a=b"},
+		},
+		{
+			name:    "comma and empty value",
+			req:     NewJcmdRequest("JFR.start").Option("settings", "default,profile").Option("name", ""),
+			hotSpot: []string{`JFR.start settings=default,profile name=""`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.Encode(HotSpot)
+			if err != nil || !slices.Equal(got, tt.hotSpot) {
+				t.Errorf("Encode(HotSpot) = %q, %v, want %q", got, err, tt.hotSpot)
+			}
+			got, err = tt.req.Encode(OpenJ9)
+			if tt.openJ9 == nil {
+				if err == nil {
+					t.Errorf("Encode(OpenJ9) = %q, want an error", got)
+				}
+			} else if err != nil || !slices.Equal(got, tt.openJ9) {
+				t.Errorf("Encode(OpenJ9) = %q, %v, want %q", got, err, tt.openJ9)
+			}
+		})
+	}
+}
+
+func TestJcmdRequestInvalid(t *testing.T) {
+	invalid := []*JcmdRequest{
+		NewJcmdRequest(""),
+		NewJcmdRequest("GC.run now"),
+		NewJcmdRequest("VM.log").Option("bad name", "x"),
+		NewJcmdRequest("VM.log").Option("what", `both " and '`),
+		NewJcmdRequest("GC.heap_dump").Arg(`C:\dumps dir\`),
+		NewJcmdRequest("GC.heap_dump").Arg("a\x00b"),
+		NewJcmdRequest("JFR.start").Option("filename", "a\nVM.set_flag HeapDumpPath /tmp"),
+		NewJcmdRequest("GC.heap_dump").Arg("a\rb"),
+		NewJcmdRequest("JFR.start").Flag("-a\nVM.set_flag"),
+	}
+	for _, req := range invalid {
+		if got, err := req.Encode(HotSpot); err == nil {
+			t.Errorf("Encode(HotSpot) of %s = %q, want an error", req, got)
+		}
+	}
+
+	long := NewJcmdRequest("GC.heap_dump").Arg(strings.Repeat("x", MaxRequestSize))
+	for _, jvm := range []JVMType{HotSpot, OpenJ9} {
+		if _, err := long.Encode(jvm); !errors.Is(err, ErrRequestTooLarge) {
+			t.Errorf("Encode(%s) of a long request error = %v, want ErrRequestTooLarge", jvm, err)
+		}
+	}
+
+	// The limit is on the encoded request
+	fits := NewJcmdRequest("GC.heap_dump").Arg(strings.Repeat("x", MaxRequestSize-len("1\x00jcmd\x00GC.heap_dump \x00\x00\x00")))
+	if _, err := fits.Encode(HotSpot); err != nil {
+		t.Errorf("Encode(HotSpot) of a request of exactly MaxRequestSize: %v", err)
+	}
+}
+
+func TestParseJcmdHelpAll(t *testing.T) {
+	help, err := os.ReadFile("testdata/jcmd-help.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := parseJcmdHelp(string(help))
+	wantNames := []string{"Compiler.codecache", "GC.heap_dump", "GC.run", "JFR.start", "Thread.print", "VM.version", "help"}
+	if !slices.Equal(names, wantNames) {
+		t.Fatalf("parseJcmdHelp() = %q, want %q", names, wantNames)
+	}
+
+	helpAll, err := os.ReadFile("testdata/jcmd-help-all.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := parseJcmdHelpAll(string(helpAll), names)
+	if !catalog.Detailed || !slices.Equal(catalog.Names(), wantNames) {
+		t.Fatalf("catalog names = %q", catalog.Names())
+	}
+
+	dump := catalog.Command("GC.heap_dump")
+	if dump.Description != "Generate a HPROF format dump of the Java heap." || !strings.HasPrefix(dump.Impact, "High:") ||
+		dump.Permission != "java.lang.management.ManagementPermission(monitor)" || dump.Syntax != "GC.heap_dump [options] <filename>" {
+		t.Errorf("GC.heap_dump = %+v", dump)
+	}
+	wantArgs := []JcmdOption{{Name: "filename", Description: "Name of the dump file", Type: "STRING", Default: "no default value"}}
+	if !slices.Equal(dump.Arguments, wantArgs) {
+		t.Errorf("GC.heap_dump arguments = %+v", dump.Arguments)
+	}
+	if len(dump.Options) != 3 || dump.Options[1].Name != "-gz" || dump.Options[1].Type != "INT" || dump.Options[1].Default != "1" || !dump.Options[1].Optional {
+		t.Errorf("GC.heap_dump options = %+v", dump.Options)
+	}
+
+	if gc := catalog.Command("GC.run"); gc.Permission != "" || len(gc.Options) != 0 {
+		t.Errorf("GC.run = %+v", gc)
+	}
+	jfr := catalog.Command("JFR.start")
+	if len(jfr.Options) != 6 || jfr.Options[3].Type != "MEMORY SIZE" || jfr.Options[5].Type != "STRING SET" || jfr.Options[5].Default != "default.jfc" {
+		t.Errorf("JFR.start options = %+v", jfr.Options)
+	}
+	if h := catalog.Command("help"); len(h.Arguments) != 1 || h.Arguments[0].Name != "command name" {
+		t.Errorf("help arguments = %+v", h.Arguments)
+	}
+}
+
+func TestCatalogVersion(t *testing.T) {
+	props := map[string]string{
+		"java.vm.name":         "OpenJDK 64-Bit Server VM",
+		"java.vm.version":      "21.0.4+7-LTS",
+		"java.runtime.version": "21.0.4+7-LTS",
+	}
+	if got := catalogVersion(props); got != "OpenJDK 64-Bit Server VM 21.0.4+7-LTS 21.0.4+7-LTS" {
+		t.Errorf("catalogVersion() = %q", got)
+	}
+
+	// Unreadable properties must not share a cache entry
+	delete(props, "java.runtime.version")
+	if got := catalogVersion(props); got != "" {
+		t.Errorf("catalogVersion() without java.runtime.version = %q, want none", got)
+	}
+	if got := catalogVersion(nil); got != "" {
+		t.Errorf("catalogVersion(nil) = %q, want none", got)
+	}
+}
+
+func TestJcmdCatalogCheck(t *testing.T) {
+	names := []string{"GC.heap_dump", "GC.run", "JFR.start", "Thread.print", "help"}
+	helpAll, err := os.ReadFile("testdata/jcmd-help-all.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := parseJcmdHelpAll(string(helpAll), names)
+	catalog.Version = "OpenJDK 64-Bit Server VM 17.0.10+7 17.0.10+7"
+
+	tests := []struct {
+		args      []string
+		supported bool
+	}{
+		{nil, true},
+		{[]string{"help -all"}, true},
+		{[]string{"GC.run"}, true},
+		{[]string{"GC.run now"}, false},
+		{[]string{"GC.heap_dump", "-all", "/tmp/heap.hprof"}, true},
+		{[]string{"GC.heap_dump -gz=1 /tmp/heap.hprof"}, true},
+		{[]string{"GC.heap_dump", "/tmp/a", "/tmp/b"}, false},
+		{[]string{"GC.heap_dump -parallel=4 /tmp/heap.hprof"}, false},
+		{[]string{`JFR.start name=startup filename="/tmp/my recording.jfr"`}, true},
+		{[]string{"JFR.start", "unknown=1"}, false},
+		{[]string{"Thread.print -e"}, true},
+		{[]string{"VM.set_flag PrintGC true"}, false},
+	}
+	for _, tt := range tests {
+		err := catalog.Check(tt.args)
+		if tt.supported && err != nil {
+			t.Errorf("Check(%q): unexpected error %v", tt.args, err)
+		}
+		if !tt.supported && !errors.Is(err, ErrUnsupportedCommand) {
+			t.Errorf("Check(%q) = %v, want ErrUnsupportedCommand", tt.args, err)
+		}
+	}
+
+	// Without help -all, only command names are checked
+	names9 := &JcmdCatalog{Commands: []JcmdCommand{{Name: "Dump.java"}}}
+	if err := names9.Check([]string{"Dump.java /tmp/core.txt"}); err != nil {
+		t.Errorf("Check() on a catalog without details: %v", err)
+	}
+}
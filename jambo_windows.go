@@ -91,16 +91,56 @@ func getProcessInfo(pid int) (uid, gid, nspid int, err error) {
 	return 0, 0, pid, nil
 }
 
-func enterNamespace(pid int, nsType string) error {
+func joinNamespace(pid int, nsType string) (bool, error) {
 	// Windows doesn't have Linux namespaces
+	return false, nil
+}
+
+func getNamespaceIDs(pid, uid, gid int) (nsUid, nsGid int) {
+	return uid, gid
+}
+
+func checkAttachOwner(pid, nsUid int) error {
 	return nil
 }
 
+func sharesNamespace(pid int, nsType string) bool {
+	return true
+}
+
 func setCredentials(uid, gid int) error {
 	// Not applicable on Windows
 	return nil
 }
 
+func listJVMs() ([]VMInfo, error) {
+	return nil, errors.New("listing JVMs not supported on Windows")
+}
+
+func readCgroupPaths(pid int) ([]string, error) {
+	return nil, errors.New("cgroups not supported on Windows")
+}
+
+func readCmdline(pid int) []string {
+	return nil
+}
+
+func targetFilePath(pid int, path string) string {
+	return path
+}
+
+func openProcessHandle(pid int) (*processHandle, error) {
+	return &processHandle{pid: pid, pidfd: -1}, nil
+}
+
+func (h *processHandle) verify() error {
+	return nil
+}
+
+func (h *processHandle) close() error {
+	return nil
+}
+
 func getTempPath(pid int) (string, error) {
 	path := os.Getenv("JAMBO_ATTACH_PATH")
 	if path != "" {
@@ -111,13 +151,15 @@ func getTempPath(pid int) (string, error) {
 
 // hotSpot implements JVM interface for HotSpot JVM on Windows.
 // Uses remote thread injection technique to call JVM_EnqueueOperation.
-type hotSpot struct{}
+type hotSpot struct {
+	process *processHandle // unused on Windows
+}
 
 func (h *hotSpot) Type() JVMType {
 	return HotSpot
 }
 
-func (h *hotSpot) Detect(nspid int) bool {
+func (h *hotSpot) Detect(pid, nspid int) bool {
 	// On Windows, we always default to HotSpot
 	// OpenJ9 detection would require more complex logic
 	return true
@@ -147,26 +189,34 @@ func (h *hotSpot) Detect(nspid int) bool {
 // Error codes:
 //   - 1001: Could not load JVM module (jvm.dll)
 //   - 1002: Could not find JVM_EnqueueOperation function
-func (h *hotSpot) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func (h *hotSpot) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
+	if options.DryRun {
+		options.trace(TraceDryRun, nil, "would inject JVM_EnqueueOperation into process %d with args %q", pid, args)
+		return fmt.Sprintf("process: %d\nargs: %q\n", pid, args), nil
+	}
+
 	// Create named pipe for communication
 	pipeName, pipe, err := h.createPipe()
 	if err != nil {
 		return "", fmt.Errorf("failed to create pipe: %v", err)
 	}
 	defer windows.CloseHandle(pipe)
+	options.trace(TraceConnect, nil, "created pipe %s", pipeName)
 
 	// Inject remote thread into target process
 	if err := h.injectThread(pid, pipeName, args); err != nil {
 		return "", fmt.Errorf("failed to inject thread: %v", err)
 	}
+	options.trace(TraceSend, nil, "remote thread enqueued %q", args)
 
 	// Read response from pipe
 	output, err := h.readResponse(pipe)
 	if err != nil {
 		return "", fmt.Errorf("failed to read response: %v", err)
 	}
+	options.trace(TraceRecv, []byte(output), "read %d bytes from pipe", len(output))
 
-	if printOutput {
+	if options.PrintOutput {
 		fmt.Print(output)
 	}
 
@@ -373,6 +423,9 @@ func (h *hotSpot) allocateData(hProcess windows.Handle, pipeName string, args []
 
 	for i := 0; i < len(args) && i < 4; i++ {
 		if i < cmdArgs {
+			if len(args[i]) >= len(data.Args[i]) {
+				return 0, fmt.Errorf("%w: argument %d is %d bytes, limit %d", ErrRequestTooLarge, i, len(args[i]), len(data.Args[i])-1)
+			}
 			copy(data.Args[i][:], args[i]+"\x00")
 		}
 	}
@@ -546,28 +599,59 @@ func checkBitness(hProcess windows.Handle) error {
 }
 
 // openJ9 implements JVM interface for OpenJ9 JVM on Windows
-type openJ9 struct{}
+type openJ9 struct {
+	info    *OpenJ9Info
+	tmpDir  string
+	process *processHandle // unused on Windows
+}
 
 func (o *openJ9) Type() JVMType {
 	return OpenJ9
 }
 
-func (o *openJ9) Detect(nspid int) bool {
+func (o *openJ9) Detect(pid, nspid int) bool {
 	// OpenJ9 detection on Windows is not implemented
 	return false
 }
 
-func (o *openJ9) Attach(pid, nspid int, args []string, printOutput bool, tmpPath string) (string, error) {
+func detectOpenJ9(pid, nspid int, attachPath string) *openJ9 {
+	return nil
+}
+
+func (o *openJ9) Attach(pid, nspid int, args []string, options *Options, tmpPath string) (string, error) {
 	return "", errors.New("OpenJ9 attach not supported on Windows")
 }
 
-func (o *openJ9) translateCommand(args []string) string {
+func (o *openJ9) translateCommand(args []string) (string, error) {
 	if len(args) > 0 {
-		return args[0]
+		return args[0], nil
 	}
-	return ""
+	return "", nil
 }
 
 func (o *openJ9) unescapeString(s string) string {
 	return s
 }
+
+// Replay serves a recorded Session back to the client code in place of the JVM.
+type Replay struct{}
+
+func (s *Session) Replay(tmpPath string, nspid int) (*Replay, error) {
+	return nil, errors.New("session replay not supported on Windows")
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+func diagnose(pid int, options *Options) []Check {
+	return []Check{{Name: "platform", Status: CheckFail, Detail: "diagnostics not supported on Windows"}}
+}
+
+func cleanup(pid int, options *Options) ([]StaleFile, error) {
+	return nil, errors.New("cleanup not supported on Windows")
+}
+
+func readTargetFile(pid int, path string) ([]byte, error) {
+	return nil, errors.New("reading target files not supported on Windows")
+}
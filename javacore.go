@@ -0,0 +1,511 @@
+package jambo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Javacore is an OpenJ9 javacore file, the text dump written by datadump
+// (jcmd Dump.java). A javacore is made of sections of tagged lines, such
+// as "3XMTHREADINFO" or "4XESTACKTRACE"; the tags whose meaning is known
+// are parsed into the fields below, and every line is kept in Sections.
+type Javacore struct {
+	// Path is the file the javacore was written to, as the target sees
+	// it (1TIFILENAME).
+	Path string `json:"path,omitempty"`
+
+	// Date is the time of the dump, as written by the JVM (1TIDATETIME).
+	Date string `json:"date,omitempty"`
+
+	// Event describes what triggered the dump (1TISIGINFO).
+	Event string `json:"event,omitempty"`
+
+	// Environment holds the ENVINFO section.
+	Environment JavacoreEnvironment `json:"environment"`
+
+	// CurrentThread is the name of the thread that wrote the dump, if it
+	// is a Java thread (1XMCURTHDINFO).
+	CurrentThread string `json:"currentThread,omitempty"`
+
+	// Threads holds the threads of the THREADS section.
+	Threads []JavacoreThread `json:"threads"`
+
+	// Monitors holds the Java and system monitors of the LOCKS section.
+	Monitors []JavacoreMonitor `json:"monitors"`
+
+	// MemorySegments holds the memory segments of the MEMINFO section.
+	MemorySegments []JavacoreSegment `json:"memorySegments"`
+
+	// GCHistory holds the GC trace history of the MEMINFO section, most
+	// recent first, one event per entry.
+	GCHistory []string `json:"gcHistory"`
+
+	// NativeLibraries holds the native libraries loaded by class loaders,
+	// from the CLASSES section.
+	NativeLibraries []JavacoreLibrary `json:"nativeLibraries"`
+
+	// Sections holds every section in file order, including the parsed
+	// ones, for tags that have no field.
+	Sections []JavacoreSection `json:"sections"`
+}
+
+// JavacoreSection is a section of a javacore, started by a 0SECTION line.
+type JavacoreSection struct {
+	// Name is the section name, e.g. "THREADS".
+	Name string `json:"name"`
+
+	// Lines are the tagged lines of the section, without NULL lines.
+	Lines []JavacoreLine `json:"lines"`
+}
+
+// JavacoreLine is a tagged javacore line.
+type JavacoreLine struct {
+	Tag  string `json:"tag"`  // e.g. "3XMTHREADINFO"
+	Text string `json:"text"` // the rest of the line, trimmed
+}
+
+// JavacoreEnvironment is the ENVINFO section of a javacore.
+type JavacoreEnvironment struct {
+	JavaVersion string            `json:"javaVersion,omitempty"` // 1CIJAVAVERSION
+	VMVersion   string            `json:"vmVersion,omitempty"`   // 1CIVMVERSION
+	CommandLine string            `json:"commandLine,omitempty"` // 1CICMDLINE
+	JavaHome    string            `json:"javaHome,omitempty"`    // 1CIJAVAHOMEDIR
+	ProcessID   int               `json:"processId,omitempty"`   // 1CIPROCESSID, in the JVM's PID namespace
+	UserArgs    []string          `json:"userArgs,omitempty"`    // 2CIUSERARG, the options the JVM was created with
+	Variables   map[string]string `json:"variables,omitempty"`   // 2CIENVVAR
+}
+
+// JavacoreThread is a thread of the THREADS section.
+type JavacoreThread struct {
+	// Name is the thread name, or the description of a thread without a
+	// Java thread object, e.g. "Anonymous native thread".
+	Name string `json:"name"`
+
+	// VMThread is the address of the J9VMThread, empty for native
+	// threads.
+	VMThread string `json:"vmThread,omitempty"`
+
+	// State is the Java state code: R (runnable), CW (condition wait),
+	// B (blocked), P (parked), S (suspended), Z (zombie) and so on.
+	State string `json:"state,omitempty"`
+
+	// Priority is the Java priority.
+	Priority int `json:"priority,omitempty"`
+
+	// ID is the java.lang.Thread ID.
+	ID uint64 `json:"id,omitempty"`
+
+	// Daemon reports whether the thread is a daemon thread.
+	Daemon bool `json:"daemon,omitempty"`
+
+	// NativeID is the operating system thread ID.
+	NativeID uint64 `json:"nativeId,omitempty"`
+
+	// Blocker describes the monitor or object the thread waits for
+	// (3XMTHREADBLOCK), e.g. "Parked on: ... Owned by: <unknown>".
+	Blocker string `json:"blocker,omitempty"`
+
+	// Stack is the Java call stack, innermost frame first.
+	Stack []JavacoreFrame `json:"stack,omitempty"`
+
+	// NativeStack is the native call stack, innermost frame first.
+	NativeStack []string `json:"nativeStack,omitempty"`
+}
+
+// JavacoreFrame is a frame of a Java call stack.
+type JavacoreFrame struct {
+	// Location is the method and source position, e.g.
+	// "java/lang/Thread.sleep(Native Method)".
+	Location string `json:"location"`
+
+	// Locks describes the monitors the frame entered, e.g. "entered lock:
+	// java/lang/Object@0x00000000FFF04AD8, entry count: 1".
+	Locks []string `json:"locks,omitempty"`
+}
+
+// JavacoreMonitor is a monitor of the LOCKS section.
+type JavacoreMonitor struct {
+	// Object is the locked Java object, e.g.
+	// "java/lang/Object@0x00000000FFF04AD8", or the name and address of a
+	// system monitor.
+	Object string `json:"object"`
+
+	// System reports whether this is a JVM system monitor rather than a
+	// Java object monitor.
+	System bool `json:"system,omitempty"`
+
+	// Owner is the name of the owning thread, or empty if the monitor is
+	// not owned.
+	Owner string `json:"owner,omitempty"`
+
+	// EntryCount is the owner's recursion count.
+	EntryCount int `json:"entryCount,omitempty"`
+
+	// Waiting are the names of the threads waiting to enter the monitor.
+	Waiting []string `json:"waiting,omitempty"`
+
+	// Notify are the names of the threads waiting to be notified.
+	Notify []string `json:"notify,omitempty"`
+}
+
+// JavacoreSegment is a memory segment of the MEMINFO section.
+type JavacoreSegment struct {
+	Type  string `json:"type"`  // segment type, e.g. "Class Memory" (1STSEGTYPE)
+	ID    uint64 `json:"id"`    // address of the segment descriptor
+	Start uint64 `json:"start"` // first byte
+	Alloc uint64 `json:"alloc"` // allocation pointer
+	End   uint64 `json:"end"`   // end of the segment
+	Flags uint64 `json:"flags"` // J9 memory type flags
+	Size  uint64 `json:"size"`  // size in bytes
+}
+
+// JavacoreLibrary is a native library loaded by a class loader.
+type JavacoreLibrary struct {
+	Loader string `json:"loader"` // e.g. "*System*(0x00000000FFF0B0E8)"
+	Path   string `json:"path"`
+}
+
+var (
+	javacoreQuoted     = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	javacoreOwner      = regexp.MustCompile(`(?:owner|Flat locked by) "((?:[^"\\]|\\.)*)"`)
+	javacoreEntryCount = regexp.MustCompile(`entry count:? (\d+)`)
+	javacoreProcessID  = regexp.MustCompile(`^Process ID: (\d+)`)
+)
+
+// ParseJavacore parses an OpenJ9 javacore. Lines that do not start with a
+// tag are ignored, so that truncated or hand-edited files still parse; it
+// only fails if data contains no section at all.
+func ParseJavacore(data []byte) (*Javacore, error) {
+	jc := &Javacore{}
+
+	var section *JavacoreSection
+	var thread *JavacoreThread
+	var monitor *JavacoreMonitor
+	var segmentType, loader string
+	inCurrentThread := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		tag, text := splitJavacoreLine(scanner.Text())
+		if tag == "" || tag == "NULL" {
+			continue
+		}
+
+		if tag == "0SECTION" {
+			name, _, _ := strings.Cut(text, " ")
+			jc.Sections = append(jc.Sections, JavacoreSection{Name: name})
+			section = &jc.Sections[len(jc.Sections)-1]
+			thread, monitor = nil, nil
+			continue
+		}
+		if section == nil {
+			continue
+		}
+		section.Lines = append(section.Lines, JavacoreLine{Tag: tag, Text: text})
+
+		switch tag {
+		// TITLE
+		case "1TIDATETIME":
+			jc.Date = strings.TrimSpace(strings.TrimPrefix(text, "Date:"))
+		case "1TISIGINFO":
+			jc.Event = text
+		case "1TIFILENAME":
+			if _, path, ok := strings.Cut(text, ":"); ok {
+				jc.Path = strings.TrimSpace(path)
+			}
+
+		// ENVINFO
+		case "1CIJAVAVERSION":
+			jc.Environment.JavaVersion = text
+		case "1CIVMVERSION":
+			jc.Environment.VMVersion = text
+		case "1CICMDLINE":
+			jc.Environment.CommandLine = text
+		case "1CIJAVAHOMEDIR":
+			jc.Environment.JavaHome = strings.TrimSpace(strings.TrimPrefix(text, "Java Home Dir:"))
+		case "1CIPROCESSID":
+			if m := javacoreProcessID.FindStringSubmatch(text); m != nil {
+				jc.Environment.ProcessID, _ = strconv.Atoi(m[1])
+			}
+		case "2CIUSERARG":
+			jc.Environment.UserArgs = append(jc.Environment.UserArgs, text)
+		case "2CIENVVAR":
+			if name, value, ok := strings.Cut(text, "="); ok {
+				if jc.Environment.Variables == nil {
+					jc.Environment.Variables = make(map[string]string)
+				}
+				jc.Environment.Variables[name] = value
+			}
+
+		// MEMINFO
+		case "1STSEGTYPE":
+			segmentType = text
+		case "1STSEGMENT":
+			if segment, ok := parseJavacoreSegment(segmentType, text); ok {
+				jc.MemorySegments = append(jc.MemorySegments, segment)
+			}
+		case "3STHSTTYPE":
+			jc.GCHistory = append(jc.GCHistory, text)
+
+		// LOCKS
+		case "2LKMONINUSE":
+			jc.Monitors = append(jc.Monitors, JavacoreMonitor{})
+			monitor = &jc.Monitors[len(jc.Monitors)-1]
+		case "3LKMONOBJECT":
+			if monitor != nil {
+				parseJavacoreMonitor(monitor, text)
+			}
+		case "2LKREGMON":
+			jc.Monitors = append(jc.Monitors, JavacoreMonitor{System: true})
+			monitor = &jc.Monitors[len(jc.Monitors)-1]
+			parseJavacoreMonitor(monitor, text)
+		case "3LKWAITER":
+			if monitor != nil {
+				monitor.Waiting = append(monitor.Waiting, javacoreThreadName(text))
+			}
+		case "3LKWAITNOTIFY":
+			if monitor != nil {
+				monitor.Notify = append(monitor.Notify, javacoreThreadName(text))
+			}
+
+		// THREADS
+		case "1XMCURTHDINFO":
+			inCurrentThread = true
+		case "1XMTHDINFO":
+			inCurrentThread = false
+		case "3XMTHREADINFO":
+			if inCurrentThread {
+				if strings.HasPrefix(text, `"`) {
+					jc.CurrentThread = javacoreThreadName(text)
+				}
+				continue
+			}
+			jc.Threads = append(jc.Threads, parseJavacoreThread(text))
+			thread = &jc.Threads[len(jc.Threads)-1]
+		case "3XMJAVALTHREAD":
+			if thread != nil && !inCurrentThread {
+				parseJavacoreJavaThread(thread, text)
+			}
+		case "3XMTHREADINFO1":
+			if thread != nil && !inCurrentThread {
+				if id, ok := javacoreField(text, "native thread ID:"); ok {
+					thread.NativeID = id
+				}
+			}
+		case "3XMTHREADBLOCK":
+			if thread != nil && !inCurrentThread {
+				thread.Blocker = text
+			}
+		case "4XESTACKTRACE":
+			if thread != nil && !inCurrentThread {
+				thread.Stack = append(thread.Stack, JavacoreFrame{Location: strings.TrimPrefix(text, "at ")})
+			}
+		case "5XESTACKTRACE":
+			if thread != nil && !inCurrentThread && len(thread.Stack) > 0 {
+				frame := &thread.Stack[len(thread.Stack)-1]
+				frame.Locks = append(frame.Locks, strings.TrimSuffix(strings.TrimPrefix(text, "("), ")"))
+			}
+		case "4XENATIVESTACK":
+			if thread != nil && !inCurrentThread {
+				thread.NativeStack = append(thread.NativeStack, text)
+			}
+
+		// CLASSES
+		case "2CLTEXTCLLIB":
+			loader = strings.TrimSpace(strings.TrimPrefix(text, "Loader"))
+		case "3CLTEXTLIB":
+			jc.NativeLibraries = append(jc.NativeLibraries, JavacoreLibrary{Loader: loader, Path: text})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jc.Sections) == 0 {
+		return nil, fmt.Errorf("not a javacore: no 0SECTION line")
+	}
+	return jc, nil
+}
+
+// Section returns the section with the given name, or nil.
+func (jc *Javacore) Section(name string) *JavacoreSection {
+	for i := range jc.Sections {
+		if jc.Sections[i].Name == name {
+			return &jc.Sections[i]
+		}
+	}
+	return nil
+}
+
+// splitJavacoreLine splits a line into its tag and trimmed text. Tags start
+// with a digit, or are NULL.
+func splitJavacoreLine(line string) (tag, text string) {
+	tag, text = line, ""
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		tag, text = line[:i], line[i+1:]
+	}
+	if tag == "" || (tag != "NULL" && (tag[0] < '0' || tag[0] > '9')) {
+		return "", ""
+	}
+	return tag, strings.TrimSpace(text)
+}
+
+// parseJavacoreThread parses a 3XMTHREADINFO line, e.g.
+//
+//	"main" J9VMThread:0x00000000002D4E00, omrthread_t:0x00007F5C..., java/lang/Thread:0x00000000FFF2A1B8, state:CW, prio=5
+func parseJavacoreThread(text string) JavacoreThread {
+	if !strings.HasPrefix(text, `"`) {
+		return JavacoreThread{Name: text}
+	}
+	thread := JavacoreThread{Name: javacoreThreadName(text)}
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if i := strings.Index(field, "J9VMThread:"); i != -1 {
+			thread.VMThread = strings.TrimPrefix(field[i:], "J9VMThread:")
+		} else if state, ok := strings.CutPrefix(field, "state:"); ok {
+			thread.State = state
+		} else if prio, ok := strings.CutPrefix(field, "prio="); ok {
+			thread.Priority, _ = strconv.Atoi(prio)
+		}
+	}
+	return thread
+}
+
+// parseJavacoreJavaThread parses a 3XMJAVALTHREAD line, e.g.
+//
+//	(java/lang/Thread getId:0x1, isDaemon:false)
+func parseJavacoreJavaThread(thread *JavacoreThread, text string) {
+	if id, ok := javacoreField(text, "getId:"); ok {
+		thread.ID = id
+	}
+	thread.Daemon = strings.Contains(text, "isDaemon:true")
+}
+
+// parseJavacoreMonitor parses a 3LKMONOBJECT or 2LKREGMON line, e.g.
+//
+//	java/lang/Object@0x00000000FFF04AD8: owner "main" (J9VMThread:0x00000000002D4E00), entry count 1
+//	Thread global lock mutex lock (0x00007F5C8C00B3A8): <unowned>
+func parseJavacoreMonitor(monitor *JavacoreMonitor, text string) {
+	object, state, ok := strings.Cut(text, ": ")
+	if !ok {
+		monitor.Object = strings.TrimSuffix(text, ":")
+		return
+	}
+	monitor.Object = object
+	if m := javacoreOwner.FindStringSubmatch(state); m != nil {
+		monitor.Owner = m[1]
+	}
+	if m := javacoreEntryCount.FindStringSubmatch(state); m != nil {
+		monitor.EntryCount, _ = strconv.Atoi(m[1])
+	}
+}
+
+// parseJavacoreSegment parses a 1STSEGMENT line: the segment descriptor,
+// start, alloc and end addresses, type flags and size, all in hex.
+func parseJavacoreSegment(segmentType, text string) (JavacoreSegment, bool) {
+	fields := strings.Fields(text)
+	if len(fields) < 6 {
+		return JavacoreSegment{}, false
+	}
+	var values [6]uint64
+	for i := range values {
+		v, err := strconv.ParseUint(strings.TrimPrefix(fields[i], "0x"), 16, 64)
+		if err != nil {
+			return JavacoreSegment{}, false
+		}
+		values[i] = v
+	}
+	return JavacoreSegment{
+		Type:  segmentType,
+		ID:    values[0],
+		Start: values[1],
+		Alloc: values[2],
+		End:   values[3],
+		Flags: values[4],
+		Size:  values[5],
+	}, true
+}
+
+// javacoreThreadName returns the first quoted string of text.
+func javacoreThreadName(text string) string {
+	if m := javacoreQuoted.FindStringSubmatch(text); m != nil {
+		return m[1]
+	}
+	return text
+}
+
+// javacoreField returns the hex value following name in text, e.g. the
+// 0x1 of "getId:0x1,".
+func javacoreField(text, name string) (uint64, bool) {
+	_, rest, ok := strings.Cut(text, name)
+	if !ok {
+		return 0, false
+	}
+	rest = strings.TrimSpace(rest)
+	end := strings.IndexAny(rest, ",) ")
+	if end == -1 {
+		end = len(rest)
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(rest[:end], "0x"), 16, 64)
+	return v, err == nil
+}
+
+// javacorePathPattern matches the default javacore file name, for output
+// that does not have the usual "Dump written to" form.
+var javacorePathPattern = regexp.MustCompile(`\S*javacore\S*\.txt`)
+
+// Javacore makes an OpenJ9 JVM write a javacore with datadump (jcmd
+// Dump.java), then reads the file through the target's root directory and
+// parses it. The file is left in place, at the returned Javacore's Path.
+// HotSpot JVMs write no javacores; they fail with ErrUnsupportedCommand.
+//
+// Options may be nil; PrintOutput and Output are ignored. In DryRun mode
+// nothing is sent, so there is no javacore to read, and an error is
+// returned once the request has been traced.
+func (p *Process) Javacore(options *Options) (*Javacore, error) {
+	if jvm := p.detectInAttachPath(options); jvm == nil || jvm.Type() != OpenJ9 {
+		return nil, fmt.Errorf("%w: only OpenJ9 writes javacores", ErrUnsupportedCommand)
+	}
+	options = quietOptions(options)
+	output, err := p.Attach("datadump", nil, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		return nil, errors.New("dry run: no javacore was written")
+	}
+
+	path := javacorePath(output)
+	if path == "" {
+		return nil, fmt.Errorf("datadump did not report a javacore file: %q", strings.TrimSpace(output))
+	}
+	data, err := readTargetFile(p.pid, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read javacore: %w", err)
+	}
+	jc, err := ParseJavacore(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	jc.Path = path
+	return jc, nil
+}
+
+// javacorePath returns the file named in the output of datadump, such as
+// "Dump written to /app/javacore.20240101.120000.1.0001.txt", or "" if
+// there is none. The output may still be in the properties form of the
+// OpenJ9 diagnostics response.
+func javacorePath(output string) string {
+	output = diagnosticOutput(output)
+	if _, rest, ok := strings.Cut(output, "written to "); ok {
+		if fields := strings.Fields(rest); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return javacorePathPattern.FindString(output)
+}
@@ -0,0 +1,244 @@
+package jambo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxRequestSize is the largest attach request, in bytes, jambo sends to a
+// JVM. Larger requests fail with ErrRequestTooLarge instead of being cut
+// short.
+const MaxRequestSize = 8192
+
+// ErrRequestTooLarge indicates that an attach request exceeds
+// MaxRequestSize once encoded for the target JVM.
+var ErrRequestTooLarge = errors.New("attach request too large")
+
+// JcmdRequest builds a jcmd diagnostic command with its arguments, and
+// quotes them for the protocol of the target JVM when sent with
+// Process.Jcmd. Arguments may contain spaces; HotSpot receives them quoted,
+// as its diagnostic command parser expects. OpenJ9 separates arguments
+// with commas and has no quoting, so arguments containing a comma are
+// rejected for OpenJ9.
+//
+// For example, this starts a recording whose file name contains a space:
+//
+//	req := jambo.NewJcmdRequest("JFR.start").
+//		Option("name", "startup").
+//		Option("filename", "/tmp/my recording.jfr")
+//	output, err := proc.Jcmd(req, nil)
+type JcmdRequest struct {
+	command string
+	args    []jcmdArg
+}
+
+// jcmdArg is a positional argument (name empty), a name=value option, or a
+// flag such as -all (flag set).
+type jcmdArg struct {
+	name  string
+	value string
+	flag  bool
+}
+
+// NewJcmdRequest starts a request for the diagnostic command, e.g.
+// "GC.heap_dump" or "JFR.start".
+func NewJcmdRequest(command string) *JcmdRequest {
+	return &JcmdRequest{command: command}
+}
+
+// Arg appends a positional argument, such as the file name of
+// GC.heap_dump.
+func (r *JcmdRequest) Arg(value string) *JcmdRequest {
+	r.args = append(r.args, jcmdArg{value: value})
+	return r
+}
+
+// Option appends a name=value option, such as filename=/tmp/app.jfr.
+func (r *JcmdRequest) Option(name, value string) *JcmdRequest {
+	r.args = append(r.args, jcmdArg{name: name, value: value})
+	return r
+}
+
+// Flag appends an option given by name alone, such as -all or -l.
+func (r *JcmdRequest) Flag(name string) *JcmdRequest {
+	r.args = append(r.args, jcmdArg{name: name, flag: true})
+	return r
+}
+
+// Command returns the diagnostic command name.
+func (r *JcmdRequest) Command() string {
+	return r.command
+}
+
+// String returns the request as a HotSpot jcmd command line, or a
+// description of why it cannot be encoded.
+func (r *JcmdRequest) String() string {
+	line, err := r.hotSpotLine()
+	if err != nil {
+		return fmt.Sprintf("%s (%v)", r.command, err)
+	}
+	return line
+}
+
+// Encode returns the attach arguments that Process.Attach sends as the
+// "jcmd" command to a JVM of type jvm, quoted and separated as its protocol
+// requires. It fails if an argument cannot be represented, or with
+// ErrRequestTooLarge if the request would exceed MaxRequestSize.
+func (r *JcmdRequest) Encode(jvm JVMType) ([]string, error) {
+	if err := checkJcmdName(r.command); err != nil {
+		return nil, fmt.Errorf("command: %w", err)
+	}
+
+	if jvm == OpenJ9 {
+		// The management agent settings are sent as properties, one per
+		// line, rather than separated by commas
+		allowCommas := r.command == "ManagementAgent.start"
+		args := []string{r.command}
+		for _, arg := range r.args {
+			text, err := arg.openJ9(allowCommas)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, text)
+		}
+		// "ATTACH_DIAGNOSTICS:" + arguments joined by commas + NUL
+		size := len("ATTACH_DIAGNOSTICS:") + len(strings.Join(args, ",")) + 1
+		if size > MaxRequestSize {
+			return nil, fmt.Errorf("%w: %d bytes for OpenJ9, limit %d", ErrRequestTooLarge, size, MaxRequestSize)
+		}
+		return args, nil
+	}
+
+	line, err := r.hotSpotLine()
+	if err != nil {
+		return nil, err
+	}
+	// "1\0jcmd\0" + line + "\0" + two empty arguments
+	size := len("1\x00jcmd\x00") + len(line) + 3
+	if size > MaxRequestSize {
+		return nil, fmt.Errorf("%w: %d bytes for HotSpot, limit %d", ErrRequestTooLarge, size, MaxRequestSize)
+	}
+	return []string{line}, nil
+}
+
+// hotSpotLine returns the command and its arguments as one line, quoted
+// for HotSpot's DCmdArgIter.
+func (r *JcmdRequest) hotSpotLine() (string, error) {
+	var b strings.Builder
+	b.WriteString(r.command)
+	for _, arg := range r.args {
+		text, err := arg.hotSpot()
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(' ')
+		b.WriteString(text)
+	}
+	return b.String(), nil
+}
+
+// hotSpot returns the argument as HotSpot parses it: tokens are separated
+// by spaces, and a value may be enclosed in single or double quotes, which
+// HotSpot strips. There is no escape character, so a value can only be
+// quoted with a quote character it does not contain.
+func (a jcmdArg) hotSpot() (string, error) {
+	if a.name != "" {
+		if err := checkJcmdName(a.name); err != nil {
+			return "", fmt.Errorf("option %q: %w", a.name, err)
+		}
+		if a.flag {
+			return a.name, nil
+		}
+	}
+
+	// Without a name, an = would make HotSpot read the value as an option
+	value, err := quoteHotSpotValue(a.value, a.name == "")
+	if err != nil {
+		return "", fmt.Errorf("argument %q: %w", a.value, err)
+	}
+	if a.name != "" {
+		return a.name + "=" + value, nil
+	}
+	return value, nil
+}
+
+// openJ9 returns the argument as OpenJ9 expects it between commas. Commas
+// are left in if allowCommas is set.
+func (a jcmdArg) openJ9(allowCommas bool) (string, error) {
+	text := a.value
+	if a.name != "" {
+		if err := checkJcmdName(a.name); err != nil {
+			return "", fmt.Errorf("option %q: %w", a.name, err)
+		}
+		text = a.name
+		if !a.flag {
+			text += "=" + a.value
+		}
+	}
+	if !allowCommas && strings.ContainsRune(text, ',') {
+		return "", fmt.Errorf("argument %q: OpenJ9 cannot pass commas in jcmd arguments", text)
+	}
+	if strings.ContainsRune(text, 0) {
+		return "", fmt.Errorf("argument %q: contains a NUL byte", text)
+	}
+	return text, nil
+}
+
+// quoteHotSpotValue quotes value if it is empty, contains white space (or
+// an = if positional) or a quote anywhere, since HotSpot takes a quote
+// within a token as the start of a quoted section; double quotes are
+// preferred.
+// Line breaks cannot be quoted: HotSpot splits the jcmd line into commands
+// at newlines before it parses quotes.
+func quoteHotSpotValue(value string, positional bool) (string, error) {
+	if strings.ContainsRune(value, 0) {
+		return "", errors.New("contains a NUL byte")
+	}
+	if strings.ContainsAny(value, "\n\r") {
+		return "", errors.New("contains a line break")
+	}
+	special := " \t\"'"
+	if positional {
+		special += "="
+	}
+	if value != "" && !strings.ContainsAny(value, special) {
+		return value, nil
+	}
+	// A quote preceded by a backslash does not close the value
+	if strings.HasSuffix(value, `\`) {
+		return "", errors.New("a quoted value cannot end with a backslash")
+	}
+	for _, quote := range []string{`"`, `'`} {
+		if !strings.Contains(value, quote) {
+			return quote + value + quote, nil
+		}
+	}
+	return "", errors.New("contains both quote characters")
+}
+
+// checkJcmdName checks a command or option name, which neither JVM can
+// quote.
+func checkJcmdName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if strings.ContainsAny(name, " \t\n\r=,\"'\x00") {
+		return errors.New("invalid character in name")
+	}
+	return nil
+}
+
+// Jcmd runs the diagnostic command built by req, encoded for the target
+// JVM; see JcmdRequest. Options may be nil.
+func (p *Process) Jcmd(req *JcmdRequest, options *Options) (string, error) {
+	jvm := Unknown
+	if j := p.detectInAttachPath(options); j != nil {
+		jvm = j.Type()
+	}
+	args, err := req.Encode(jvm)
+	if err != nil {
+		return "", err
+	}
+	return p.Attach("jcmd", args, options)
+}
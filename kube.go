@@ -0,0 +1,214 @@
+package jambo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// KubePodLogDir is the kubelet's per-pod log directory. Its layout,
+	// <namespace>_<pod>_<uid>/<container>/, is used to map pod UIDs to names.
+	KubePodLogDir = "/var/log/pods"
+
+	// KubeContainerLogDir holds the kubelet's per-container log symlinks named
+	// <pod>_<namespace>_<container>-<containerID>.log, used to map container IDs to names.
+	KubeContainerLogDir = "/var/log/containers"
+
+	// ErrNotInPod indicates the process does not run in a Kubernetes pod.
+	ErrNotInPod = errors.New("process is not running in a kubernetes pod")
+)
+
+// KubeContainer identifies the Kubernetes container a process runs in.
+//
+// PodUID and ContainerID are always taken from the process's cgroup path.
+// Namespace, Pod and Container are resolved from the node's CRI log
+// directories and are empty when those directories are unavailable.
+type KubeContainer struct {
+	Namespace   string
+	Pod         string
+	PodUID      string
+	Container   string
+	ContainerID string
+}
+
+// String returns the container reference in <namespace>/<pod>/<container> form,
+// falling back to the pod UID and container ID when names are unknown.
+func (k *KubeContainer) String() string {
+	if k.Pod == "" {
+		return fmt.Sprintf("pod %s container %s", k.PodUID, k.ContainerID)
+	}
+	ref := k.Namespace + "/" + k.Pod
+	if k.Container != "" {
+		ref += "/" + k.Container
+	}
+	return ref
+}
+
+// KubeContainer returns the Kubernetes container the process runs in.
+// No API server is contacted; see KubeContainer for how names are resolved.
+//
+// Returns ErrNotInPod if the process's cgroups are not below kubepods.
+func (p *Process) KubeContainer() (*KubeContainer, error) {
+	return kubeContainerOf(p.pid)
+}
+
+// FindKubeJVMs returns the JVMs running in the container referenced by ref.
+//
+// ref has the form <namespace>/<pod>[/<container>]. Without a container
+// name, JVMs in every container of the pod are returned.
+func FindKubeJVMs(ref string) ([]VMInfo, error) {
+	namespace, pod, container, err := ParseKubeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := ListJVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []VMInfo
+	for _, vm := range vms {
+		kc, err := kubeContainerOf(vm.Pid)
+		if err != nil {
+			continue
+		}
+		if kc.Namespace == namespace && kc.Pod == pod && (container == "" || kc.Container == container) {
+			found = append(found, vm)
+		}
+	}
+	return found, nil
+}
+
+// ParseKubeRef splits a <namespace>/<pod>[/<container>] reference.
+func ParseKubeRef(ref string) (namespace, pod, container string, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("invalid kubernetes reference %q: expected <namespace>/<pod>[/<container>]", ref)
+	}
+	if len(parts) == 3 {
+		container = parts[2]
+	}
+	return parts[0], parts[1], container, nil
+}
+
+// kubeContainerOf resolves the Kubernetes container of the given process.
+func kubeContainerOf(pid int) (*KubeContainer, error) {
+	paths, err := readCgroupPaths(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		podUID, containerID, ok := parseKubepodsCgroup(path)
+		if !ok {
+			continue
+		}
+
+		kc := &KubeContainer{PodUID: podUID, ContainerID: containerID}
+		resolveKubeNames(kc, KubePodLogDir, KubeContainerLogDir)
+		return kc, nil
+	}
+
+	return nil, ErrNotInPod
+}
+
+// parseKubepodsCgroup extracts the pod UID and container ID from a cgroup path.
+//
+// Both cgroupfs and systemd driver layouts are recognized, for cgroup v1 and v2:
+//
+//	/kubepods/burstable/pod<uid>/<id>
+//	/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope
+//
+// The systemd driver replaces dashes in the pod UID with underscores; they are
+// restored. containerID is empty for the pod-level (sandbox) cgroup.
+func parseKubepodsCgroup(path string) (podUID, containerID string, ok bool) {
+	if !strings.Contains(path, "kubepods") {
+		return "", "", false
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segment = strings.TrimSuffix(segment, ".slice")
+
+		var uid string
+		if strings.HasPrefix(segment, "pod") {
+			uid = segment[len("pod"):]
+		} else if idx := strings.LastIndex(segment, "-pod"); idx != -1 && strings.HasPrefix(segment, "kubepods") {
+			uid = segment[idx+len("-pod"):]
+		} else {
+			continue
+		}
+		if uid == "" {
+			continue
+		}
+
+		podUID = strings.ReplaceAll(uid, "_", "-")
+		if i+1 < len(segments) {
+			containerID = parseContainerScope(segments[i+1])
+		}
+		return podUID, containerID, true
+	}
+
+	return "", "", false
+}
+
+// parseContainerScope strips runtime-specific decoration from a container cgroup name.
+func parseContainerScope(name string) string {
+	name = strings.TrimSuffix(name, ".scope")
+	if strings.HasPrefix(name, "crio-conmon-") {
+		return ""
+	}
+	for _, prefix := range []string{"cri-containerd-", "containerd-", "docker-", "crio-", "libpod-"} {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return name
+}
+
+// resolveKubeNames fills in the namespace, pod and container names of kc
+// from the kubelet's log directory layout.
+func resolveKubeNames(kc *KubeContainer, podLogDir, containerLogDir string) {
+	entries, err := os.ReadDir(podLogDir)
+	if err != nil {
+		return
+	}
+
+	var podDir string
+	for _, entry := range entries {
+		// Namespace and pod names are DNS labels and cannot contain '_'.
+		parts := strings.SplitN(entry.Name(), "_", 3)
+		if len(parts) == 3 && parts[2] == kc.PodUID {
+			kc.Namespace, kc.Pod = parts[0], parts[1]
+			podDir = filepath.Join(podLogDir, entry.Name())
+			break
+		}
+	}
+	if podDir == "" {
+		return
+	}
+
+	if kc.ContainerID != "" {
+		prefix := kc.Pod + "_" + kc.Namespace + "_"
+		suffix := "-" + kc.ContainerID + ".log"
+		if links, err := os.ReadDir(containerLogDir); err == nil {
+			for _, link := range links {
+				name := link.Name()
+				if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+					kc.Container = strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+					return
+				}
+			}
+		}
+	}
+
+	// A pod with a single container needs no container ID mapping.
+	containers, err := os.ReadDir(podDir)
+	if err == nil && len(containers) == 1 && containers[0].IsDir() {
+		kc.Container = containers[0].Name()
+	}
+}
@@ -0,0 +1,175 @@
+package jambo
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LocalConnectorAddressProperty is the agent property holding the JMX
+// service URL of the local management agent.
+const LocalConnectorAddressProperty = "com.sun.management.jmxremote.localConnectorAddress"
+
+// ManagementAgentOptions configures the remote JMX management agent started
+// by Process.StartManagementAgent. Settings that are not given keep the
+// JVM's defaults, which require authentication and SSL.
+type ManagementAgentOptions struct {
+	// Port is the JMX registry port (jmxremote.port). Required unless
+	// set in ConfigFile.
+	Port int
+
+	// RMIPort is the RMI connector port (jmxremote.rmi.port); 0 lets the
+	// JVM choose.
+	RMIPort int
+
+	// Host is the address to bind to (jmxremote.host); empty binds to
+	// all interfaces.
+	Host string
+
+	// ConfigFile is a management.properties file as the target sees it
+	// (config.file).
+	ConfigFile string
+
+	// Properties holds further settings by their jcmd name, without the
+	// com.sun.management. prefix, e.g. "jmxremote.authenticate": "false".
+	Properties map[string]string
+}
+
+// request returns the jcmd ManagementAgent.start request for the settings,
+// with options in a stable order. Values are passed as given, spaces
+// included.
+func (o *ManagementAgentOptions) request() *JcmdRequest {
+	req := NewJcmdRequest("ManagementAgent.start")
+	if o.ConfigFile != "" {
+		req.Option("config.file", o.ConfigFile)
+	}
+	if o.Host != "" {
+		req.Option("jmxremote.host", o.Host)
+	}
+	if o.Port != 0 {
+		req.Option("jmxremote.port", strconv.Itoa(o.Port))
+	}
+	if o.RMIPort != 0 {
+		req.Option("jmxremote.rmi.port", strconv.Itoa(o.RMIPort))
+	}
+	for _, name := range slices.Sorted(maps.Keys(o.Properties)) {
+		req.Option(name, o.Properties[name])
+	}
+	return req
+}
+
+// StartLocalManagementAgent starts the local JMX agent of the JVM, which
+// only accepts connections from the same host and user, and returns its
+// connector address, e.g. "service:jmx:rmi://127.0.0.1/stub/rO0...".
+// Starting an agent that is already running returns the existing address.
+//
+// This sends jcmd ManagementAgent.start_local to HotSpot and
+// ATTACH_START_LOCAL_MANAGEMENT_AGENT to OpenJ9, then reads the agent
+// properties. Options may be nil; PrintOutput and Output are ignored.
+func (p *Process) StartLocalManagementAgent(options *Options) (string, error) {
+	options = quietOptions(options)
+	if _, err := p.Attach("jcmd", []string{"ManagementAgent.start_local"}, options); err != nil {
+		return "", err
+	}
+	return p.localConnectorAddress(options)
+}
+
+// StartManagementAgent starts the remote JMX agent of the JVM with the
+// given settings, and returns the local connector address if the local
+// agent is running as well, or "" otherwise.
+//
+// This sends jcmd ManagementAgent.start to HotSpot and
+// ATTACH_START_MANAGEMENT_AGENT to OpenJ9, then reads the agent
+// properties. Options may be nil; PrintOutput and Output are ignored.
+func (p *Process) StartManagementAgent(agent *ManagementAgentOptions, options *Options) (string, error) {
+	if agent == nil {
+		agent = &ManagementAgentOptions{}
+	}
+	options = quietOptions(options)
+	if _, err := p.Jcmd(agent.request(), options); err != nil {
+		return "", err
+	}
+
+	address, err := p.localConnectorAddress(options)
+	if errors.Is(err, errNoLocalConnector) {
+		return "", nil
+	}
+	return address, err
+}
+
+// StopManagementAgent stops the remote JMX agent of the JVM with jcmd
+// ManagementAgent.stop. The local agent cannot be stopped. OpenJ9 has no
+// equivalent command, so this returns ErrUnsupportedCommand there.
+// Options may be nil; PrintOutput and Output are ignored.
+func (p *Process) StopManagementAgent(options *Options) error {
+	_, err := p.Attach("jcmd", []string{"ManagementAgent.stop"}, quietOptions(options))
+	return err
+}
+
+// ManagementAgentStatus returns the JVM's description of its management
+// agents, from jcmd ManagementAgent.status. OpenJ9 has no equivalent
+// command; there, the status is derived from the agent properties.
+// Options may be nil; PrintOutput and Output are ignored.
+func (p *Process) ManagementAgentStatus(options *Options) (string, error) {
+	options = quietOptions(options)
+	if p.detectInAttachPath(options).Type() != OpenJ9 {
+		return p.Attach("jcmd", []string{"ManagementAgent.status"}, options)
+	}
+
+	props, err := p.agentProperties(options)
+	if err != nil {
+		return "", err
+	}
+	var status strings.Builder
+	if address := props[LocalConnectorAddressProperty]; address != "" {
+		fmt.Fprintf(&status, "Agent: local\nConnection address: %s\n", address)
+	} else {
+		status.WriteString("Agent: local not started\n")
+	}
+	if port := props["com.sun.management.jmxremote.port"]; port != "" {
+		fmt.Fprintf(&status, "Agent: remote\nPort: %s\n", port)
+	}
+	return status.String(), nil
+}
+
+// errNoLocalConnector is returned by localConnectorAddress if the local
+// agent is not running.
+var errNoLocalConnector = errors.New("local management agent is not running")
+
+// localConnectorAddress reads the local connector address from the agent
+// properties.
+func (p *Process) localConnectorAddress(options *Options) (string, error) {
+	props, err := p.agentProperties(options)
+	if err != nil {
+		return "", err
+	}
+	address := props[LocalConnectorAddressProperty]
+	if address == "" {
+		return "", errNoLocalConnector
+	}
+	return address, nil
+}
+
+// agentProperties reads and parses the JVM's agent properties.
+func (p *Process) agentProperties(options *Options) (map[string]string, error) {
+	output, err := p.Attach("agentProperties", nil, options)
+	if err != nil {
+		return nil, err
+	}
+	return parseProperties([]byte(output)), nil
+}
+
+// quietOptions returns a copy of options that neither prints nor streams
+// the output of the commands used internally.
+func quietOptions(options *Options) *Options {
+	quiet := Options{}
+	if options != nil {
+		quiet = *options
+	}
+	quiet.PrintOutput = false
+	quiet.Output = nil
+	return &quiet
+}
@@ -0,0 +1,275 @@
+package jambo
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultParallelism is the number of targets AttachMany attaches to
+// concurrently when ManyOptions.Parallelism is not set.
+const DefaultParallelism = 4
+
+// ManyOptions configures the behavior of AttachMany.
+type ManyOptions struct {
+	// Options is applied to every target. Timeout is the per-target timeout.
+	// PrintOutput and Output are ignored, since output of concurrent
+	// attaches would interleave.
+	Options
+
+	// Parallelism bounds the number of targets attached concurrently.
+	// A value <= 0 means DefaultParallelism.
+	Parallelism int
+}
+
+// Result holds the outcome of an attach operation against a single target.
+type Result struct {
+	// Pid is the process ID of the target.
+	Pid int
+
+	// Output is the command output returned by the JVM.
+	Output string
+
+	// Err is the error that occurred while attaching, if any.
+	Err error
+
+	// Duration is the wall-clock time spent on this target.
+	Duration time.Duration
+}
+
+// AttachMany attaches to every target concurrently and executes the same
+// command in each of them.
+//
+// At most opts.Parallelism targets are processed at a time, and each one is
+// bounded by opts.Timeout. A target whose attach timed out keeps its slot
+// until the attach thread returns, so that hanging targets do not raise the
+// number of concurrent attaches; AttachMany itself does not wait for them.
+// Targets that have not been started when ctx is done are reported with
+// ctx.Err(). Duplicate PIDs are attached only once.
+//
+// Example:
+//
+//	results := jambo.AttachMany(ctx, []int{1234, 5678}, "threaddump", nil, &jambo.ManyOptions{
+//	    Options:     jambo.Options{Timeout: 10000},
+//	    Parallelism: 8,
+//	})
+//	for pid, r := range results {
+//	    if r.Err != nil {
+//	        log.Printf("%d: %v", pid, r.Err)
+//	    }
+//	}
+//
+// Returns the results keyed by PID; the map always contains every target.
+func AttachMany(ctx context.Context, targets []int, command string, args []string, opts *ManyOptions) map[int]Result {
+	if opts == nil {
+		opts = &ManyOptions{}
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultParallelism
+	}
+
+	options := opts.Options
+	options.PrintOutput = false
+	options.Output = nil
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[int]Result, len(targets))
+		seen    = make(map[int]bool, len(targets))
+		sem     = make(chan struct{}, parallelism)
+	)
+
+	for _, pid := range targets {
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			results[pid] = Result{Pid: pid, Err: ctx.Err()}
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(pid int) {
+			// The slot is held until the attach thread has finished, even
+			// if the result was given up on after a timeout
+			var threads sync.WaitGroup
+			defer func() {
+				threads.Wait()
+				<-sem
+			}()
+
+			opts := options
+			opts.threads = &threads
+			result := attachOne(ctx, pid, command, args, &opts)
+
+			mu.Lock()
+			results[pid] = result
+			mu.Unlock()
+			wg.Done()
+		}(pid)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// attachOne attaches to a single target on behalf of AttachMany.
+func attachOne(ctx context.Context, pid int, command string, args []string, options *Options) Result {
+	start := time.Now()
+	result := Result{Pid: pid}
+
+	proc, err := NewProcess(pid)
+	if err != nil {
+		result.Err = err
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	result.Output, result.Err = proc.AttachContext(ctx, command, args, options)
+	result.Duration = time.Since(start)
+	return result
+}
+
+// VMInfo describes a JVM process discovered on the local machine.
+type VMInfo struct {
+	// Pid is the process ID of the JVM.
+	Pid int `json:"pid"`
+
+	// MainClass is the main class, jar file or module of the application,
+	// as given on the java command line.
+	MainClass string `json:"mainClass"`
+
+	// CommandLine is the full command line of the process.
+	CommandLine []string `json:"commandLine"`
+}
+
+// ListJVMs returns all JVM processes visible to the caller.
+//
+// Returns an error if process enumeration is not supported on this platform.
+func ListJVMs() ([]VMInfo, error) {
+	return listJVMs()
+}
+
+// SelectJVMs returns the JVM processes matching selector.
+// See VMInfo.Matches for the selector syntax.
+func SelectJVMs(selector string) ([]VMInfo, error) {
+	vms, err := ListJVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []VMInfo
+	for _, vm := range vms {
+		if vm.Matches(selector) {
+			selected = append(selected, vm)
+		}
+	}
+	return selected, nil
+}
+
+// Matches reports whether the JVM matches selector.
+//
+// Supported selectors:
+//   - "*" or "all": every JVM
+//   - a decimal number: the JVM with that PID
+//   - anything else: a glob pattern (see filepath.Match) matched against the
+//     main class, its simple name, or the base name of the main jar
+func (vm VMInfo) Matches(selector string) bool {
+	if selector == "*" || selector == "all" {
+		return true
+	}
+
+	if pid, err := strconv.Atoi(selector); err == nil {
+		return vm.Pid == pid
+	}
+
+	candidates := []string{vm.MainClass, filepath.Base(vm.MainClass)}
+	if idx := strings.LastIndex(vm.MainClass, "."); idx != -1 && !strings.HasSuffix(vm.MainClass, ".jar") {
+		candidates = append(candidates, vm.MainClass[idx+1:])
+	}
+
+	for _, candidate := range candidates {
+		if ok, _ := filepath.Match(selector, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// javaOptionsWithValue lists launcher options that take their value
+// as a separate argument.
+var javaOptionsWithValue = map[string]bool{
+	"-cp":                    true,
+	"-classpath":             true,
+	"--class-path":           true,
+	"-p":                     true,
+	"--module-path":          true,
+	"--upgrade-module-path":  true,
+	"--add-modules":          true,
+	"--limit-modules":        true,
+	"--add-reads":            true,
+	"--add-exports":          true,
+	"--add-opens":            true,
+	"--patch-module":         true,
+	"--enable-native-access": true,
+	"--source":               true,
+}
+
+// parseMainClass extracts the main class, jar or module from a java command line.
+// It returns an empty string if none can be found.
+func parseMainClass(cmdline []string) string {
+	for i := 1; i < len(cmdline); i++ {
+		arg := cmdline[i]
+
+		switch {
+		case arg == "-jar" || arg == "-m" || arg == "--module":
+			if i+1 < len(cmdline) {
+				return cmdline[i+1]
+			}
+			return ""
+		case strings.HasPrefix(arg, "--module="):
+			return strings.TrimPrefix(arg, "--module=")
+		case javaOptionsWithValue[arg]:
+			i++
+		case strings.HasPrefix(arg, "-"):
+			// Option with an attached value, e.g. -Xmx1g or -Dkey=value
+		default:
+			return arg
+		}
+	}
+	return ""
+}
+
+// launcherOptions returns the JVM options of a java command line: the
+// arguments after the launcher, up to the main class, jar or module.
+func launcherOptions(cmdline []string) []string {
+	for i := 1; i < len(cmdline); i++ {
+		arg := cmdline[i]
+
+		switch {
+		case arg == "-jar" || arg == "-m" || arg == "--module" || strings.HasPrefix(arg, "--module="):
+			return cmdline[1:i]
+		case javaOptionsWithValue[arg]:
+			i++
+		case strings.HasPrefix(arg, "-"):
+		default:
+			return cmdline[1:i]
+		}
+	}
+	if len(cmdline) == 0 {
+		return nil
+	}
+	return cmdline[1:]
+}
@@ -0,0 +1,264 @@
+package jambo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OpenJ9Info is the advertisement an OpenJ9 JVM publishes in its
+// .com_ibm_tools_attach/{id}/attachInfo file.
+type OpenJ9Info struct {
+	// VMID is the attach ID of the JVM, its PID unless set with
+	// -Dcom.ibm.tools.attach.id.
+	VMID string `json:"vmId"`
+
+	// DisplayName is the name shown by tools, usually the main class,
+	// set with -Dcom.ibm.tools.attach.displayName.
+	DisplayName string `json:"displayName"`
+
+	// ProcessID is the PID of the JVM in its own PID namespace.
+	ProcessID int `json:"processId"`
+
+	// UID is the user ID of the JVM in its own user namespace, or -1 if
+	// the file does not record it.
+	UID int `json:"uid"`
+
+	// Version is the attach API version of the JVM.
+	Version string `json:"version"`
+}
+
+// javaOptionVariables are the environment variables whose options a JVM
+// reads in addition to its command line, in the order they are applied.
+// JDK_JAVA_OPTIONS is expanded by the launcher and does not appear in
+// /proc/{pid}/cmdline.
+var javaOptionVariables = []string{"JAVA_TOOL_OPTIONS", "OPENJ9_JAVA_OPTIONS", "IBM_JAVA_OPTIONS", "JDK_JAVA_OPTIONS"}
+
+// javaOptions returns the JVM options given through environ, a list of
+// NAME=value entries, followed by those on the command line, so that the
+// last occurrence of an option is the one in effect.
+func javaOptions(environ, cmdline []string) []string {
+	var options []string
+	for _, name := range javaOptionVariables {
+		for _, entry := range environ {
+			if value, ok := strings.CutPrefix(entry, name+"="); ok {
+				options = append(options, splitJavaOptions(value)...)
+			}
+		}
+	}
+	return append(options, launcherOptions(cmdline)...)
+}
+
+// splitJavaOptions splits the value of an options variable at white
+// space. Single or double quotes group white space into one option, as the
+// JVM allows.
+func splitJavaOptions(value string) []string {
+	var options []string
+	var current strings.Builder
+	var quote rune
+	inOption := false
+	for _, r := range value {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+			inOption = true
+		case quote == 0 && (r == ' ' || r == '\t' || r == '\n'):
+			if inOption {
+				options = append(options, current.String())
+				current.Reset()
+				inOption = false
+			}
+		default:
+			current.WriteRune(r)
+			inOption = true
+		}
+	}
+	if inOption {
+		options = append(options, current.String())
+	}
+	return options
+}
+
+// systemProperty returns the value of the last -D{name}= option.
+func systemProperty(options []string, name string) (string, bool) {
+	value, found := "", false
+	for _, option := range options {
+		if v, ok := strings.CutPrefix(option, "-D"+name+"="); ok {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// openJ9AttachDirectories returns the attach directory an OpenJ9 JVM was
+// configured with through com.ibm.tools.attach.directory, and the
+// java.io.tmpdir it would otherwise be created in. Both are paths as the
+// JVM sees them, and empty if not set.
+func openJ9AttachDirectories(options []string) (directory, tmpDir string) {
+	directory, _ = systemProperty(options, "com.ibm.tools.attach.directory")
+	tmpDir, _ = systemProperty(options, "java.io.tmpdir")
+	return directory, tmpDir
+}
+
+// parseAttachInfo parses an attachInfo file, which is written as Java
+// properties.
+func parseAttachInfo(data []byte) (*OpenJ9Info, error) {
+	props := parseProperties(data)
+
+	info := &OpenJ9Info{
+		VMID:        props["vmId"],
+		DisplayName: props["displayName"],
+		UID:         -1,
+		Version:     props["version"],
+	}
+	if info.VMID == "" {
+		return nil, fmt.Errorf("attachInfo has no vmId")
+	}
+
+	pid, err := strconv.Atoi(props["processId"])
+	if err != nil {
+		return nil, fmt.Errorf("attachInfo has an invalid processId %q", props["processId"])
+	}
+	info.ProcessID = pid
+
+	if value, ok := props["userUid"]; ok {
+		uid, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("attachInfo has an invalid userUid %q", value)
+		}
+		info.UID = uid
+	}
+
+	return info, nil
+}
+
+// diagnosticOutput returns the text of an ATTACH_DIAGNOSTICS response,
+// which OpenJ9 sends as the openj9_diagnostics.string_result property and
+// Attach only unescapes when printing. Other output is returned unchanged.
+func diagnosticOutput(output string) string {
+	if !strings.Contains(output, "openj9_diagnostics.string_result=") {
+		return output
+	}
+	return parseProperties([]byte(output))["openj9_diagnostics.string_result"]
+}
+
+// managementAgentProperties converts ManagementAgent.start arguments, such
+// as jmxremote.port=9999, into the agent properties OpenJ9 expects after
+// ATTACH_START_MANAGEMENT_AGENT, in java.util.Properties format. Like jcmd,
+// it adds the com.sun.management. prefix.
+func managementAgentProperties(args []string) string {
+	var b strings.Builder
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		b.WriteString(escapeProperty("com.sun.management." + name))
+		b.WriteByte('=')
+		b.WriteString(escapeProperty(value))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// escapeProperty escapes a properties key or value so that
+// java.util.Properties.load reads it back unchanged.
+func escapeProperty(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\' || r == '=' || r == ':' || r == '#' || r == '!':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == ' ' && i == 0:
+			b.WriteString(`\ `)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r > 0x7e:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseProperties parses the subset of the Java properties format written
+// by java.util.Properties.store: one key=value or key:value pair per line,
+// comments starting with # or !, and backslash escapes. Continuation lines
+// are not supported.
+func parseProperties(data []byte) map[string]string {
+	props := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		// The key ends at the first unescaped separator
+		end := len(line)
+		for i := 0; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+				continue
+			}
+			if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' {
+				end = i
+				break
+			}
+		}
+		key := unescapeProperty(line[:end])
+		value := strings.TrimLeft(line[end:], " \t\f")
+		if value != "" && (value[0] == '=' || value[0] == ':') {
+			value = strings.TrimLeft(value[1:], " \t\f")
+		}
+		props[key] = unescapeProperty(value)
+	}
+
+	return props
+}
+
+// unescapeProperty resolves the backslash escapes of a properties key or
+// value, including \uXXXX.
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if r, err := strconv.ParseUint(s[i+1:min(i+5, len(s))], 16, 32); err == nil && i+5 <= len(s) {
+				b.WriteRune(rune(r))
+				i += 4
+			} else {
+				b.WriteByte('u')
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
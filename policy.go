@@ -0,0 +1,340 @@
+package jambo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ErrPolicyDenied indicates the attach operation was rejected by the Policy
+// before anything was sent to the target. The concrete error is a *PolicyError.
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// Policy actions.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// ReadOnlyPreset is the name of the built-in read-only policy.
+// See ReadOnlyPolicy for what it permits.
+const ReadOnlyPreset = "read-only"
+
+// Policy decides which attach operations may be performed.
+//
+// Rules are evaluated in order and the first matching rule decides.
+// If no rule matches, the rules of Preset are evaluated, and then Default
+// applies. A Policy is typically loaded from a JSON file with LoadPolicy:
+//
+//	{
+//	    "preset": "read-only",
+//	    "rules": [
+//	        {"action": "allow", "commands": ["dumpheap", "jcmd:GC.heap_dump"], "uids": [0]},
+//	        {"action": "deny", "targets": ["com.example.Payments*"]}
+//	    ]
+//	}
+type Policy struct {
+	// Preset names a built-in policy whose rules follow Rules (e.g. "read-only").
+	Preset string `json:"preset,omitempty"`
+
+	// Default is the action when no rule matches: "allow" or "deny".
+	// Empty means the default of Preset, or "allow" without a preset.
+	Default string `json:"default,omitempty"`
+
+	// Rules are evaluated in order; the first match decides.
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches attach operations by command, target and caller.
+// Empty match lists match everything.
+type PolicyRule struct {
+	// Name identifies the rule in denial errors.
+	Name string `json:"name,omitempty"`
+
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+
+	// Commands lists attach commands (e.g. "load", "setflag") or jcmd
+	// subcommands written as "jcmd:<Subcommand>" (e.g. "jcmd:VM.set_flag").
+	// Plain "jcmd" matches every jcmd subcommand. Glob patterns are
+	// accepted, e.g. "jcmd:JFR.*".
+	Commands []string `json:"commands,omitempty"`
+
+	// Targets lists target selectors; see VMInfo.Matches for the syntax.
+	Targets []string `json:"targets,omitempty"`
+
+	// UIDs lists the calling user IDs the rule applies to.
+	UIDs []int `json:"uids,omitempty"`
+
+	// args restricts the arguments of the listed commands: such a command
+	// only matches if each of its arguments matches one of the patterns.
+	// Used by presets.
+	args map[string][]string
+}
+
+// PolicyError describes an operation rejected by a Policy.
+// It matches ErrPolicyDenied with errors.Is.
+type PolicyError struct {
+	Pid     int    // target process ID
+	UID     int    // calling user ID
+	Command string // command, with the jcmd subcommand if any (e.g. "jcmd:VM.set_flag")
+	Rule    string // name or index of the deciding rule, or "default"
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%v: %s on process %d for uid %d (rule %s)", ErrPolicyDenied, e.Command, e.Pid, e.UID, e.Rule)
+}
+
+// Is reports whether target is ErrPolicyDenied.
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrPolicyDenied
+}
+
+// readOnlyCommands are the operations permitted by the read-only preset.
+// None of them changes VM state, loads code or writes files in the target;
+// commands that could are limited to the arguments in readOnlyArgs.
+var readOnlyCommands = []string{
+	"properties",
+	"agentProperties",
+	"threaddump",
+	"inspectheap",
+	"printflag",
+	"jcmd:help",
+	"jcmd:Thread.print",
+	"jcmd:GC.class_histogram",
+	"jcmd:GC.heap_info",
+	"jcmd:VM.version",
+	"jcmd:VM.uptime",
+	"jcmd:VM.flags",
+	"jcmd:VM.command_line",
+	"jcmd:VM.system_properties",
+	"jcmd:VM.info",
+	"jcmd:VM.metaspace",
+	"jcmd:VM.classloader_stats",
+	"jcmd:VM.native_memory",
+	"jcmd:VM.stringtable",
+	"jcmd:VM.symboltable",
+	"jcmd:Compiler.codecache",
+	"jcmd:JFR.check",
+	"jcmd:ManagementAgent.status",
+}
+
+// readOnlyArgs are the only arguments the read-only preset accepts for
+// commands that otherwise write a file (inspectheap's filename), force a
+// full GC (-live) or change the VM's state (native memory tracking's
+// baseline and shutdown).
+var readOnlyArgs = map[string][]string{
+	"inspectheap":             {"-all"},
+	"jcmd:GC.class_histogram": {"-all", "-parallel=*"},
+	"jcmd:VM.native_memory":   {"summary", "detail", "summary.diff", "detail.diff", "statistics", "scale=*"},
+}
+
+// ReadOnlyPolicy returns the built-in read-only policy. It allows commands
+// that only inspect the JVM (thread dumps, histograms, properties, flags and
+// informational jcmd subcommands) and denies everything else, including
+// load, setflag, dumpheap and datadump.
+func ReadOnlyPolicy() *Policy {
+	return &Policy{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{Name: ReadOnlyPreset, Action: PolicyAllow, Commands: readOnlyCommands, args: readOnlyArgs},
+		},
+	}
+}
+
+// LoadPolicy reads a Policy from a JSON file. As a shortcut, the name of a
+// built-in preset (e.g. "read-only") may be given instead of a path.
+func LoadPolicy(path string) (*Policy, error) {
+	if path == ReadOnlyPreset {
+		return ReadOnlyPolicy(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+// validate checks actions and preset names.
+func (pol *Policy) validate() error {
+	if pol.Preset != "" && pol.Preset != ReadOnlyPreset {
+		return fmt.Errorf("unknown preset %q", pol.Preset)
+	}
+	if pol.Default != "" && pol.Default != PolicyAllow && pol.Default != PolicyDeny {
+		return fmt.Errorf("invalid default action %q", pol.Default)
+	}
+	for i, rule := range pol.Rules {
+		if rule.Action != PolicyAllow && rule.Action != PolicyDeny {
+			return fmt.Errorf("rule %d: invalid action %q", i, rule.Action)
+		}
+	}
+	return nil
+}
+
+// Check decides whether uid may run command with args against target.
+//
+// A jcmd line may hold several commands separated by newlines, which
+// HotSpot runs one after the other; each of them must be allowed. Empty
+// lines are rejected.
+//
+// Returns nil if the operation is allowed, or a *PolicyError otherwise.
+func (pol *Policy) Check(target VMInfo, uid int, command string, args []string) error {
+	commands, ok := policyCommands(command, args)
+	if !ok {
+		return &PolicyError{Pid: target.Pid, UID: uid, Command: "jcmd", Rule: "empty command line"}
+	}
+	for _, cmd := range commands {
+		if err := pol.check(target, uid, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyCommand is one command of an operation, as named in policy rules,
+// with its arguments.
+type policyCommand struct {
+	name string
+	args []string
+}
+
+// check decides on one command of an operation.
+func (pol *Policy) check(target VMInfo, uid int, cmd policyCommand) error {
+	rules := pol.Rules
+	def := pol.Default
+	if pol.Preset == ReadOnlyPreset {
+		preset := ReadOnlyPolicy()
+		rules = append(append([]PolicyRule(nil), rules...), preset.Rules...)
+		if def == "" {
+			def = preset.Default
+		}
+	}
+
+	for i, rule := range rules {
+		if !rule.matches(target, uid, cmd) {
+			continue
+		}
+		if rule.Action == PolicyAllow {
+			return nil
+		}
+
+		ruleName := rule.Name
+		if ruleName == "" {
+			ruleName = fmt.Sprintf("#%d", i)
+		}
+		return &PolicyError{Pid: target.Pid, UID: uid, Command: cmd.name, Rule: ruleName}
+	}
+
+	if def == PolicyDeny {
+		return &PolicyError{Pid: target.Pid, UID: uid, Command: cmd.name, Rule: "default"}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the command.
+func (rule *PolicyRule) matches(target VMInfo, uid int, cmd policyCommand) bool {
+	if len(rule.UIDs) > 0 && !containsInt(rule.UIDs, uid) {
+		return false
+	}
+
+	if len(rule.Targets) > 0 {
+		matched := false
+		for _, selector := range rule.Targets {
+			if target.Matches(selector) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Commands) > 0 {
+		matched := false
+		for _, pattern := range rule.Commands {
+			if matchCommand(pattern, cmd.name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if accepted, ok := rule.args[cmd.name]; ok {
+		for _, arg := range cmd.args {
+			if !slices.ContainsFunc(accepted, func(pattern string) bool {
+				ok, _ := path.Match(pattern, arg)
+				return ok
+			}) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// policyCommands returns the commands policies match: the command itself,
+// or "jcmd:<Subcommand>" for each line of a jcmd request. The line is
+// built from args as it is sent, joined with spaces, and split on newlines
+// as HotSpot does. Empty arguments are dropped. It reports false if the
+// request is empty or has an empty line.
+func policyCommands(command string, args []string) ([]policyCommand, bool) {
+	if command != "jcmd" {
+		var fields []string
+		for _, arg := range args {
+			if arg != "" {
+				fields = append(fields, arg)
+			}
+		}
+		return []policyCommand{{name: command, args: fields}}, true
+	}
+
+	var commands []policyCommand
+	for _, line := range strings.Split(strings.Join(args, " "), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, false
+		}
+		commands = append(commands, policyCommand{name: "jcmd:" + fields[0], args: fields[1:]})
+	}
+	return commands, true
+}
+
+// matchCommand matches a rule command pattern against a policy command name.
+// A pattern of "jcmd" matches every jcmd subcommand.
+func matchCommand(pattern, name string) bool {
+	if pattern == "*" || pattern == name {
+		return true
+	}
+	if pattern == "jcmd" && strings.HasPrefix(name, "jcmd:") {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func containsInt(list []int, v int) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
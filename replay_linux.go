@@ -0,0 +1,229 @@
+//go:build linux
+
+package jambo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayTimeout bounds each wait of the fake JVM for the client.
+const replayTimeout = 10 * time.Second
+
+// Replay serves a recorded Session back to the client code in place of the JVM.
+type Replay struct {
+	session  *Session
+	listener net.Listener // HotSpot attach socket
+	done     chan struct{}
+	result   chan error
+}
+
+// Replay starts a fake JVM that answers with the recorded responses.
+//
+// tmpPath is used as the attach directory and nspid as the target's
+// namespace PID; the client must attach with the same values. For HotSpot a
+// listener is created at tmpPath/.java_pid<nspid>, which serves each
+// recorded connection in turn, such as the getversion probe before a
+// protocol version 2 request. For OpenJ9 the attach directory is populated
+// and the fake JVM connects back once the client writes replyInfo. The live
+// requests are compared with the recorded ones and any difference is
+// reported by Close.
+//
+// Example:
+//
+//	session, _ := jambo.LoadSession("testdata/hotspot-threaddump.json")
+//	replay, _ := session.Replay(dir, session.NsPid)
+//	output, err := jvm.Attach(pid, session.NsPid, args, &jambo.Options{}, dir)
+//	if err := replay.Close(); err != nil {
+//	    // the client sent something other than what was recorded
+//	}
+func (s *Session) Replay(tmpPath string, nspid int) (*Replay, error) {
+	r := &Replay{
+		session: s,
+		done:    make(chan struct{}),
+		result:  make(chan error, 1),
+	}
+
+	switch s.JVM {
+	case HotSpot.String():
+		listener, err := net.Listen("unix", fmt.Sprintf("%s/.java_pid%d", tmpPath, nspid))
+		if err != nil {
+			return nil, err
+		}
+		r.listener = listener
+		go func() { r.result <- r.serveHotSpot() }()
+	case OpenJ9.String():
+		if err := r.prepareOpenJ9(tmpPath, nspid); err != nil {
+			return nil, err
+		}
+		go func() { r.result <- r.serveOpenJ9(tmpPath, nspid) }()
+	default:
+		return nil, fmt.Errorf("cannot replay session of JVM type %q", s.JVM)
+	}
+
+	return r, nil
+}
+
+// Close stops the fake JVM and returns the first mismatch between the live
+// exchange and the recording, if any.
+func (r *Replay) Close() error {
+	close(r.done)
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	return <-r.result
+}
+
+// serveHotSpot accepts a connection for each recorded one, checks its
+// request and plays back its response.
+func (r *Replay) serveHotSpot() error {
+	for i, events := range r.session.connections() {
+		if err := r.serveHotSpotConn(i+1, events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveHotSpotConn serves recorded connection n.
+func (r *Replay) serveHotSpotConn(n int, events []SessionEvent) error {
+	conn, err := r.listener.Accept()
+	if err != nil {
+		return fmt.Errorf("replay: no connection %d: %v", n, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replayTimeout))
+
+	expected := sent(events)
+	request := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return fmt.Errorf("replay: reading request on connection %d: %v", n, err)
+	}
+	if !bytes.Equal(request, expected) {
+		return fmt.Errorf("replay: request %q on connection %d does not match recorded %q", request, n, expected)
+	}
+
+	return r.playResponses(conn, events)
+}
+
+// prepareOpenJ9 creates the attach directory entries the client looks for.
+func (r *Replay) prepareOpenJ9(tmpPath string, nspid int) error {
+	dir := fmt.Sprintf("%s/.com_ibm_tools_attach/%d", tmpPath, nspid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	attachInfo := fmt.Sprintf("#attachInfo\nvmId=%d\ndisplayName=replay\nprocessId=%d\nuserUid=%d\nversion=0x60000\n", nspid, nspid, os.Geteuid())
+	if err := os.WriteFile(dir+"/attachInfo", []byte(attachInfo), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(tmpPath+"/.com_ibm_tools_attach/_notifier", nil, 0644)
+}
+
+// serveOpenJ9 waits for replyInfo, connects back like the JVM would,
+// checks the command and plays back the response.
+func (r *Replay) serveOpenJ9(tmpPath string, nspid int) error {
+	replyInfo := fmt.Sprintf("%s/.com_ibm_tools_attach/%d/replyInfo", tmpPath, nspid)
+	deadline := time.Now().Add(replayTimeout)
+
+	var key string
+	var port int
+	for {
+		data, err := os.ReadFile(replyInfo)
+		if err == nil {
+			lines := strings.Split(string(data), "\n")
+			if len(lines) >= 2 {
+				key = lines[0]
+				port, err = strconv.Atoi(lines[1])
+				if err == nil {
+					break
+				}
+			}
+		}
+
+		select {
+		case <-r.done:
+			return errors.New("replay: client never wrote replyInfo")
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return errors.New("replay: timeout waiting for replyInfo")
+		}
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("replay: connecting back: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replayTimeout))
+
+	if _, err := fmt.Fprintf(conn, "ATTACH_CONNECTED %s \x00", key); err != nil {
+		return fmt.Errorf("replay: handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadBytes(0)
+	if err != nil {
+		return fmt.Errorf("replay: reading command: %v", err)
+	}
+
+	conns := r.session.connections()
+	if len(conns) == 0 {
+		return errors.New("replay: no connection was recorded")
+	}
+	events := conns[0]
+
+	var expected []byte
+	for _, event := range events {
+		if event.Step == TraceSend {
+			expected = event.Data
+			break
+		}
+	}
+	if !bytes.Equal(command, expected) {
+		return fmt.Errorf("replay: command %q does not match recorded %q", command, expected)
+	}
+
+	if err := r.playResponses(conn, events); err != nil {
+		return err
+	}
+
+	// The client detaches after a successful command; acknowledge it.
+	if _, err := reader.ReadBytes(0); err == nil {
+		conn.Write([]byte("ATTACH_ACK\x00"))
+	}
+	return nil
+}
+
+// playResponses writes the responses recorded in events, keeping the
+// recorded gaps between consecutive chunks.
+func (r *Replay) playResponses(conn net.Conn, events []SessionEvent) error {
+	var last time.Duration = -1
+	for _, event := range events {
+		if event.Step != TraceRecv {
+			continue
+		}
+
+		if last >= 0 && event.Offset > last {
+			select {
+			case <-r.done:
+				return nil
+			case <-time.After(event.Offset - last):
+			}
+		}
+		last = event.Offset
+
+		if _, err := conn.Write(event.Data); err != nil {
+			return fmt.Errorf("replay: writing response: %v", err)
+		}
+	}
+	return nil
+}
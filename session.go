@@ -0,0 +1,173 @@
+package jambo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SessionVersion is the format version written by Session.Save.
+const SessionVersion = 1
+
+// Session is the recorded transcript of an attach operation: every protocol
+// step with its timing and the raw bytes exchanged. Sessions are captured
+// with a Recorder and served back to the client code with Session.Replay.
+type Session struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	JVM     string         `json:"jvm"` // "HotSpot" or "OpenJ9"
+	Pid     int            `json:"pid"`
+	NsPid   int            `json:"nsPid"`
+	Command string         `json:"command"`
+	Args    []string       `json:"args,omitempty"`
+	Events  []SessionEvent `json:"events"`
+	Output  string         `json:"output"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// SessionEvent is a TraceEvent with its offset from the start of the recording.
+// Conn numbers the connections of the session from 1, in the order they
+// were made; it is 0 for steps outside a connection.
+type SessionEvent struct {
+	Offset  time.Duration `json:"offset"`
+	Step    string        `json:"step"`
+	Message string        `json:"message"`
+	Data    []byte        `json:"data,omitempty"`
+	Conn    int           `json:"conn,omitempty"`
+}
+
+// Recorder is a Tracer that captures a Session.
+//
+// Example:
+//
+//	rec := jambo.NewRecorder()
+//	output, err := proc.Attach("threaddump", nil, &jambo.Options{Tracer: rec})
+//	rec.Session(proc, "threaddump", nil, output, err).Save("session.json")
+type Recorder struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []SessionEvent
+	conns  map[uint64]int // TraceEvent.Conn to SessionEvent.Conn
+}
+
+// NewRecorder returns a Recorder whose offsets are relative to now.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now(), conns: make(map[uint64]int)}
+}
+
+// Trace records event.
+func (r *Recorder) Trace(event TraceEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conn := 0
+	if event.Conn != 0 {
+		if conn = r.conns[event.Conn]; conn == 0 {
+			conn = len(r.conns) + 1
+			r.conns[event.Conn] = conn
+		}
+	}
+
+	r.events = append(r.events, SessionEvent{
+		Offset:  event.Time.Sub(r.start),
+		Step:    event.Step,
+		Message: event.Message,
+		Data:    event.Data,
+		Conn:    conn,
+	})
+}
+
+// Session returns the recorded transcript of an attach to proc.
+func (r *Recorder) Session(proc *Process, command string, args []string, output string, err error) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := &Session{
+		Version: SessionVersion,
+		Created: r.start.UTC(),
+		Pid:     proc.Pid(),
+		NsPid:   proc.NsPid(),
+		Command: command,
+		Args:    args,
+		Events:  append([]SessionEvent(nil), r.events...),
+		Output:  output,
+	}
+	if proc.JVM() != nil {
+		session.JVM = proc.JVM().Type().String()
+	}
+	if err != nil {
+		session.Error = err.Error()
+	}
+	return session
+}
+
+// MultiTracer sends each event to all of its tracers.
+type MultiTracer []Tracer
+
+// Trace forwards event to every tracer.
+func (m MultiTracer) Trace(event TraceEvent) {
+	for _, tracer := range m {
+		tracer.Trace(event)
+	}
+}
+
+// LoadSession reads a Session written by Session.Save.
+func LoadSession(path string) (*Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("invalid session %s: %v", path, err)
+	}
+	if session.Version != SessionVersion {
+		return nil, fmt.Errorf("invalid session %s: unsupported version %d", path, session.Version)
+	}
+	return &session, nil
+}
+
+// Save writes the session as indented JSON. Data is base64-encoded so that
+// binary content and NUL separators survive unchanged.
+func (s *Session) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// connections returns the data exchanged on each connection of the
+// session, in order. Sessions recorded without connection numbers hold
+// one connection.
+func (s *Session) connections() [][]SessionEvent {
+	var conns [][]SessionEvent
+	index := make(map[int]int)
+	for _, event := range s.Events {
+		if event.Step != TraceSend && event.Step != TraceRecv {
+			continue
+		}
+		i, ok := index[event.Conn]
+		if !ok {
+			i = len(conns)
+			index[event.Conn] = i
+			conns = append(conns, nil)
+		}
+		conns[i] = append(conns[i], event)
+	}
+	return conns
+}
+
+// sent returns the concatenated data sent on a connection.
+func sent(events []SessionEvent) []byte {
+	var data []byte
+	for _, event := range events {
+		if event.Step == TraceSend {
+			data = append(data, event.Data...)
+		}
+	}
+	return data
+}
@@ -0,0 +1,104 @@
+package jambo
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Trace steps reported to a Tracer.
+const (
+	TraceNamespace  = "namespace"   // target namespace entered, shared or not enterable
+	TraceAttachFile = "attach-file" // HotSpot .attach_pid file created or removed
+	TraceSignal     = "signal"      // signal sent to the target
+	TracePoll       = "poll"        // HotSpot socket wait loop iteration
+	TraceConnect    = "connect"     // connection to the attach listener
+	TraceLock       = "lock"        // OpenJ9 file lock acquired or released
+	TraceReplyInfo  = "reply-info"  // OpenJ9 replyInfo file written
+	TraceSemop      = "semop"       // OpenJ9 semaphore operation
+	TraceCleanup    = "cleanup"     // stale attach state removed
+	TraceAccept     = "accept"      // OpenJ9 connect-back accepted and key verified
+	TraceSend       = "send"        // bytes sent to the JVM
+	TraceRecv       = "recv"        // bytes received from the JVM
+	TraceDryRun     = "dry-run"     // step skipped because of Options.DryRun
+)
+
+// TraceEvent describes one step of the attach protocol.
+type TraceEvent struct {
+	// Time is when the step happened.
+	Time time.Time
+
+	// Step is one of the Trace* constants.
+	Step string
+
+	// Message is a human-readable description of the step.
+	Message string
+
+	// Data holds the raw bytes exchanged with the JVM, if any.
+	Data []byte
+
+	// Conn identifies the connection to the JVM the step happened on, or
+	// is 0 for steps outside a connection. Every connection gets its own.
+	Conn uint64
+}
+
+// Tracer receives protocol events from attach operations.
+// Trace may be called from the attach thread and must not block for long.
+type Tracer interface {
+	Trace(event TraceEvent)
+}
+
+// NewWriterTracer returns a Tracer that writes events to w, one per line,
+// with the time elapsed since the tracer was created. Data is written as a
+// quoted Go string so NUL separators and binary content stay visible.
+func NewWriterTracer(w io.Writer) Tracer {
+	return &writerTracer{w: w, start: time.Now()}
+}
+
+type writerTracer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+func (t *writerTracer) Trace(event TraceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elapsed := event.Time.Sub(t.start).Seconds() * 1000
+	fmt.Fprintf(t.w, "[%9.3fms] %-11s %s\n", elapsed, event.Step, event.Message)
+	if len(event.Data) > 0 {
+		fmt.Fprintf(t.w, "%14s%s\n", "", strconv.Quote(string(event.Data)))
+	}
+}
+
+// trace reports a protocol step to options.Tracer, if one is set.
+func (o *Options) trace(step string, data []byte, format string, args ...any) {
+	o.traceConn(0, step, data, format, args...)
+}
+
+// traceConn reports a protocol step on connection conn, as numbered by
+// newConnID, to options.Tracer, if one is set.
+func (o *Options) traceConn(conn uint64, step string, data []byte, format string, args ...any) {
+	if o == nil || o.Tracer == nil {
+		return
+	}
+	o.Tracer.Trace(TraceEvent{
+		Time:    time.Now(),
+		Step:    step,
+		Message: fmt.Sprintf(format, args...),
+		Data:    append([]byte(nil), data...),
+		Conn:    conn,
+	})
+}
+
+// connIDs numbers the connections to JVMs for TraceEvent.Conn.
+var connIDs atomic.Uint64
+
+// newConnID returns the identifier of a new connection.
+func newConnID() uint64 {
+	return connIDs.Add(1)
+}
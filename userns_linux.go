@@ -0,0 +1,129 @@
+//go:build linux
+
+package jambo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// idMapping is one line of /proc/{pid}/uid_map or gid_map: count IDs
+// starting at inside in the process's user namespace are outside in the
+// user namespace of the reader.
+type idMapping struct {
+	inside, outside, count int
+}
+
+// idMap is the content of a uid_map or gid_map file.
+type idMap []idMapping
+
+// parseIDMap parses the content of a uid_map or gid_map file.
+func parseIDMap(data []byte) (idMap, error) {
+	var m idMap
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed id map line %q", line)
+		}
+		var values [3]int
+		for i, field := range fields {
+			v, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("malformed id map line %q", line)
+			}
+			values[i] = int(v)
+		}
+		m = append(m, idMapping{inside: values[0], outside: values[1], count: values[2]})
+	}
+	return m, nil
+}
+
+// toInside translates an ID of the reader's user namespace into the
+// namespace the map belongs to. It returns false for an unmapped ID, which
+// processes in that namespace see as the overflow ID (usually 65534).
+func (m idMap) toInside(id int) (int, bool) {
+	for _, r := range m {
+		if id >= r.outside && id-r.outside < r.count {
+			return r.inside + id - r.outside, true
+		}
+	}
+	return -1, false
+}
+
+// sharesUserNamespace reports whether pid is in the user namespace of the
+// current process. It assumes so if the namespaces cannot be compared.
+func sharesUserNamespace(pid int) bool {
+	var self, target syscall.Stat_t
+	if err := syscall.Stat("/proc/self/ns/user", &self); err != nil {
+		return true
+	}
+	if err := syscall.Stat(fmt.Sprintf(nsPath, pid, "user"), &target); err != nil {
+		return true
+	}
+	return self.Dev == target.Dev && self.Ino == target.Ino
+}
+
+// readIDMaps reads the uid and gid maps of pid's user namespace.
+func readIDMaps(pid int) (uidMap, gidMap idMap, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/uid_map", pid))
+	if err != nil {
+		return nil, nil, err
+	}
+	if uidMap, err = parseIDMap(data); err != nil {
+		return nil, nil, err
+	}
+	data, err = os.ReadFile(fmt.Sprintf("/proc/%d/gid_map", pid))
+	if err != nil {
+		return nil, nil, err
+	}
+	if gidMap, err = parseIDMap(data); err != nil {
+		return nil, nil, err
+	}
+	return uidMap, gidMap, nil
+}
+
+// getNamespaceIDs translates the host uid and gid of pid into its user
+// namespace. Outside of a user namespace, or if the maps cannot be read,
+// they are returned unchanged; unmapped IDs are returned as -1.
+func getNamespaceIDs(pid, uid, gid int) (nsUid, nsGid int) {
+	if sharesUserNamespace(pid) {
+		return uid, gid
+	}
+	uidMap, gidMap, err := readIDMaps(pid)
+	if err != nil {
+		return uid, gid
+	}
+	nsUid, _ = uidMap.toInside(uid)
+	nsGid, _ = gidMap.toInside(gid)
+	return nsUid, nsGid
+}
+
+// checkAttachOwner verifies that files created with the current effective
+// uid will be trusted by pid, a JVM running as nsUid in its user namespace.
+// Attach files must be owned by the JVM's own uid or by root as the JVM
+// sees them, i.e. after mapping into its user namespace; a file owned by an
+// unmapped uid is silently ignored, and the attach would only time out.
+func checkAttachOwner(pid, nsUid int) error {
+	if sharesUserNamespace(pid) {
+		return nil
+	}
+	uidMap, _, err := readIDMaps(pid)
+	if err != nil {
+		return nil
+	}
+	euid := os.Geteuid()
+	owner, mapped := uidMap.toInside(euid)
+	switch {
+	case !mapped:
+		return fmt.Errorf("%w: uid %d is not mapped in the user namespace of process %d; attach files it creates would not be trusted", ErrPermission, euid, pid)
+	case owner != nsUid && owner != 0:
+		return fmt.Errorf("%w: uid %d is uid %d in the user namespace of process %d, which runs as uid %d there", ErrPermission, euid, owner, pid, nsUid)
+	}
+	return nil
+}